@@ -109,6 +109,8 @@ type Restore struct {
 type TLS struct {
 	PluginName string `json:"pluginName,omitempty"`
 	LogLevel   string `json:"logLevel,omitempty"`
+	// KeyAlgorithm of the generated private keys, one of rsa-2048, rsa-3072, rsa-4096, ecdsa-p256, ecdsa-p384 or ed25519
+	KeyAlgorithm string `json:"keyAlgorithm,omitempty"`
 }
 
 // Volume describes a single volume in the manifest.
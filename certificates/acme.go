@@ -0,0 +1,433 @@
+package certificates
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	ACME = "acme"
+
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+
+	acmeAccountKeyName  = "acme-account"
+	defaultACMETimeout  = 10 * time.Minute
+	acmeHTTP01PathRoute = "/.well-known/acme-challenge/"
+)
+
+// ChallengeSolver fulfills the ACME challenges of a given type, so the CA can validate the domain ownership
+type ChallengeSolver interface {
+	// Type returns the challenge type the solver handles, e.g. http-01 or dns-01
+	Type() string
+	// Present publishes the challenge value. For http-01 the value is the key authorization
+	// to serve under /.well-known/acme-challenge/<token>, for dns-01 it is the TXT record for _acme-challenge.<domain>
+	Present(ctx context.Context, domain, token, value string) error
+	// CleanUp removes what Present has published
+	CleanUp(ctx context.Context, domain, token, value string) error
+}
+
+// ACMEStrategy obtains publicly trusted certificates from an ACME (RFC 8555) directory, such as Let's Encrypt or step-ca
+type ACMEStrategy struct {
+	Log        *logrus.Entry
+	Domain     string
+	CommonName string
+	BasePath   string
+	DNSNames   []string
+	// KeyAlgorithm used when the request does not ask for one, RSA 2048 by default
+	KeyAlgorithm KeyAlgorithm
+
+	DirectoryURL string
+	Email        string
+	Solvers      []ChallengeSolver
+	Timeout      time.Duration
+	HTTPClient   *http.Client
+
+	Secret SecretDeposit
+
+	generatedKeyPairs
+	requested RequestResponse
+}
+
+func (a *ACMEStrategy) Request(params RequestParams) (RequestResponse, error) {
+	response, err := a.request(params)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	a.requested = response
+	return response, nil
+}
+
+func (a *ACMEStrategy) request(params RequestParams) (RequestResponse, error) {
+	a.Log.Infof("requesting certificates from ACME directory %v", a.DirectoryURL)
+	if params.Usage == UsageClient {
+		return RequestResponse{}, fmt.Errorf("ACME CAs only issue server certificates")
+	}
+	if len(params.IPAddresses) > 0 {
+		return RequestResponse{}, fmt.Errorf("IP addresses are not supported by the ACME strategy")
+	}
+	algorithm, err := selectKeyAlgorithm(params.KeyAlgorithm, a.KeyAlgorithm)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	params.KeyAlgorithm = algorithm
+	// Publicly trusted CAs do not issue certificates for Ed25519 keys
+	if params.KeyAlgorithm == Ed25519 {
+		return RequestResponse{}, fmt.Errorf("key algorithm %v is not supported by ACME CAs", Ed25519)
+	}
+	location := a.getLocation(a.BasePath)
+	if !params.Force && fileExists(location.CertPath, location.KeyPath) {
+		chainPEM, keyPEM, err := readKeyPair(location.CertPath, location.KeyPath)
+		if err != nil {
+			return RequestResponse{}, err
+		}
+		if err := a.checkValidity(chainPEM, params); err == nil {
+			a.Log.Infof("certificates exist and are valid, skip request")
+			return newRequestResponse(chainPEM, keyPEM, nil)
+		}
+		a.Log.Infof("certificates exist, but are not valid anymore")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.getTimeout())
+	defer cancel()
+
+	client, err := a.getClient(ctx)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+
+	var orderOptions []acme.OrderOption
+	if params.Validity > 0 {
+		orderOptions = append(orderOptions, acme.WithOrderNotAfter(time.Now().Add(params.Validity)))
+	}
+	dnsNames := a.getDNSNames(params)
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(dnsNames...), orderOptions...)
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not create order: %v", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorize(ctx, client, authzURL); err != nil {
+			return RequestResponse{}, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return RequestResponse{}, fmt.Errorf("order is not ready: %v", err)
+	}
+
+	privateKey, err := generateKey(params.KeyAlgorithm)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: a.getCommonName(params)},
+		DNSNames: dnsNames,
+	}, privateKey)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not finalize order: %v", err)
+	}
+
+	chainPEM := new(bytes.Buffer)
+	for _, der := range chain {
+		if err := pem.Encode(chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return RequestResponse{}, err
+		}
+	}
+	keyPEM, err := encodePrivateKey(privateKey)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	a.Log.Infof("certificates have been issued for %v", a.getCommonName(params))
+
+	a.Cert = chainPEM.Bytes()
+	a.Key = keyPEM
+	// Publicly trusted certificates chain to the system roots
+	return newRequestResponse(a.Cert, a.Key, nil)
+}
+
+func (a *ACMEStrategy) Deposit(params DepositParams) (DepositResponse, error) {
+	if params.Target == DepositTargetKubernetes {
+		return a.Secret.deposit(params.getContext(), a.requested)
+	}
+	if err := checkDepositTarget(params.Target); err != nil {
+		return DepositResponse{}, err
+	}
+	location := a.getLocation(params.getBasePath(a.BasePath))
+	if a.Cert == nil {
+		return DepositResponse{Location: location}, nil
+	}
+	a.Log.Infof("storing certificates")
+
+	if err := writeKeyPair(location.CertPath, location.KeyPath, a.Cert, a.Key); err != nil {
+		return DepositResponse{}, err
+	}
+
+	a.Log.Infof("certificates stored at: %v, %v", location.CertPath, location.KeyPath)
+	return DepositResponse{Location: location}, nil
+}
+
+func (a *ACMEStrategy) GetLocations(params GetLocationParams) (Location, error) {
+	return a.getLocation(a.BasePath), nil
+}
+
+func (a *ACMEStrategy) getLocation(basePath string) Location {
+	return Location{
+		CertPath: a.getPath(basePath, a.Domain, certExt),
+		KeyPath:  a.getPath(basePath, a.Domain, keyExt),
+	}
+}
+
+// getClient returns a client bound to the ACME account, the account is registered the first time
+func (a *ACMEStrategy) getClient(ctx context.Context) (*acme.Client, error) {
+	accountKey, err := a.loadOrCreateAccountKey()
+	if err != nil {
+		return nil, fmt.Errorf("could not loadOrCreateAccountKey: %v", err)
+	}
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: a.DirectoryURL,
+		HTTPClient:   a.HTTPClient,
+	}
+
+	account := &acme.Account{}
+	if a.Email != "" {
+		account.Contact = []string{"mailto:" + a.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("could not register ACME account: %v", err)
+	}
+
+	return client, nil
+}
+
+func (a *ACMEStrategy) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("could not GetAuthorization: %v", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	challenge, solver := a.pickChallenge(authz)
+	if challenge == nil {
+		return fmt.Errorf("no solver configured for any of the challenges offered for %v", authz.Identifier.Value)
+	}
+
+	var value string
+	switch challenge.Type {
+	case ChallengeHTTP01:
+		value, err = client.HTTP01ChallengeResponse(challenge.Token)
+	case ChallengeDNS01:
+		value, err = client.DNS01ChallengeRecord(challenge.Token)
+	default:
+		err = fmt.Errorf("unsupported challenge type %v", challenge.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	domain := authz.Identifier.Value
+	a.Log.Infof("solving %v challenge for %v", challenge.Type, domain)
+	if err := solver.Present(ctx, domain, challenge.Token, value); err != nil {
+		return fmt.Errorf("could not present %v challenge for %v: %v", challenge.Type, domain, err)
+	}
+	defer func() {
+		if err := solver.CleanUp(ctx, domain, challenge.Token, value); err != nil {
+			a.Log.WithError(err).Warnf("could not clean up %v challenge for %v", challenge.Type, domain)
+		}
+	}()
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("could not accept %v challenge for %v: %v", challenge.Type, domain, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization for %v failed: %v", domain, err)
+	}
+	return nil
+}
+
+// pickChallenge returns the first offered challenge, in order of the configured solvers
+func (a *ACMEStrategy) pickChallenge(authz *acme.Authorization) (*acme.Challenge, ChallengeSolver) {
+	for _, solver := range a.Solvers {
+		for _, challenge := range authz.Challenges {
+			if challenge.Type == solver.Type() {
+				return challenge, solver
+			}
+		}
+	}
+	return nil, nil
+}
+
+// loadOrCreateAccountKey reuses the key of the ACME account, which is written atomically so that a crash never
+// leaves a truncated key making the next run register a new account
+func (a *ACMEStrategy) loadOrCreateAccountKey() (crypto.Signer, error) {
+	keyPath := a.getPath(a.BasePath, acmeAccountKeyName, keyExt)
+	if fileExists(keyPath) {
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		return parsePrivateKey(keyPEM)
+	}
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodePrivateKey(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(a.BasePath, 0755); err != nil {
+		return nil, err
+	}
+	tmpKeyPath, err := writeTempFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpKeyPath, keyPath); err != nil {
+		os.Remove(tmpKeyPath)
+		return nil, err
+	}
+	return accountKey, nil
+}
+
+// checkValidity makes sure the stored leaf covers the domain and has not expired.
+// The chain itself was validated by the ACME CA when it has been issued
+func (a *ACMEStrategy) checkValidity(chainPEM []byte, params RequestParams) error {
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return err
+	}
+	leaf := chain[0]
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %v", leaf.NotAfter)
+	}
+	if leaf.Subject.CommonName != a.getCommonName(params) {
+		return fmt.Errorf("certificate has been issued for %v", leaf.Subject.CommonName)
+	}
+	if err := checkStoredKeyAlgorithm(chainPEM, params.KeyAlgorithm); err != nil {
+		return err
+	}
+	return coversNames(chainPEM, a.getDNSNames(params), nil)
+}
+
+// getDNSNames returns the names of the order, public CAs require the common name to be one of them
+func (a *ACMEStrategy) getDNSNames(params RequestParams) []string {
+	return mergeNames([]string{a.Domain, a.getCommonName(params)}, a.DNSNames, params.DNSNames)
+}
+
+func (a *ACMEStrategy) getCommonName(params RequestParams) string {
+	if params.CommonName != "" {
+		return params.CommonName
+	}
+	if a.CommonName != "" {
+		return a.CommonName
+	}
+	return a.Domain
+}
+
+func (a *ACMEStrategy) getTimeout() time.Duration {
+	if a.Timeout <= 0 {
+		return defaultACMETimeout
+	}
+	return a.Timeout
+}
+
+func (a *ACMEStrategy) getPath(basePath, name, extension string) string {
+	return fmt.Sprintf("%s/%s.%s", basePath, name, extension)
+}
+
+// HTTP01Solver serves the http-01 key authorizations, it must be reachable on port 80 of every requested domain
+type HTTP01Solver struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func (h *HTTP01Solver) Type() string {
+	return ChallengeHTTP01
+}
+
+func (h *HTTP01Solver) Present(ctx context.Context, domain, token, value string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens == nil {
+		h.tokens = map[string]string{}
+	}
+	h.tokens[token] = value
+	return nil
+}
+
+func (h *HTTP01Solver) CleanUp(ctx context.Context, domain, token, value string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.tokens, token)
+	return nil
+}
+
+func (h *HTTP01Solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, acmeHTTP01PathRoute) {
+		http.NotFound(w, r)
+		return
+	}
+	h.mu.RLock()
+	value, ok := h.tokens[strings.TrimPrefix(r.URL.Path, acmeHTTP01PathRoute)]
+	h.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(value))
+}
+
+// DNS01Solver delegates the TXT record management to the DNS provider hooks
+type DNS01Solver struct {
+	// PresentRecord creates the TXT record fqdn with the given value, e.g. _acme-challenge.example.org
+	PresentRecord func(ctx context.Context, fqdn, value string) error
+	// CleanUpRecord deletes the TXT record created by PresentRecord
+	CleanUpRecord func(ctx context.Context, fqdn, value string) error
+}
+
+func (d *DNS01Solver) Type() string {
+	return ChallengeDNS01
+}
+
+func (d *DNS01Solver) Present(ctx context.Context, domain, token, value string) error {
+	if d.PresentRecord == nil {
+		return fmt.Errorf("PresentRecord hook is not configured")
+	}
+	return d.PresentRecord(ctx, getDNS01RecordName(domain), value)
+}
+
+func (d *DNS01Solver) CleanUp(ctx context.Context, domain, token, value string) error {
+	if d.CleanUpRecord == nil {
+		return nil
+	}
+	return d.CleanUpRecord(ctx, getDNS01RecordName(domain), value)
+}
+
+func getDNS01RecordName(domain string) string {
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+}
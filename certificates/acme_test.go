@@ -0,0 +1,224 @@
+package certificates
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/borealisdb/commons/logger"
+)
+
+// fakeACMEServer implements the happy path of RFC 8555 with http-01 challenges,
+// JWS signatures are not verified
+type fakeACMEServer struct {
+	t       *testing.T
+	server  *httptest.Server
+	issuer  *issuer
+	solver  *HTTP01Solver
+	mu      sync.Mutex
+	nonce   int
+	domains []string
+	valid   map[int]bool
+	certPEM []byte
+}
+
+func (f *fakeACMEServer) url(path string) string {
+	return f.server.URL + path
+}
+
+func (f *fakeACMEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/directory" {
+		fmt.Fprintf(w, `{"newNonce": %q, "newAccount": %q, "newOrder": %q}`,
+			f.url("/new-nonce"), f.url("/new-account"), f.url("/new-order"))
+		return
+	}
+	f.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", f.nonce))
+
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &jws); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	}
+
+	switch {
+	case r.URL.Path == "/new-nonce":
+	case r.URL.Path == "/new-account":
+		w.Header().Set("Location", f.url("/accounts/1"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"status": "valid"}`)
+	case r.URL.Path == "/new-order":
+		var order struct {
+			Identifiers []struct{ Value string }
+		}
+		_ = json.Unmarshal(payload, &order)
+		f.domains = nil
+		for _, identifier := range order.Identifiers {
+			f.domains = append(f.domains, identifier.Value)
+		}
+		w.Header().Set("Location", f.url("/orders/1"))
+		w.WriteHeader(http.StatusCreated)
+		f.writeOrder(w)
+	case r.URL.Path == "/orders/1":
+		w.Header().Set("Location", f.url("/orders/1"))
+		f.writeOrder(w)
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		var i int
+		fmt.Sscanf(r.URL.Path, "/authz/%d", &i)
+		status := "pending"
+		if f.valid[i] {
+			status = "valid"
+		}
+		fmt.Fprintf(w, `{"status": %q, "identifier": {"type": "dns", "value": %q}, "challenges": [
+			{"type": "tls-alpn-01", "url": %q, "token": "alpn%d", "status": "pending"},
+			{"type": "http-01", "url": %q, "token": "token%d", "status": "pending"}]}`,
+			status, f.domains[i], f.url(fmt.Sprintf("/chal/alpn/%d", i)), i, f.url(fmt.Sprintf("/chal/%d", i)), i)
+	case strings.HasPrefix(r.URL.Path, "/chal/"):
+		var i int
+		fmt.Sscanf(r.URL.Path, "/chal/%d", &i)
+		// validate the challenge as the CA would, by fetching the key authorization
+		token := fmt.Sprintf("token%d", i)
+		recorder := httptest.NewRecorder()
+		f.solver.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, acmeHTTP01PathRoute+token, nil))
+		if !strings.HasPrefix(recorder.Body.String(), token+".") {
+			f.t.Errorf("http-01 challenge for %v not presented", f.domains[i])
+		}
+		f.valid[i] = true
+		fmt.Fprintf(w, `{"type": "http-01", "url": %q, "token": %q, "status": "valid"}`, f.url(r.URL.Path), token)
+	case r.URL.Path == "/orders/1/finalize":
+		var finalize struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(payload, &finalize)
+		der, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		certBytes, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, f.issuer.cert, csr.PublicKey, f.issuer.key)
+		if err != nil {
+			f.t.Errorf("could not sign csr: %v", err)
+			return
+		}
+		f.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+		f.certPEM = append(f.certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.issuer.cert.Raw})...)
+		w.Header().Set("Location", f.url("/orders/1"))
+		f.writeOrder(w)
+	case r.URL.Path == "/certificates/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(f.certPEM)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeACMEServer) writeOrder(w http.ResponseWriter) {
+	status := "ready"
+	var authorizations []string
+	for i := range f.domains {
+		authorizations = append(authorizations, f.url(fmt.Sprintf("/authz/%d", i)))
+		if !f.valid[i] {
+			status = "pending"
+		}
+	}
+	certificate := ""
+	if f.certPEM != nil {
+		status = "valid"
+		certificate = f.url("/certificates/1")
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         status,
+		"authorizations": authorizations,
+		"finalize":       f.url("/orders/1/finalize"),
+		"certificate":    certificate,
+	})
+}
+
+func TestACMEStrategy_Request(t *testing.T) {
+	iss, _, err := makeRootCert(DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("makeRootCert(DefaultKeyAlgorithm) error = %v", err)
+	}
+	solver := &HTTP01Solver{}
+	fake := &fakeACMEServer{t: t, issuer: iss, solver: solver, valid: map[int]bool{}}
+	fake.server = httptest.NewServer(fake)
+	defer fake.server.Close()
+
+	strategy := GetStrategy(ACME, StrategiesParams{
+		Domain:           "mycluster.borealisdb.io",
+		CommonName:       "primary.mycluster.borealisdb.io",
+		DNSNames:         []string{"mycluster-repl.borealisdb.io"},
+		BasePath:         t.TempDir(),
+		ACMEDirectoryURL: fake.url("/directory"),
+		ACMEEmail:        "admin@borealisdb.io",
+		ChallengeSolvers: []ChallengeSolver{&DNS01Solver{}, solver},
+		Log:              logger.NewDefaultLogger("info", "certificates"),
+	})
+	if _, err := strategy.Request(RequestParams{}); err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if _, err := strategy.Deposit(DepositParams{}); err != nil {
+		t.Fatalf("Deposit() error = %v", err)
+	}
+
+	location, _ := strategy.GetLocations(GetLocationParams{})
+	chain, err := parseCertificates(readFile(t, location.CertPath))
+	if err != nil {
+		t.Fatalf("parseCertificates() error = %v", err)
+	}
+	if len(chain) != 2 {
+		t.Errorf("chain length = %v, want 2", len(chain))
+	}
+	if got := chain[0].Subject.CommonName; got != "primary.mycluster.borealisdb.io" {
+		t.Errorf("CommonName = %v, want primary.mycluster.borealisdb.io", got)
+	}
+	for _, name := range []string{"mycluster.borealisdb.io", "primary.mycluster.borealisdb.io", "mycluster-repl.borealisdb.io"} {
+		if err := chain[0].VerifyHostname(name); err != nil {
+			t.Errorf("VerifyHostname() error = %v", err)
+		}
+	}
+	if len(solver.tokens) != 0 {
+		t.Errorf("challenges have not been cleaned up: %v", solver.tokens)
+	}
+	acme := strategy.(*ACMEStrategy)
+	accountKeyPEM := readFile(t, acme.getPath(acme.BasePath, acmeAccountKeyName, keyExt))
+	if block, _ := pem.Decode(accountKeyPEM); block == nil || block.Type != "PRIVATE KEY" {
+		t.Errorf("account key is not stored as PKCS#8")
+	}
+
+	// The stored certificate is still valid, the ACME directory must not be contacted again
+	fake.server.Close()
+	if _, err := strategy.Request(RequestParams{}); err != nil {
+		t.Errorf("Request() with valid certificates error = %v", err)
+	}
+}
@@ -3,14 +3,12 @@ package certificates
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"io/fs"
 	"io/ioutil"
 	"math/big"
 	"os"
@@ -22,6 +20,8 @@ const (
 
 	certExt = "crt"
 	keyExt  = "key"
+
+	autogeneratedValidity = time.Hour * 24 * 180
 )
 
 type generatedKeyPairs struct {
@@ -34,59 +34,111 @@ type AutoGenerateStrategy struct {
 	Domain     string
 	CommonName string
 	BasePath   string
+	// KeyAlgorithm used when the request does not ask for one, RSA 2048 by default
+	KeyAlgorithm KeyAlgorithm
+
+	Secret SecretDeposit
+
 	generatedKeyPairs
+	requested RequestResponse
+	// usage of the requested certificate, client certificates are stored apart from the server ones
+	usage Usage
 }
 
 func (c *AutoGenerateStrategy) Request(params RequestParams) (RequestResponse, error) {
+	response, err := c.request(params)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	c.requested, c.usage = response, params.Usage
+	return response, nil
+}
+
+func (c *AutoGenerateStrategy) request(params RequestParams) (RequestResponse, error) {
 	c.Log.Infof("requesting certificats")
-	if c.exists() {
-		isExpired, err := c.isExpired()
+	algorithm, err := selectKeyAlgorithm(params.KeyAlgorithm, c.KeyAlgorithm)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	params.KeyAlgorithm = algorithm
+	if _, err := getExtKeyUsage(params.Usage); err != nil {
+		return RequestResponse{}, err
+	}
+	c.generatedKeyPairs = generatedKeyPairs{}
+	if params.Force {
+		c.Log.Infof("certificates renewal has been forced")
+		return c.generate(params)
+	}
+	if c.exists(params.Usage) {
+		isExpired, err := c.isExpired(params.Usage)
 		if err != nil {
 			return RequestResponse{}, err
 		}
 		if isExpired {
 			c.Log.Infof("certificates exist, but are expired")
-			if err := c.generate(); err != nil {
-				return RequestResponse{}, err
-			}
-
-			return RequestResponse{}, nil
+			return c.generate(params)
+		}
+		response, err := c.readStored(params.Usage)
+		if err != nil {
+			return RequestResponse{}, err
+		}
+		if err := checkLeafUsage(response.Certificate, c.getCommonName(params), params.Usage); err != nil {
+			c.Log.Infof("certificates exist, but %v", err)
+			return c.generate(params)
+		}
+		if err := coversNames(response.Certificate, params.DNSNames, params.IPAddresses); err != nil {
+			c.Log.Infof("certificates exist, but %v", err)
+			return c.generate(params)
+		}
+		if err := checkStoredKeyAlgorithm(response.Certificate, params.KeyAlgorithm); err != nil {
+			c.Log.Infof("certificates exist, but %v", err)
+			return c.generate(params)
 		}
 		c.Log.Infof("certificates exist, skip generation")
-		return RequestResponse{}, nil
+		return response, nil
 	}
 	c.Log.Infof("certificates do not exist")
 
-	if err := c.generate(); err != nil {
-		return RequestResponse{}, err
-	}
-
-	return RequestResponse{}, nil
+	return c.generate(params)
 }
 
-func (c *AutoGenerateStrategy) generate() error {
+func (c *AutoGenerateStrategy) generate(params RequestParams) (RequestResponse, error) {
 	c.Log.Infof("generating certificates")
-	certPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	certPrivateKey, err := generateKey(params.KeyAlgorithm)
 	if err != nil {
-		c.Log.WithError(err).Fatal()
+		return RequestResponse{}, err
+	}
+	extKeyUsage, err := getExtKeyUsage(params.Usage)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	parsedIPs, err := parseIPs(params.IPAddresses)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	validity := params.Validity
+	if validity <= 0 {
+		validity = autogeneratedValidity
 	}
 
 	template := x509.Certificate{
 		SerialNumber: big.NewInt(1),
 		Subject: pkix.Name{
-			CommonName: c.CommonName,
+			CommonName: c.getCommonName(params),
 		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(time.Hour * 24 * 180),
+		DNSNames:    mergeNames([]string{c.Domain}, params.DNSNames),
+		IPAddresses: parsedIPs,
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validity),
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              getKeyUsage(certPrivateKey.Public()),
+		ExtKeyUsage:           extKeyUsage,
 		BasicConstraintsValid: true,
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &certPrivateKey.PublicKey, certPrivateKey)
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, certPrivateKey.Public(), certPrivateKey)
 	if err != nil {
-		return err
+		return RequestResponse{}, err
 	}
 
 	certPEM := new(bytes.Buffer)
@@ -94,59 +146,72 @@ func (c *AutoGenerateStrategy) generate() error {
 		Type:  "CERTIFICATE",
 		Bytes: certBytes,
 	}); err != nil {
-		return err
+		return RequestResponse{}, err
 	}
 
-	certPrivateKeyPEM := new(bytes.Buffer)
-	if err := pem.Encode(certPrivateKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certPrivateKey),
-	}); err != nil {
-		return err
+	certPrivateKeyPEM, err := encodePrivateKey(certPrivateKey)
+	if err != nil {
+		return RequestResponse{}, err
 	}
 	c.Log.Infof("certificates have been generated")
 
 	c.Cert = certPEM.Bytes()
-	c.Key = certPrivateKeyPEM.Bytes()
-	return nil
+	c.Key = certPrivateKeyPEM
+	// The certificate is self signed, thus it is its own CA
+	return newRequestResponse(c.Cert, c.Key, c.Cert)
 }
 
-func (c *AutoGenerateStrategy) Deposit(params DepositParams) (DepositResponse, error) {
-	c.Log.Infof("storing certificates")
-
-	if c.exists() {
-		return DepositResponse{}, nil
+func (c *AutoGenerateStrategy) readStored(usage Usage) (RequestResponse, error) {
+	certPEM, keyPEM, err := readKeyPair(c.getLocation(c.BasePath).pairPaths(usage))
+	if err != nil {
+		return RequestResponse{}, err
 	}
+	return newRequestResponse(certPEM, keyPEM, certPEM)
+}
 
-	if err := os.MkdirAll(c.BasePath, fs.ModePerm); err != nil {
-		return DepositResponse{}, err
+func (c *AutoGenerateStrategy) Deposit(params DepositParams) (DepositResponse, error) {
+	if params.Target == DepositTargetKubernetes {
+		return c.Secret.depositLeaf(params.getContext(), c.usage, c.requested)
 	}
-
-	certPath := c.getPath(certExt)
-	keyPath := c.getPath(keyExt)
-
-	if err := ioutil.WriteFile(certPath, c.Cert, fs.ModePerm); err != nil {
+	if err := checkDepositTarget(params.Target); err != nil {
 		return DepositResponse{}, err
 	}
-	if err := ioutil.WriteFile(keyPath, c.Key, fs.ModePerm); err != nil {
+	basePath := params.getBasePath(c.BasePath)
+	location := c.getLocation(basePath)
+	if c.Cert == nil {
+		return DepositResponse{Location: location}, nil
+	}
+	c.Log.Infof("storing certificates")
+
+	certPath, keyPath := location.pairPaths(c.usage)
+	if err := writeKeyPair(certPath, keyPath, c.Cert, c.Key); err != nil {
 		return DepositResponse{}, err
 	}
 
 	c.Log.Infof("certificates stored at: %v, %v", certPath, keyPath)
 
-	return DepositResponse{}, nil
+	return DepositResponse{Location: location}, nil
 }
 
 func (c *AutoGenerateStrategy) GetLocations(params GetLocationParams) (Location, error) {
+	return c.getLocation(c.BasePath), nil
+}
+
+func (c *AutoGenerateStrategy) getLocation(basePath string) Location {
+	clientName := fmt.Sprintf("%v-%v", c.Domain, clientSuffix)
 	return Location{
-		CertPath: c.getPath(certExt),
-		KeyPath:  c.getPath(keyExt),
-	}, nil
+		CertPath:       c.getPath(basePath, c.Domain, certExt),
+		KeyPath:        c.getPath(basePath, c.Domain, keyExt),
+		CAPath:         c.getPath(basePath, c.Domain, certExt),
+		ClientCertPath: c.getPath(basePath, clientName, certExt),
+		ClientKeyPath:  c.getPath(basePath, clientName, keyExt),
+	}
 }
 
-func (c *AutoGenerateStrategy) isExpired() (bool, error) {
+func (c *AutoGenerateStrategy) isExpired(usage Usage) (bool, error) {
 	c.Log.Infof("checking certifcates validity")
-	rootPEM, err := ioutil.ReadFile(c.getPath(certExt))
+	certPath, _ := c.getLocation(c.BasePath).pairPaths(usage)
+	rootPEM, err := ioutil.ReadFile(certPath)
 	if err != nil {
 		return false, err
 	}
@@ -171,7 +236,7 @@ func (c *AutoGenerateStrategy) isExpired() (bool, error) {
 		Intermediates:             nil,
 		Roots:                     roots,
 		CurrentTime:               time.Now(),
-		KeyUsages:                 nil,
+		KeyUsages:                 []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
 		MaxConstraintComparisions: 0,
 	}
 
@@ -190,9 +255,8 @@ func (c *AutoGenerateStrategy) isExpired() (bool, error) {
 	return false, nil
 }
 
-func (c *AutoGenerateStrategy) exists() bool {
-	certPath := c.getPath(certExt)
-	keyPath := c.getPath(keyExt)
+func (c *AutoGenerateStrategy) exists(usage Usage) bool {
+	certPath, keyPath := c.getLocation(c.BasePath).pairPaths(usage)
 	if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
 		return false
 	}
@@ -202,6 +266,13 @@ func (c *AutoGenerateStrategy) exists() bool {
 	return true
 }
 
-func (c *AutoGenerateStrategy) getPath(extension string) string {
-	return fmt.Sprintf("%s/%s.%s", c.BasePath, c.Domain, extension)
+func (c *AutoGenerateStrategy) getCommonName(params RequestParams) string {
+	if params.CommonName != "" {
+		return params.CommonName
+	}
+	return c.CommonName
+}
+
+func (c *AutoGenerateStrategy) getPath(basePath, name, extension string) string {
+	return fmt.Sprintf("%s/%s.%s", basePath, name, extension)
 }
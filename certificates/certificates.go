@@ -1,5 +1,10 @@
 package certificates
 
+import (
+	"context"
+	"time"
+)
+
 // CertificateAuthority
 // The idea is that in the future Borealis could have its own CA to manage, rotate and issue certificates centrally
 type CertificateAuthority interface {
@@ -14,16 +19,100 @@ type CertificateAuthority interface {
 type Location struct {
 	CertPath string
 	KeyPath  string
+	CAPath   string
+	// IntermediatePath holds the intermediate CA, which is already bundled after the leaves of CertPath and ClientCertPath
+	IntermediatePath string
+
+	ClientCertPath string
+	ClientKeyPath  string
+
+	// CRLPath is set once a certificate revocation list has been deposited
+	CRLPath string
+
+	// SecretName is set when the certificates are stored in a Kubernetes secret
+	SecretName string
 }
 
+// PostgresParameters returns the server TLS settings of postgresql.conf pointing to the stored files
+func (l Location) PostgresParameters() map[string]string {
+	parameters := map[string]string{}
+	for name, path := range map[string]string{
+		"ssl_cert_file": l.CertPath,
+		"ssl_key_file":  l.KeyPath,
+		"ssl_ca_file":   l.CAPath,
+		"ssl_crl_file":  l.CRLPath,
+	} {
+		if path != "" {
+			parameters[name] = path
+		}
+	}
+	return parameters
+}
+
+// Usage of the requested certificate
+type Usage string
+
+const (
+	UsageServer Usage = "server"
+	UsageClient Usage = "client"
+)
+
+// KeyAlgorithm of the private key generated along with the certificate
+type KeyAlgorithm string
+
+const (
+	RSA2048   KeyAlgorithm = "rsa-2048"
+	RSA3072   KeyAlgorithm = "rsa-3072"
+	RSA4096   KeyAlgorithm = "rsa-4096"
+	ECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	ECDSAP384 KeyAlgorithm = "ecdsa-p384"
+	Ed25519   KeyAlgorithm = "ed25519"
+
+	DefaultKeyAlgorithm = RSA2048
+)
+
+// RequestParams describes the certificate to request, the strategy defaults are used for every empty field
 type RequestParams struct {
+	// CommonName of the certificate subject
+	CommonName string
+	// DNSNames and IPAddresses are added as SANs on top of the ones configured for the strategy
+	DNSNames    []string
+	IPAddresses []string
+	// Validity of the certificate, some CAs might not honour it
+	Validity time.Duration
+	// KeyAlgorithm overrides the one configured for the strategy
+	KeyAlgorithm KeyAlgorithm
+	// Usage selects between a server and a client certificate, server by default
+	Usage Usage
+	// Force issues new certificates even when the stored ones are still valid, e.g. to renew them ahead of expiry
+	Force bool
 }
+
 type RequestResponse struct {
+	// Certificate PEM chain, leaf first
+	Certificate []byte
+	// Key PEM encoded private key of the leaf
+	Key []byte
+	// CA PEM encoded certificate of the authority which issued the leaf, when known
+	CA       []byte
+	NotAfter time.Time
 }
 
+const (
+	DepositTargetFilesystem = "filesystem"
+	DepositTargetKubernetes = "kubernetes"
+)
+
 type DepositParams struct {
+	// Target where the certificates are stored, the filesystem by default
+	Target string
+	// BasePath overrides the strategy BasePath for the filesystem target
+	BasePath string
+	// Context bounds the calls to the Kubernetes target, context.Background() by default
+	Context context.Context
 }
 type DepositResponse struct {
+	Location Location
 }
 
 type GetLocationParams struct {
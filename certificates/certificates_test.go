@@ -0,0 +1,201 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/borealisdb/commons/logger"
+)
+
+func TestStrategies_RequestContract(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		params   RequestParams
+		wantErr  bool
+	}{
+		{
+			name:     "autogenerated server certificate",
+			strategy: Autogenerated,
+			params: RequestParams{
+				DNSNames:    []string{"mycluster.test.svc.cluster.local"},
+				IPAddresses: []string{"10.0.0.1"},
+				Validity:    48 * time.Hour,
+			},
+		},
+		{
+			name:     "internal CA server certificate",
+			strategy: InternalCA,
+			params: RequestParams{
+				DNSNames:    []string{"mycluster.example.org"},
+				IPAddresses: []string{"10.0.0.1"},
+				Validity:    48 * time.Hour,
+			},
+		},
+		{
+			name:     "internal CA client certificate",
+			strategy: InternalCA,
+			params: RequestParams{
+				CommonName: "application",
+				Validity:   48 * time.Hour,
+				Usage:      UsageClient,
+			},
+		},
+		{
+			name:     "autogenerated client certificate",
+			strategy: Autogenerated,
+			params: RequestParams{
+				CommonName: "application",
+				Validity:   48 * time.Hour,
+				Usage:      UsageClient,
+			},
+		},
+		{
+			name:     "autogenerated ECDSA certificate",
+			strategy: Autogenerated,
+			params: RequestParams{
+				Validity:     48 * time.Hour,
+				KeyAlgorithm: ECDSAP256,
+			},
+		},
+		{
+			name:     "internal CA Ed25519 certificate",
+			strategy: InternalCA,
+			params: RequestParams{
+				Validity:     48 * time.Hour,
+				KeyAlgorithm: Ed25519,
+			},
+		},
+		{
+			name:     "unsupported key algorithm",
+			strategy: Autogenerated,
+			params:   RequestParams{KeyAlgorithm: "dsa-1024"},
+			wantErr:  true,
+		},
+		{
+			name:     "unsupported usage",
+			strategy: InternalCA,
+			params:   RequestParams{Usage: "peer"},
+			wantErr:  true,
+		},
+		{
+			name:     "noop strategy with an unsupported usage",
+			strategy: Noop,
+			params:   RequestParams{Usage: "peer"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := GetStrategy(tt.strategy, StrategiesParams{
+				Domain:     "mycluster.borealisdb.io",
+				CommonName: "mycluster",
+				BasePath:   t.TempDir(),
+				Log:        logger.NewDefaultLogger("info", "certificates"),
+			})
+			response, err := strategy.Request(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Request() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			usage := x509.ExtKeyUsageServerAuth
+			if tt.params.Usage == UsageClient {
+				usage = x509.ExtKeyUsageClientAuth
+			}
+			if err := verifyLeaf(response.Certificate, response.CA, "", usage); err != nil {
+				t.Errorf("returned certificate does not chain to the returned CA: %v", err)
+			}
+			if len(response.Key) == 0 {
+				t.Errorf("no key returned")
+			}
+			if err := coversNames(response.Certificate, tt.params.DNSNames, tt.params.IPAddresses); err != nil {
+				t.Errorf("returned certificate does not cover the requested names: %v", err)
+			}
+			if want := time.Now().Add(tt.params.Validity); response.NotAfter.Before(want.Add(-time.Minute)) || response.NotAfter.After(want) {
+				t.Errorf("NotAfter = %v, want %v", response.NotAfter, want)
+			}
+			leaf, _ := parseCertificates(response.Certificate)
+			if tt.params.CommonName != "" && leaf[0].Subject.CommonName != tt.params.CommonName {
+				t.Errorf("CommonName = %v, want %v", leaf[0].Subject.CommonName, tt.params.CommonName)
+			}
+			wantAlgorithm := tt.params.KeyAlgorithm
+			if wantAlgorithm == "" {
+				wantAlgorithm = DefaultKeyAlgorithm
+			}
+			if algorithm := keyAlgorithmOf(leaf[0].PublicKey); algorithm != wantAlgorithm {
+				t.Errorf("key algorithm = %v, want %v", algorithm, wantAlgorithm)
+			}
+			if block, _ := pem.Decode(response.Key); block == nil || block.Type != "PRIVATE KEY" {
+				t.Errorf("key is not PKCS#8 encoded")
+			}
+			if _, err := parsePrivateKey(response.Key); err != nil {
+				t.Errorf("could not parse key: %v", err)
+			}
+			wantKeyEncipherment := strings.HasPrefix(string(wantAlgorithm), "rsa")
+			if hasKeyEncipherment := leaf[0].KeyUsage&x509.KeyUsageKeyEncipherment != 0; hasKeyEncipherment != wantKeyEncipherment {
+				t.Errorf("key encipherment usage = %v, want %v", hasKeyEncipherment, wantKeyEncipherment)
+			}
+
+			basePath := filepath.Join(t.TempDir(), "deposit")
+			deposited, err := strategy.Deposit(DepositParams{BasePath: basePath})
+			if err != nil {
+				t.Fatalf("Deposit() error = %v", err)
+			}
+			certPath, _ := deposited.Location.pairPaths(tt.params.Usage)
+			if filepath.Dir(certPath) != basePath {
+				t.Errorf("certificate path = %v, want it under %v", certPath, basePath)
+			}
+			readFile(t, certPath)
+			// Self signed client certificates are their own CA
+			if tt.params.Usage != UsageClient {
+				readFile(t, deposited.Location.CAPath)
+			}
+
+			if _, err := strategy.Deposit(DepositParams{Target: "s3"}); err == nil {
+				t.Errorf("Deposit() to an unsupported target should fail")
+			}
+		})
+	}
+}
+
+func TestAutoGenerateStrategy_ClientCertificate(t *testing.T) {
+	strategy := GetStrategy(Autogenerated, StrategiesParams{
+		Domain:     "mycluster.borealisdb.io",
+		CommonName: "mycluster",
+		BasePath:   t.TempDir(),
+		Log:        logger.NewDefaultLogger("info", "certificates"),
+	})
+	if _, err := strategy.Request(RequestParams{}); err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	deposited, err := strategy.Deposit(DepositParams{})
+	if err != nil {
+		t.Fatalf("Deposit() error = %v", err)
+	}
+	serverPEM := readFile(t, deposited.Location.CertPath)
+
+	// The stored server certificate must neither be handed out nor be overwritten for a client request
+	client, err := strategy.Request(RequestParams{CommonName: "application", Usage: UsageClient})
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if err := checkLeafUsage(client.Certificate, "application", UsageClient); err != nil {
+		t.Errorf("client certificate: %v", err)
+	}
+	if _, err := strategy.Deposit(DepositParams{}); err != nil {
+		t.Fatalf("Deposit() error = %v", err)
+	}
+	if string(readFile(t, deposited.Location.CertPath)) != string(serverPEM) {
+		t.Errorf("server certificate has been overwritten by the client one")
+	}
+	if string(readFile(t, deposited.Location.ClientCertPath)) != string(client.Certificate) {
+		t.Errorf("client certificate has not been stored at %v", deposited.Location.ClientCertPath)
+	}
+}
@@ -1,18 +1,81 @@
 package certificates
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
 const Custom = "custom"
 
+// CustomStrategy uses certificates provided by the user, Borealis never issues nor renews them
 type CustomStrategy struct {
 	CertificatePath    string
 	CertificateKeyPath string
+
+	Secret SecretDeposit
+
+	requested RequestResponse
 }
 
 func (c *CustomStrategy) Request(params RequestParams) (RequestResponse, error) {
-	return RequestResponse{}, nil
+	response, err := c.request(params)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	c.requested = response
+	return response, nil
+}
+
+func (c *CustomStrategy) request(params RequestParams) (RequestResponse, error) {
+	if c.CertificatePath == "" {
+		return RequestResponse{}, nil
+	}
+	certPEM, err := os.ReadFile(c.CertificatePath)
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not read custom certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(c.CertificateKeyPath)
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not read custom certificate key: %v", err)
+	}
+	if err := coversNames(certPEM, params.DNSNames, params.IPAddresses); err != nil {
+		return RequestResponse{}, fmt.Errorf("custom certificate does not cover the requested names: %v", err)
+	}
+
+	return newRequestResponse(certPEM, keyPEM, nil)
 }
 
+// Deposit copies the custom certificates when another BasePath is requested, they are left in place otherwise
 func (c *CustomStrategy) Deposit(params DepositParams) (DepositResponse, error) {
-	return DepositResponse{}, nil
+	if params.Target == DepositTargetKubernetes {
+		return c.Secret.deposit(params.getContext(), c.requested)
+	}
+	if err := checkDepositTarget(params.Target); err != nil {
+		return DepositResponse{}, err
+	}
+	location, _ := c.GetLocations(GetLocationParams{})
+	if params.BasePath == "" || c.CertificatePath == "" {
+		return DepositResponse{Location: location}, nil
+	}
+
+	certPEM, err := os.ReadFile(c.CertificatePath)
+	if err != nil {
+		return DepositResponse{}, err
+	}
+	keyPEM, err := os.ReadFile(c.CertificateKeyPath)
+	if err != nil {
+		return DepositResponse{}, err
+	}
+	location = Location{
+		CertPath: filepath.Join(params.BasePath, filepath.Base(c.CertificatePath)),
+		KeyPath:  filepath.Join(params.BasePath, filepath.Base(c.CertificateKeyPath)),
+	}
+	if err := writeKeyPair(location.CertPath, location.KeyPath, certPEM, keyPEM); err != nil {
+		return DepositResponse{}, err
+	}
+
+	return DepositResponse{Location: location}, nil
 }
 
 func (c *CustomStrategy) GetLocations(params GetLocationParams) (Location, error) {
@@ -1,12 +1,37 @@
 package certificates
 
-import "github.com/sirupsen/logrus"
+import (
+	"time"
+
+	"github.com/borealisdb/commons/k8sutil"
+	"github.com/sirupsen/logrus"
+)
 
 type StrategiesParams struct {
 	Domain     string
 	CommonName string
 	BasePath   string
 
+	ClusterName string
+	Namespace   string
+	DNSNames    []string
+	IPAddresses []string
+	// KeyAlgorithm matches the keyAlgorithm of the Postgres TLS spec
+	KeyAlgorithm KeyAlgorithm
+
+	IntermediateScope    string
+	IntermediateValidity time.Duration
+
+	RemoteCAEndpoint string
+	RootCAPath       string
+
+	ACMEDirectoryURL string
+	ACMEEmail        string
+	ChallengeSolvers []ChallengeSolver
+
+	// KubeClient is used to deposit the certificates in the cluster TLS secret
+	KubeClient k8sutil.KubernetesClient
+
 	CertificatePath    string
 	CertificateKeyPath string
 
@@ -14,16 +39,63 @@ type StrategiesParams struct {
 }
 
 func GetStrategy(name string, params StrategiesParams) CertificateAuthority {
+	secret := SecretDeposit{
+		KubeClient:  params.KubeClient,
+		ClusterName: params.ClusterName,
+		Namespace:   params.Namespace,
+	}
 	strategies := map[string]CertificateAuthority{
 		Autogenerated: &AutoGenerateStrategy{
-			Log:        params.Log,
-			Domain:     params.Domain,
-			CommonName: params.CommonName,
-			BasePath:   params.BasePath,
+			Log:          params.Log,
+			Domain:       params.Domain,
+			CommonName:   params.CommonName,
+			BasePath:     params.BasePath,
+			KeyAlgorithm: params.KeyAlgorithm,
+			Secret:       secret,
+		},
+		InternalCA: &InternalCAStrategy{
+			Log:          params.Log,
+			Domain:       params.Domain,
+			CommonName:   params.CommonName,
+			BasePath:     params.BasePath,
+			ClusterName:  params.ClusterName,
+			Namespace:    params.Namespace,
+			DNSNames:     params.DNSNames,
+			IPAddresses:  params.IPAddresses,
+			KeyAlgorithm: params.KeyAlgorithm,
+			Secret:       secret,
+
+			IntermediateScope:    params.IntermediateScope,
+			IntermediateValidity: params.IntermediateValidity,
+		},
+		RemoteCA: &RemoteCAStrategy{
+			Log:          params.Log,
+			Domain:       params.Domain,
+			CommonName:   params.CommonName,
+			BasePath:     params.BasePath,
+			DNSNames:     params.DNSNames,
+			IPAddresses:  params.IPAddresses,
+			Endpoint:     params.RemoteCAEndpoint,
+			RootCAPath:   params.RootCAPath,
+			KeyAlgorithm: params.KeyAlgorithm,
+			Secret:       secret,
+		},
+		ACME: &ACMEStrategy{
+			Log:          params.Log,
+			Domain:       params.Domain,
+			CommonName:   params.CommonName,
+			BasePath:     params.BasePath,
+			DNSNames:     params.DNSNames,
+			DirectoryURL: params.ACMEDirectoryURL,
+			Email:        params.ACMEEmail,
+			Solvers:      params.ChallengeSolvers,
+			KeyAlgorithm: params.KeyAlgorithm,
+			Secret:       secret,
 		},
 		Custom: &CustomStrategy{
 			CertificatePath:    params.CertificatePath,
 			CertificateKeyPath: params.CertificateKeyPath,
+			Secret:             secret,
 		},
 		Noop: &NoopStrategy{},
 	}
@@ -0,0 +1,207 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	// IntermediateScopeCluster gives every cluster its own intermediate, the default
+	IntermediateScopeCluster = "cluster"
+	// IntermediateScopeNamespace shares an intermediate between the clusters of a namespace
+	IntermediateScopeNamespace = "namespace"
+
+	DefaultIntermediateValidity = 5 * 365 * 24 * time.Hour
+
+	intermediatePrefix = "intermediate"
+)
+
+// makeIntermediateCert signs an intermediate CA with the root. It can not sign other CAs,
+// so compromising it only requires to replace the leaves of its cluster or namespace
+func makeIntermediateCert(root *issuer, commonName string, validity time.Duration, algorithm KeyAlgorithm) (*issuer, certsPair, error) {
+	if root.key == nil {
+		return nil, certsPair{}, fmt.Errorf("root CA key is offline, it must be brought back to sign intermediate %v", commonName)
+	}
+	privateKey, err := generateKey(algorithm)
+	if err != nil {
+		return nil, certsPair{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return nil, certsPair{}, err
+	}
+	skid, err := calculateSKID(privateKey.Public())
+	if err != nil {
+		return nil, certsPair{}, err
+	}
+	notAfter := time.Now().Add(validity)
+	if notAfter.After(root.cert.NotAfter) {
+		notAfter = root.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		SerialNumber: serial,
+		NotBefore:    time.Now(),
+		NotAfter:     notAfter,
+
+		SubjectKeyId:          skid,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, root.cert, privateKey.Public(), root.key)
+	if err != nil {
+		return nil, certsPair{}, err
+	}
+	certificate, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, certsPair{}, err
+	}
+
+	certPEM := new(bytes.Buffer)
+	if err := pem.Encode(certPEM, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certBytes,
+	}); err != nil {
+		return nil, certsPair{}, err
+	}
+	keyPEM, err := encodePrivateKey(privateKey)
+	if err != nil {
+		return nil, certsPair{}, err
+	}
+
+	return &issuer{
+		key:   privateKey,
+		cert:  certificate,
+		chain: certPEM.Bytes(),
+	}, certsPair{
+		Key:  bytes.NewBuffer(keyPEM),
+		Cert: certPEM,
+	}, nil
+}
+
+// getSigner returns the intermediate signing the leaves of the cluster, creating or renewing it when it would
+// expire before a leaf of the given validity. Roots created before intermediates existed keep signing the leaves
+func (c *InternalCAStrategy) getSigner(leafValidity time.Duration) (*issuer, error) {
+	root, err := c.loadOrCreateCA()
+	if err != nil {
+		return nil, fmt.Errorf("could not loadOrCreateCA: %v", err)
+	}
+	if root.cert.MaxPathLenZero {
+		c.Log.Warnf("root CA can not sign intermediates, leaves are signed by the root")
+		return root, nil
+	}
+
+	name := c.getIntermediateName()
+	certPath := c.getPath(c.BasePath, name, certExt)
+	keyPath := c.getPath(c.BasePath, name, keyExt)
+	if fileExists(certPath, keyPath) {
+		iss, err := c.loadIntermediate(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		err = c.checkIntermediate(iss, root, leafValidity)
+		if err == nil {
+			return iss, nil
+		}
+		c.Log.Infof("intermediate %v must be renewed: %v", name, err)
+	}
+
+	c.Log.Infof("creating intermediate %v", name)
+	algorithm, err := selectKeyAlgorithm("", c.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	validity := c.IntermediateValidity
+	if validity <= 0 {
+		validity = DefaultIntermediateValidity
+	}
+	if time.Now().Add(validity).Before(getLeafNotAfter(leafValidity)) {
+		return nil, fmt.Errorf("intermediate validity %v is shorter than the leaves validity", validity)
+	}
+	iss, pair, err := makeIntermediateCert(root, fmt.Sprintf("borealis %v", name), validity, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyPair(certPath, keyPath, pair.Cert.Bytes(), pair.Key.Bytes()); err != nil {
+		return nil, fmt.Errorf("could not store intermediate: %v", err)
+	}
+	if err := c.getRegistry().Record(iss.cert); err != nil {
+		return nil, fmt.Errorf("could not record intermediate %v: %v", iss.cert.SerialNumber, err)
+	}
+	c.Log.Infof("intermediate stored at: %v", certPath)
+	return iss, nil
+}
+
+func (c *InternalCAStrategy) loadIntermediate(certPath, keyPath string) (*issuer, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	iss, err := loadIssuer(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not load intermediate %v: %v", certPath, err)
+	}
+	iss.chain = certPEM
+	return iss, nil
+}
+
+// checkIntermediate makes sure the intermediate is still signed by the current root, is not revoked
+// and outlives a leaf of the given validity
+func (c *InternalCAStrategy) checkIntermediate(iss, root *issuer, leafValidity time.Duration) error {
+	if err := iss.cert.CheckSignatureFrom(root.cert); err != nil {
+		return err
+	}
+	status, err := c.getRegistry().Status(iss.cert.SerialNumber)
+	if err != nil {
+		return err
+	}
+	if status == StatusRevoked {
+		return fmt.Errorf("intermediate has been revoked")
+	}
+	if getLeafNotAfter(leafValidity).After(iss.cert.NotAfter) {
+		return fmt.Errorf("intermediate expires at %v", iss.cert.NotAfter)
+	}
+	return nil
+}
+
+// checkIssuedBy makes sure the leaf of the PEM chain has been signed by the issuer,
+// so the leaves are replaced along with a renewed intermediate
+func checkIssuedBy(chainPEM []byte, iss *issuer) error {
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return err
+	}
+	if err := chain[0].CheckSignatureFrom(iss.cert); err != nil {
+		return fmt.Errorf("certificate has not been issued by %v", iss.cert.Subject.CommonName)
+	}
+	return nil
+}
+
+// getIntermediateName returns the file name of the intermediate according to the IntermediateScope
+func (c *InternalCAStrategy) getIntermediateName() string {
+	namespace := c.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	if c.IntermediateScope == IntermediateScopeNamespace || c.ClusterName == "" {
+		return fmt.Sprintf("%v-%v", intermediatePrefix, namespace)
+	}
+	return fmt.Sprintf("%v-%v-%v", intermediatePrefix, namespace, c.ClusterName)
+}
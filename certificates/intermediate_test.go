@@ -0,0 +1,74 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"testing"
+
+	"github.com/borealisdb/commons/logger"
+)
+
+func TestInternalCAStrategy_Intermediates(t *testing.T) {
+	basePath := t.TempDir()
+	newStrategy := func(clusterName string) CertificateAuthority {
+		return GetStrategy(InternalCA, StrategiesParams{
+			Domain:      clusterName + ".borealisdb.io",
+			CommonName:  clusterName,
+			BasePath:    basePath,
+			ClusterName: clusterName,
+			Namespace:   "test",
+			Log:         logger.NewDefaultLogger("info", "certificates"),
+		})
+	}
+
+	first, err := newStrategy("first").Request(RequestParams{})
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	second, err := newStrategy("second").Request(RequestParams{})
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if !bytes.Equal(first.CA, second.CA) {
+		t.Errorf("clusters do not share the same root")
+	}
+
+	firstChain, _ := parseCertificates(first.Certificate)
+	secondChain, _ := parseCertificates(second.Certificate)
+	if len(firstChain) != 2 || len(secondChain) != 2 {
+		t.Fatalf("leaves are not bundled with their intermediate")
+	}
+	if bytes.Equal(firstChain[1].Raw, secondChain[1].Raw) {
+		t.Errorf("clusters share the same intermediate")
+	}
+	if !firstChain[1].IsCA || !firstChain[1].MaxPathLenZero {
+		t.Errorf("intermediate must be a CA which can not sign other CAs")
+	}
+	for _, response := range []RequestResponse{first, second} {
+		if err := verifyLeaf(response.Certificate, response.CA, "", x509.ExtKeyUsageServerAuth); err != nil {
+			t.Errorf("leaf does not chain to the root: %v", err)
+		}
+	}
+
+	// Once the intermediates exist the root key can be taken offline
+	if err := os.Remove(basePath + "/ca.key"); err != nil {
+		t.Fatalf("could not remove root key: %v", err)
+	}
+	renewed, err := newStrategy("first").Request(RequestParams{Force: true})
+	if err != nil {
+		t.Fatalf("Request() with the root key offline error = %v", err)
+	}
+	renewedChain, _ := parseCertificates(renewed.Certificate)
+	if !bytes.Equal(renewedChain[1].Raw, firstChain[1].Raw) {
+		t.Errorf("intermediate has been replaced")
+	}
+	if _, err := newStrategy("third").Request(RequestParams{}); err == nil {
+		t.Errorf("Request() should fail for a new intermediate while the root key is offline")
+	}
+
+	location, _ := newStrategy("first").GetLocations(GetLocationParams{})
+	if location.IntermediatePath != basePath+"/intermediate-test-first.crt" {
+		t.Errorf("IntermediatePath = %v", location.IntermediatePath)
+	}
+}
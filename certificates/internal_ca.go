@@ -0,0 +1,453 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	InternalCA = "internal_ca"
+
+	caName       = "ca"
+	clientSuffix = "client"
+	registryName = "ca-registry"
+	crlExt       = "crl"
+)
+
+// InternalCAStrategy issues the cluster certificates from a Borealis root CA.
+// The root CA is created only once under BasePath and shared by every cluster,
+// so Postgres pods and clients can all chain to the same trust root.
+// Leaves are signed by a per-cluster or per-namespace intermediate, and bundled with it,
+// so the root key can be kept offline once the intermediates exist
+type InternalCAStrategy struct {
+	Log         *logrus.Entry
+	Domain      string
+	CommonName  string
+	BasePath    string
+	ClusterName string
+	Namespace   string
+	DNSNames    []string
+	IPAddresses []string
+	// KeyAlgorithm of the leaves when the request does not ask for one and of the root CA when it is created, RSA 2048 by default
+	KeyAlgorithm KeyAlgorithm
+	// IntermediateScope is either IntermediateScopeCluster, the default, or IntermediateScopeNamespace
+	IntermediateScope    string
+	IntermediateValidity time.Duration
+
+	Secret SecretDeposit
+
+	ca        generatedKeyPairs
+	server    generatedKeyPairs
+	client    generatedKeyPairs
+	requested RequestResponse
+	// usage of the requested certificate, which selects the secret of a Kubernetes deposit
+	usage    Usage
+	registry *RevocationRegistry
+}
+
+// Request always issues both the server and the client leaves, params.Usage selects which one is returned
+func (c *InternalCAStrategy) Request(params RequestParams) (RequestResponse, error) {
+	response, err := c.request(params)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	c.requested, c.usage = response, params.Usage
+	return response, nil
+}
+
+func (c *InternalCAStrategy) request(params RequestParams) (RequestResponse, error) {
+	c.Log.Infof("requesting certificates from the internal CA")
+	algorithm, err := selectKeyAlgorithm(params.KeyAlgorithm, c.KeyAlgorithm)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	params.KeyAlgorithm = algorithm
+	if _, err := getExtKeyUsage(params.Usage); err != nil {
+		return RequestResponse{}, err
+	}
+	iss, err := c.getSigner(params.Validity)
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not getSigner: %v", err)
+	}
+
+	if !params.Force && c.leavesAreValid(params, iss) {
+		c.Log.Infof("certificates exist and are valid, skip generation")
+		return c.readStored(params.Usage)
+	}
+
+	commonName := params.CommonName
+	if commonName == "" {
+		commonName = c.CommonName
+	}
+	c.Log.Infof("issuing server and client certificates for %v", c.Domain)
+	server, err := sign(iss, signRequest{
+		commonName:  commonName,
+		domains:     c.getDNSNames(params),
+		ipAddresses: mergeNames(c.IPAddresses, params.IPAddresses),
+		extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		validity:    params.Validity,
+		algorithm:   params.KeyAlgorithm,
+	})
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not sign server certificate: %v", err)
+	}
+	client, err := sign(iss, signRequest{
+		commonName:  commonName,
+		extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		validity:    params.Validity,
+		algorithm:   params.KeyAlgorithm,
+	})
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not sign client certificate: %v", err)
+	}
+
+	c.server = generatedKeyPairs{Cert: server.Cert.Bytes(), Key: server.Key.Bytes()}
+	c.client = generatedKeyPairs{Cert: client.Cert.Bytes(), Key: client.Key.Bytes()}
+	if err := c.record(c.server.Cert, c.client.Cert); err != nil {
+		return RequestResponse{}, err
+	}
+	if params.Usage == UsageClient {
+		return newRequestResponse(c.client.Cert, c.client.Key, c.ca.Cert)
+	}
+	return newRequestResponse(c.server.Cert, c.server.Key, c.ca.Cert)
+}
+
+// Deposit stores the leaves and a copy of the CA certificate under the deposit BasePath,
+// while the CA key always stays under the strategy BasePath
+func (c *InternalCAStrategy) Deposit(params DepositParams) (DepositResponse, error) {
+	if params.Target == DepositTargetKubernetes {
+		return c.Secret.depositLeaf(params.getContext(), c.usage, c.requested)
+	}
+	if err := checkDepositTarget(params.Target); err != nil {
+		return DepositResponse{}, err
+	}
+	c.Log.Infof("storing certificates")
+	caCertPath := c.getPath(c.BasePath, caName, certExt)
+	intermediatePath := c.getPath(c.BasePath, c.getIntermediateName(), certExt)
+	location := c.getLocation(params.getBasePath(c.BasePath))
+
+	if c.ca.Cert != nil && location.CAPath != caCertPath {
+		if err := writeCertificate(location.CAPath, c.ca.Cert); err != nil {
+			return DepositResponse{}, fmt.Errorf("could not store CA certificate: %v", err)
+		}
+	}
+	if location.IntermediatePath != intermediatePath && fileExists(intermediatePath) {
+		intermediate, err := os.ReadFile(intermediatePath)
+		if err != nil {
+			return DepositResponse{}, err
+		}
+		if err := writeCertificate(location.IntermediatePath, intermediate); err != nil {
+			return DepositResponse{}, fmt.Errorf("could not store intermediate certificate: %v", err)
+		}
+	}
+	if c.server.Cert != nil {
+		if err := writeKeyPair(location.CertPath, location.KeyPath, c.server.Cert, c.server.Key); err != nil {
+			return DepositResponse{}, fmt.Errorf("could not store server certificates: %v", err)
+		}
+	}
+	if c.client.Cert != nil {
+		if err := writeKeyPair(location.ClientCertPath, location.ClientKeyPath, c.client.Cert, c.client.Key); err != nil {
+			return DepositResponse{}, fmt.Errorf("could not store client certificates: %v", err)
+		}
+	}
+
+	c.Log.Infof("certificates stored at: %v, %v", location.CertPath, location.ClientCertPath)
+	return DepositResponse{Location: location}, nil
+}
+
+// IssueClientCertificate signs a client certificate for a Postgres role. The role name is the CN,
+// so the certificate can be used to authenticate with the cert method of pg_hba instead of a password
+func (c *InternalCAStrategy) IssueClientCertificate(username string, params RequestParams) (RequestResponse, error) {
+	if username == "" {
+		return RequestResponse{}, fmt.Errorf("username is required to issue a client certificate")
+	}
+	algorithm, err := selectKeyAlgorithm(params.KeyAlgorithm, c.KeyAlgorithm)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	// The signer is persisted before handing out certificates signed by it
+	iss, err := c.getSigner(params.Validity)
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not getSigner: %v", err)
+	}
+
+	c.Log.Infof("issuing client certificate for user %v", username)
+	pair, err := sign(iss, signRequest{
+		commonName:  username,
+		extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		validity:    params.Validity,
+		algorithm:   algorithm,
+	})
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not sign client certificate for user %v: %v", username, err)
+	}
+	if err := c.record(pair.Cert.Bytes()); err != nil {
+		return RequestResponse{}, err
+	}
+	return newRequestResponse(pair.Cert.Bytes(), pair.Key.Bytes(), c.ca.Cert)
+}
+
+// DepositClientCertificate stores the client certificate of a Postgres role,
+// either in the <cluster>-<user>-client-tls secret or under the deposit BasePath
+func (c *InternalCAStrategy) DepositClientCertificate(username string, material RequestResponse, params DepositParams) (DepositResponse, error) {
+	if params.Target == DepositTargetKubernetes {
+		return c.Secret.depositClient(params.getContext(), username, material)
+	}
+	if err := checkDepositTarget(params.Target); err != nil {
+		return DepositResponse{}, err
+	}
+	basePath := params.getBasePath(c.BasePath)
+	name := fmt.Sprintf("%v-%v", username, clientSuffix)
+	location := Location{
+		CAPath:         c.getPath(basePath, caName, certExt),
+		ClientCertPath: c.getPath(basePath, name, certExt),
+		ClientKeyPath:  c.getPath(basePath, name, keyExt),
+	}
+	if err := writeKeyPair(location.ClientCertPath, location.ClientKeyPath, material.Certificate, material.Key); err != nil {
+		return DepositResponse{}, fmt.Errorf("could not store client certificate for user %v: %v", username, err)
+	}
+	if material.CA != nil && location.CAPath != c.getPath(c.BasePath, caName, certExt) {
+		if err := writeCertificate(location.CAPath, material.CA); err != nil {
+			return DepositResponse{}, fmt.Errorf("could not store CA certificate: %v", err)
+		}
+	}
+	c.Log.Infof("client certificate for user %v stored at: %v", username, location.ClientCertPath)
+
+	return DepositResponse{Location: location}, nil
+}
+
+// Revoke revokes a certificate issued by the CA, it is listed in the next generated CRL
+func (c *InternalCAStrategy) Revoke(serial *big.Int, reason RevocationReason) error {
+	c.Log.Infof("revoking certificate %v", serial)
+	return c.getRegistry().Revoke(serial, reason)
+}
+
+// RevokeSubject revokes every valid certificate issued for the common name, e.g. a Postgres role
+func (c *InternalCAStrategy) RevokeSubject(commonName string, reason RevocationReason) ([]IssuedCertificate, error) {
+	c.Log.Infof("revoking certificates of %v", commonName)
+	return c.getRegistry().RevokeSubject(commonName, reason)
+}
+
+// Status returns the revocation status of a certificate issued by the CA
+func (c *InternalCAStrategy) Status(serial *big.Int) (CertificateStatus, error) {
+	return c.getRegistry().Status(serial)
+}
+
+// GenerateCRL returns the PEM encoded revocation list of the intermediate, valid for the given duration.
+// The root CRL, listing the revoked intermediates, is appended while the root key is online
+// as Postgres checks the revocation of every certificate of the chain
+func (c *InternalCAStrategy) GenerateCRL(validity time.Duration) ([]byte, error) {
+	signer, err := c.getSigner(0)
+	if err != nil {
+		return nil, fmt.Errorf("could not getSigner: %v", err)
+	}
+	crl, err := c.getRegistry().createCRL(signer, validity)
+	if err != nil {
+		return nil, err
+	}
+	root, err := c.loadOrCreateCA()
+	if err != nil {
+		return nil, fmt.Errorf("could not loadOrCreateCA: %v", err)
+	}
+	if bytes.Equal(root.cert.Raw, signer.cert.Raw) {
+		return crl, nil
+	}
+	if root.key == nil {
+		c.Log.Warnf("root CA key is offline, the root CRL must be published along with it")
+		return crl, nil
+	}
+	rootCRL, err := c.getRegistry().createCRL(root, validity)
+	if err != nil {
+		return nil, err
+	}
+	return append(crl, rootCRL...), nil
+}
+
+// DepositCRL stores the CRL, either in the cluster TLS secret or under the deposit BasePath,
+// where Postgres can load it with ssl_crl_file
+func (c *InternalCAStrategy) DepositCRL(crl []byte, params DepositParams) (DepositResponse, error) {
+	if params.Target == DepositTargetKubernetes {
+		return c.Secret.depositCRL(params.getContext(), crl)
+	}
+	if err := checkDepositTarget(params.Target); err != nil {
+		return DepositResponse{}, err
+	}
+	location := c.getLocation(params.getBasePath(c.BasePath))
+	location.CRLPath = c.getPath(params.getBasePath(c.BasePath), caName, crlExt)
+	if err := writeCertificate(location.CRLPath, crl); err != nil {
+		return DepositResponse{}, fmt.Errorf("could not store CRL: %v", err)
+	}
+	c.Log.Infof("CRL stored at: %v", location.CRLPath)
+
+	return DepositResponse{Location: location}, nil
+}
+
+func (c *InternalCAStrategy) GetLocations(params GetLocationParams) (Location, error) {
+	return c.getLocation(c.BasePath), nil
+}
+
+func (c *InternalCAStrategy) getLocation(basePath string) Location {
+	clientName := fmt.Sprintf("%v-%v", c.Domain, clientSuffix)
+	return Location{
+		CertPath:         c.getPath(basePath, c.Domain, certExt),
+		KeyPath:          c.getPath(basePath, c.Domain, keyExt),
+		CAPath:           c.getPath(basePath, caName, certExt),
+		IntermediatePath: c.getPath(basePath, c.getIntermediateName(), certExt),
+		ClientCertPath:   c.getPath(basePath, clientName, certExt),
+		ClientKeyPath:    c.getPath(basePath, clientName, keyExt),
+	}
+}
+
+func (c *InternalCAStrategy) readStored(usage Usage) (RequestResponse, error) {
+	certPEM, keyPEM, err := readKeyPair(c.getLocation(c.BasePath).pairPaths(usage))
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	return newRequestResponse(certPEM, keyPEM, c.ca.Cert)
+}
+
+// loadOrCreateCA reuses the persisted root CA, a new one is created and stored only the very first time.
+// The root is created under the lock of its path, so that strategies starting together all sign with the stored one.
+// The root key can be removed once the intermediates exist, it is needed only to sign new ones
+func (c *InternalCAStrategy) loadOrCreateCA() (*issuer, error) {
+	certPath := c.getPath(c.BasePath, caName, certExt)
+	keyPath := c.getPath(c.BasePath, caName, keyExt)
+	unlock := lockPath(certPath)
+	defer unlock()
+	if fileExists(certPath) {
+		certPEM, err := os.ReadFile(certPath)
+		if err != nil {
+			return nil, err
+		}
+		var keyPEM []byte
+		if fileExists(keyPath) {
+			if keyPEM, err = os.ReadFile(keyPath); err != nil {
+				return nil, err
+			}
+		}
+		c.ca = generatedKeyPairs{Cert: certPEM, Key: keyPEM}
+		return loadIssuer(certPEM, keyPEM)
+	}
+
+	c.Log.Infof("root CA does not exist, creating it")
+	algorithm, err := selectKeyAlgorithm("", c.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	iss, pair, err := makeRootCert(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyPair(certPath, keyPath, pair.Cert.Bytes(), pair.Key.Bytes()); err != nil {
+		return nil, fmt.Errorf("could not store CA: %v", err)
+	}
+	c.Log.Infof("root CA stored at: %v", certPath)
+	c.ca = generatedKeyPairs{Cert: pair.Cert.Bytes(), Key: pair.Key.Bytes()}
+	return iss, nil
+}
+
+// record adds the issued leaves to the revocation registry
+func (c *InternalCAStrategy) record(certsPEM ...[]byte) error {
+	for _, certPEM := range certsPEM {
+		chain, err := parseCertificates(certPEM)
+		if err != nil {
+			return err
+		}
+		if err := c.getRegistry().Record(chain[0]); err != nil {
+			return fmt.Errorf("could not record certificate %v: %v", chain[0].SerialNumber, err)
+		}
+	}
+	return nil
+}
+
+func (c *InternalCAStrategy) getRegistry() *RevocationRegistry {
+	if c.registry == nil {
+		c.registry = &RevocationRegistry{Path: c.getPath(c.BasePath, registryName, "json"), Scope: c.getRegistryScope()}
+	}
+	return c.registry
+}
+
+// getRegistryScope identifies the cluster in the registry shared by every cluster of the CA
+func (c *InternalCAStrategy) getRegistryScope() string {
+	if c.ClusterName == "" {
+		return c.Domain
+	}
+	namespace := c.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	return fmt.Sprintf("%v/%v", namespace, c.ClusterName)
+}
+
+func (c *InternalCAStrategy) leavesAreValid(params RequestParams, signer *issuer) bool {
+	location := c.getLocation(c.BasePath)
+	if !fileExists(location.CertPath, location.KeyPath, location.ClientCertPath, location.ClientKeyPath) {
+		return false
+	}
+
+	serverPEM, err := os.ReadFile(location.CertPath)
+	if err != nil {
+		return false
+	}
+	if err := verifyLeaf(serverPEM, c.ca.Cert, c.Domain, x509.ExtKeyUsageServerAuth); err != nil {
+		c.Log.Infof("server certificate is not valid anymore: %v", err)
+		return false
+	}
+	if err := coversNames(serverPEM, c.getDNSNames(params), mergeNames(c.IPAddresses, params.IPAddresses)); err != nil {
+		c.Log.Infof("server certificate does not cover the requested names: %v", err)
+		return false
+	}
+	if err := checkStoredKeyAlgorithm(serverPEM, params.KeyAlgorithm); err != nil {
+		c.Log.Infof("server certificate must be replaced: %v", err)
+		return false
+	}
+	if err := checkIssuedBy(serverPEM, signer); err != nil {
+		c.Log.Infof("server certificate must be replaced: %v", err)
+		return false
+	}
+
+	clientPEM, err := os.ReadFile(location.ClientCertPath)
+	if err != nil {
+		return false
+	}
+	if err := verifyLeaf(clientPEM, c.ca.Cert, "", x509.ExtKeyUsageClientAuth); err != nil {
+		c.Log.Infof("client certificate is not valid anymore: %v", err)
+		return false
+	}
+	if err := checkIssuedBy(clientPEM, signer); err != nil {
+		c.Log.Infof("client certificate must be replaced: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// getDNSNames returns the configured domain along with every name the cluster services can be reached at
+func (c *InternalCAStrategy) getDNSNames(params RequestParams) []string {
+	var serviceNames []string
+	if c.ClusterName != "" {
+		for _, role := range []string{constants.RoleMaster, constants.RoleReplica} {
+			fqdn := constants.GetClusterEndpoint(c.ClusterName, c.Namespace, role)
+			parts := strings.Split(fqdn, ".")
+			// service, service.namespace, service.namespace.svc and the fully qualified name
+			for i := 1; i <= len(parts)-2; i++ {
+				serviceNames = append(serviceNames, strings.Join(parts[:i], "."))
+			}
+			serviceNames = append(serviceNames, fqdn)
+		}
+	}
+
+	return mergeNames([]string{c.Domain}, c.DNSNames, serviceNames, params.DNSNames)
+}
+
+func (c *InternalCAStrategy) getPath(basePath, name, extension string) string {
+	return fmt.Sprintf("%s/%s.%s", basePath, name, extension)
+}
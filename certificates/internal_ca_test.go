@@ -0,0 +1,118 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/borealisdb/commons/logger"
+)
+
+func TestInternalCAStrategy_RequestAndDeposit(t *testing.T) {
+	basePath := t.TempDir()
+	params := StrategiesParams{
+		Domain:      "mycluster.borealisdb.io",
+		CommonName:  "mycluster",
+		BasePath:    basePath,
+		ClusterName: "mycluster",
+		Namespace:   "test",
+		IPAddresses: []string{"127.0.0.1"},
+		Log:         logger.NewDefaultLogger("info", "certificates"),
+	}
+
+	strategy := GetStrategy(InternalCA, params)
+	if _, err := strategy.Request(RequestParams{}); err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if _, err := strategy.Deposit(DepositParams{}); err != nil {
+		t.Fatalf("Deposit() error = %v", err)
+	}
+	location, err := strategy.GetLocations(GetLocationParams{})
+	if err != nil {
+		t.Fatalf("GetLocations() error = %v", err)
+	}
+
+	caPEM := readFile(t, location.CAPath)
+	serverPEM := readFile(t, location.CertPath)
+	clientPEM := readFile(t, location.ClientCertPath)
+
+	for _, dnsName := range []string{"mycluster.borealisdb.io", "mycluster.test.svc.cluster.local", "mycluster-repl.test"} {
+		if err := verifyLeaf(serverPEM, caPEM, dnsName, x509.ExtKeyUsageServerAuth); err != nil {
+			t.Errorf("server certificate is not valid for %v: %v", dnsName, err)
+		}
+	}
+	if err := verifyLeaf(clientPEM, caPEM, "", x509.ExtKeyUsageClientAuth); err != nil {
+		t.Errorf("client certificate is not valid: %v", err)
+	}
+	if info, err := os.Stat(location.KeyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key should be stored with 0600 permissions, got %v", info.Mode().Perm())
+	}
+
+	// A second cluster must chain to the same root CA
+	params.Domain = "othercluster.borealisdb.io"
+	params.ClusterName = "othercluster"
+	other := GetStrategy(InternalCA, params)
+	if _, err := other.Request(RequestParams{}); err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if _, err := other.Deposit(DepositParams{}); err != nil {
+		t.Fatalf("Deposit() error = %v", err)
+	}
+	otherLocation, _ := other.GetLocations(GetLocationParams{})
+	if otherLocation.CAPath != location.CAPath {
+		t.Errorf("CAPath = %v, want %v", otherLocation.CAPath, location.CAPath)
+	}
+	if string(readFile(t, otherLocation.CAPath)) != string(caPEM) {
+		t.Errorf("root CA has been regenerated")
+	}
+	if err := verifyLeaf(readFile(t, otherLocation.CertPath), caPEM, "othercluster.borealisdb.io", x509.ExtKeyUsageServerAuth); err != nil {
+		t.Errorf("server certificate of the second cluster is not valid: %v", err)
+	}
+}
+
+func TestInternalCAStrategy_ConcurrentRoot(t *testing.T) {
+	basePath := t.TempDir()
+	clusters := []string{"tenanta", "tenantb", "tenantc", "tenantd"}
+	strategies := make([]CertificateAuthority, len(clusters))
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		strategies[i] = GetStrategy(InternalCA, StrategiesParams{
+			Domain:      cluster + ".borealisdb.io",
+			CommonName:  cluster,
+			BasePath:    basePath,
+			ClusterName: cluster,
+			Namespace:   "test",
+			Log:         logger.NewDefaultLogger("info", "certificates"),
+		})
+		wg.Add(1)
+		go func(strategy CertificateAuthority) {
+			defer wg.Done()
+			if _, err := strategy.Request(RequestParams{}); err != nil {
+				t.Errorf("Request() error = %v", err)
+			}
+		}(strategies[i])
+	}
+	wg.Wait()
+
+	caPEM := readFile(t, filepath.Join(basePath, caName+"."+certExt))
+	for i, strategy := range strategies {
+		if _, err := strategy.Deposit(DepositParams{}); err != nil {
+			t.Fatalf("Deposit() error = %v", err)
+		}
+		location, _ := strategy.GetLocations(GetLocationParams{})
+		if err := verifyLeaf(readFile(t, location.CertPath), caPEM, clusters[i]+".borealisdb.io", x509.ExtKeyUsageServerAuth); err != nil {
+			t.Errorf("server certificate of %v does not chain to the stored root: %v", clusters[i], err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read %v: %v", path, err)
+	}
+	return content
+}
@@ -0,0 +1,131 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// selectKeyAlgorithm returns the algorithm requested for a single certificate,
+// falling back to the one configured for the strategy and then to the default
+func selectKeyAlgorithm(requested, configured KeyAlgorithm) (KeyAlgorithm, error) {
+	algorithm := requested
+	if algorithm == "" {
+		algorithm = configured
+	}
+	if algorithm == "" {
+		algorithm = DefaultKeyAlgorithm
+	}
+	switch algorithm {
+	case RSA2048, RSA3072, RSA4096, ECDSAP256, ECDSAP384, Ed25519:
+		return algorithm, nil
+	}
+	return "", fmt.Errorf("unsupported key algorithm %q", algorithm)
+}
+
+func generateKey(algorithm KeyAlgorithm) (crypto.Signer, error) {
+	switch algorithm {
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	}
+	return nil, fmt.Errorf("unsupported key algorithm %q", algorithm)
+}
+
+// keyAlgorithmOf returns the algorithm of a public key, empty when it is not supported
+func keyAlgorithmOf(publicKey crypto.PublicKey) KeyAlgorithm {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return RSA2048
+		case 3072:
+			return RSA3072
+		case 4096:
+			return RSA4096
+		}
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return ECDSAP256
+		case elliptic.P384():
+			return ECDSAP384
+		}
+	case ed25519.PublicKey:
+		return Ed25519
+	}
+	return ""
+}
+
+// getKeyUsage returns the KeyUsage flags of a leaf. Key encipherment only makes sense
+// for RSA, where the key exchange can encrypt the premaster secret with the public key
+func getKeyUsage(publicKey crypto.PublicKey) x509.KeyUsage {
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// encodePrivateKey returns the PKCS#8 PEM encoding of the key, which Postgres and libpq read for every algorithm
+func encodePrivateKey(privateKey crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+// parsePrivateKey decodes a PKCS#8 key, as well as the PKCS#1 and SEC 1 keys stored by older versions
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse key PEM")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// checkStoredKeyAlgorithm makes sure the leaf of the PEM chain has been issued for a key of the given algorithm,
+// so changing the configured algorithm replaces the stored certificates
+func checkStoredKeyAlgorithm(chainPEM []byte, algorithm KeyAlgorithm) error {
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return err
+	}
+	if stored := keyAlgorithmOf(chain[0].PublicKey); stored != algorithm {
+		return fmt.Errorf("certificate key algorithm is %q instead of %q", stored, algorithm)
+	}
+	return nil
+}
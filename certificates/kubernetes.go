@@ -0,0 +1,123 @@
+package certificates
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/k8sutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "borealis"
+)
+
+// SecretDeposit stores the certificates into the <cluster>-tls secret, the same one credentials.Kubernetes reads from
+type SecretDeposit struct {
+	KubeClient  k8sutil.KubernetesClient
+	ClusterName string
+	Namespace   string
+}
+
+func (s SecretDeposit) deposit(ctx context.Context, material RequestResponse) (DepositResponse, error) {
+	if s.ClusterName == "" {
+		return DepositResponse{}, fmt.Errorf("cluster name is required to deposit certificates in a secret")
+	}
+	return s.write(ctx, constants.GetTLSSecretName(s.ClusterName), material)
+}
+
+// depositLeaf stores a server leaf into the cluster TLS secret and a client leaf into the secret of the role of its CN
+func (s SecretDeposit) depositLeaf(ctx context.Context, usage Usage, material RequestResponse) (DepositResponse, error) {
+	if usage != UsageClient || material.Certificate == nil {
+		return s.deposit(ctx, material)
+	}
+	chain, err := parseCertificates(material.Certificate)
+	if err != nil {
+		return DepositResponse{}, err
+	}
+	if chain[0].Subject.CommonName == "" {
+		return DepositResponse{}, fmt.Errorf("client certificate has no common name to name its secret after")
+	}
+	return s.depositClient(ctx, chain[0].Subject.CommonName, material)
+}
+
+// depositClient stores the client certificate of a Postgres role into the <cluster>-<user>-client-tls secret
+func (s SecretDeposit) depositClient(ctx context.Context, username string, material RequestResponse) (DepositResponse, error) {
+	if s.ClusterName == "" {
+		return DepositResponse{}, fmt.Errorf("cluster name is required to deposit certificates in a secret")
+	}
+	return s.write(ctx, constants.GetClientTLSSecretName(username, s.ClusterName), material)
+}
+
+// depositCRL adds the revocation list of the CA to the cluster TLS secret,
+// which must already hold the certificates as TLS secrets can not be created without them
+func (s SecretDeposit) depositCRL(ctx context.Context, crl []byte) (DepositResponse, error) {
+	if s.ClusterName == "" {
+		return DepositResponse{}, fmt.Errorf("cluster name is required to deposit certificates in a secret")
+	}
+	return s.update(ctx, constants.GetTLSSecretName(s.ClusterName), map[string][]byte{constants.RootCrlName: crl})
+}
+
+func (s SecretDeposit) write(ctx context.Context, secretName string, material RequestResponse) (DepositResponse, error) {
+	if material.Certificate == nil {
+		return DepositResponse{}, fmt.Errorf("no certificates have been requested")
+	}
+	data := map[string][]byte{
+		constants.ServerCertName: material.Certificate,
+		constants.ServerKeyName:  material.Key,
+	}
+	if material.CA != nil {
+		data[constants.RootCaCertName] = material.CA
+	}
+	return s.update(ctx, secretName, data)
+}
+
+// update creates the TLS secret or merges the data into the existing one
+func (s SecretDeposit) update(ctx context.Context, secretName string, data map[string][]byte) (DepositResponse, error) {
+	if s.KubeClient.SecretsGetter == nil {
+		return DepositResponse{}, fmt.Errorf("kubernetes client is not configured")
+	}
+
+	secrets := s.KubeClient.Secrets(s.Namespace)
+	secret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+	if k8sutil.ResourceNotFound(err) {
+		_, err = secrets.Create(ctx, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: s.Namespace,
+				Labels: map[string]string{
+					constants.ClusterNameLabel: s.ClusterName,
+					managedByLabel:             managedBy,
+				},
+			},
+			Type: v1.SecretTypeTLS,
+			Data: data,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return DepositResponse{}, fmt.Errorf("could not create secret %v: %v", secretName, err)
+		}
+		return DepositResponse{Location: Location{SecretName: secretName}}, nil
+	}
+	if err != nil {
+		return DepositResponse{}, fmt.Errorf("could not get secret %v: %v", secretName, err)
+	}
+
+	// The type of a secret is immutable, it must be recreated by whoever created it with another type
+	if secret.Type != v1.SecretTypeTLS {
+		return DepositResponse{}, fmt.Errorf("secret %v has type %v instead of %v", secretName, secret.Type, v1.SecretTypeTLS)
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for key, value := range data {
+		secret.Data[key] = value
+	}
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return DepositResponse{}, fmt.Errorf("could not update secret %v: %v", secretName, err)
+	}
+
+	return DepositResponse{Location: Location{SecretName: secretName}}, nil
+}
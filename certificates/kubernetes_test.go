@@ -0,0 +1,148 @@
+package certificates
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/k8sutil"
+	"github.com/borealisdb/commons/logger"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretDeposit(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *v1.Secret
+		wantErr  bool
+	}{
+		{
+			name: "secret is created",
+		},
+		{
+			name: "existing secret is updated",
+			existing: &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "mycluster-tls", Namespace: "test"},
+				Type:       v1.SecretTypeTLS,
+				Data:       map[string][]byte{"extra": []byte("kept")},
+			},
+		},
+		{
+			name: "existing secret has the wrong type",
+			existing: &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "mycluster-tls", Namespace: "test"},
+				Type:       v1.SecretTypeOpaque,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if tt.existing != nil {
+				clientset = fake.NewSimpleClientset(tt.existing)
+			}
+			strategy := GetStrategy(InternalCA, StrategiesParams{
+				Domain:      "mycluster.borealisdb.io",
+				CommonName:  "mycluster",
+				BasePath:    t.TempDir(),
+				ClusterName: "mycluster",
+				Namespace:   "test",
+				KubeClient:  k8sutil.KubernetesClient{SecretsGetter: clientset.CoreV1()},
+				Log:         logger.NewDefaultLogger("info", "certificates"),
+			})
+			response, err := strategy.Request(RequestParams{})
+			if err != nil {
+				t.Fatalf("Request() error = %v", err)
+			}
+
+			deposited, err := strategy.Deposit(DepositParams{Target: DepositTargetKubernetes})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Deposit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if deposited.Location.SecretName != constants.GetTLSSecretName("mycluster") {
+				t.Errorf("SecretName = %v, want %v", deposited.Location.SecretName, constants.GetTLSSecretName("mycluster"))
+			}
+
+			secret, err := clientset.CoreV1().Secrets("test").Get(context.TODO(), deposited.Location.SecretName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("could not get secret: %v", err)
+			}
+			if secret.Type != v1.SecretTypeTLS {
+				t.Errorf("secret type = %v, want %v", secret.Type, v1.SecretTypeTLS)
+			}
+			want := map[string][]byte{
+				constants.ServerCertName: response.Certificate,
+				constants.ServerKeyName:  response.Key,
+				constants.RootCaCertName: response.CA,
+			}
+			for key, value := range want {
+				if string(secret.Data[key]) != string(value) {
+					t.Errorf("secret key %v does not hold the requested material", key)
+				}
+			}
+			if tt.existing != nil && string(secret.Data["extra"]) != "kept" {
+				t.Errorf("existing secret keys have been dropped")
+			}
+			if tt.existing == nil && (secret.Labels[constants.ClusterNameLabel] != "mycluster" || secret.Labels[managedByLabel] != managedBy) {
+				t.Errorf("created secret labels = %v", secret.Labels)
+			}
+		})
+	}
+}
+
+func TestInternalCAStrategy_ClientCertificate(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	strategy := &InternalCAStrategy{
+		Log:         logger.NewDefaultLogger("info", "certificates"),
+		Domain:      "mycluster.borealisdb.io",
+		BasePath:    t.TempDir(),
+		ClusterName: "mycluster",
+		Namespace:   "test",
+		Secret: SecretDeposit{
+			KubeClient:  k8sutil.KubernetesClient{SecretsGetter: clientset.CoreV1()},
+			ClusterName: "mycluster",
+			Namespace:   "test",
+		},
+	}
+
+	for _, username := range constants.BuiltInUsernames {
+		response, err := strategy.IssueClientCertificate(username, RequestParams{})
+		if err != nil {
+			t.Fatalf("IssueClientCertificate() error = %v", err)
+		}
+		if err := verifyLeaf(response.Certificate, response.CA, "", x509.ExtKeyUsageClientAuth); err != nil {
+			t.Errorf("client certificate of %v does not chain to the CA: %v", username, err)
+		}
+		leaf, _ := parseCertificates(response.Certificate)
+		if leaf[0].Subject.CommonName != username {
+			t.Errorf("CommonName = %v, want %v", leaf[0].Subject.CommonName, username)
+		}
+
+		deposited, err := strategy.DepositClientCertificate(username, response, DepositParams{Target: DepositTargetKubernetes})
+		if err != nil {
+			t.Fatalf("DepositClientCertificate() error = %v", err)
+		}
+		secret, err := clientset.CoreV1().Secrets("test").Get(context.TODO(), deposited.Location.SecretName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("could not get secret: %v", err)
+		}
+		if deposited.Location.SecretName != constants.GetClientTLSSecretName(username, "mycluster") {
+			t.Errorf("SecretName = %v, want %v", deposited.Location.SecretName, constants.GetClientTLSSecretName(username, "mycluster"))
+		}
+		if string(secret.Data[constants.ServerKeyName]) != string(response.Key) {
+			t.Errorf("secret of %v does not hold the client key", username)
+		}
+	}
+
+	// The CA signing the client certificates must survive a restart
+	if !fileExists(strategy.getPath(strategy.BasePath, caName, certExt)) {
+		t.Errorf("CA has not been persisted")
+	}
+}
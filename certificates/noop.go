@@ -5,10 +5,19 @@ const Noop = "noop"
 type NoopStrategy struct{}
 
 func (n NoopStrategy) Request(params RequestParams) (RequestResponse, error) {
+	if _, err := getExtKeyUsage(params.Usage); err != nil {
+		return RequestResponse{}, err
+	}
 	return RequestResponse{}, nil
 }
 
 func (n NoopStrategy) Deposit(params DepositParams) (DepositResponse, error) {
+	if params.Target == DepositTargetKubernetes {
+		return DepositResponse{}, nil
+	}
+	if err := checkDepositTarget(params.Target); err != nil {
+		return DepositResponse{}, err
+	}
 	return DepositResponse{}, nil
 }
 
@@ -1,19 +1,413 @@
 package certificates
 
-const RemoteCA = "remote_ca"
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	RemoteCA = "remote_ca"
+
+	defaultRemoteCAPollInterval = 5 * time.Second
+	defaultRemoteCATimeout      = 5 * time.Minute
+
+	remoteCAStatusPending  = "pending"
+	remoteCAStatusIssued   = "issued"
+	remoteCAStatusRejected = "rejected"
+)
+
+// RemoteCAStrategy requests certificates from a remote CA using a CSR flow.
+// The key never leaves the host: a PKCS#10 CSR is POSTed to <Endpoint>/sign and
+// the CA answers with a certificate request document, which is polled at
+// <Endpoint>/certificates/<id> until the certificate has been issued
 type RemoteCAStrategy struct {
+	Log         *logrus.Entry
+	Domain      string
+	CommonName  string
+	BasePath    string
+	DNSNames    []string
+	IPAddresses []string
+	// KeyAlgorithm used when the request does not ask for one, RSA 2048 by default
+	KeyAlgorithm KeyAlgorithm
+
+	Endpoint     string
+	RootCAPath   string // Trust bundle used to validate the returned chain, system roots are used when empty
+	PollInterval time.Duration
+	Timeout      time.Duration
+	HTTPClient   *http.Client
+
+	Secret SecretDeposit
+
+	generatedKeyPairs
+	requested RequestResponse
+	// usage of the requested certificate, client certificates are stored apart from the server ones
+	usage Usage
+}
+
+type remoteCASignRequest struct {
+	CSR      string `json:"csr"`
+	Usage    Usage  `json:"usage,omitempty"`
+	Validity string `json:"validity,omitempty"` // Go duration, e.g. 720h
+}
+
+type remoteCACertificate struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Certificate string `json:"certificate,omitempty"` // PEM chain, leaf first
+	Reason      string `json:"reason,omitempty"`
+}
+
+func (r *RemoteCAStrategy) Request(params RequestParams) (RequestResponse, error) {
+	response, err := r.request(params)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	r.requested, r.usage = response, params.Usage
+	return response, nil
+}
+
+func (r *RemoteCAStrategy) request(params RequestParams) (RequestResponse, error) {
+	r.Log.Infof("requesting certificates from remote CA %v", r.Endpoint)
+	if r.Endpoint == "" {
+		return RequestResponse{}, fmt.Errorf("remote CA endpoint is not configured")
+	}
+	algorithm, err := selectKeyAlgorithm(params.KeyAlgorithm, r.KeyAlgorithm)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	params.KeyAlgorithm = algorithm
+	if _, err := getExtKeyUsage(params.Usage); err != nil {
+		return RequestResponse{}, err
+	}
+	r.generatedKeyPairs = generatedKeyPairs{}
+
+	certPath, keyPath := r.getLocation(r.BasePath).pairPaths(params.Usage)
+	if !params.Force && fileExists(certPath, keyPath) {
+		chainPEM, keyPEM, err := readKeyPair(certPath, keyPath)
+		if err != nil {
+			return RequestResponse{}, err
+		}
+		if err := r.validateStored(chainPEM, params); err == nil {
+			r.Log.Infof("certificates exist and are valid, skip request")
+			return r.newResponse(chainPEM, keyPEM)
+		}
+		r.Log.Infof("certificates exist, but are not valid anymore")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.getTimeout())
+	defer cancel()
+
+	privateKey, err := generateKey(params.KeyAlgorithm)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	csrPEM, err := r.createCSR(privateKey, params)
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not createCSR: %v", err)
+	}
+
+	issued, err := r.submit(ctx, csrPEM, params)
+	if err != nil {
+		return RequestResponse{}, fmt.Errorf("could not submit CSR: %v", err)
+	}
+	issued, err = r.waitForCertificate(ctx, issued)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+
+	chainPEM := []byte(issued.Certificate)
+	if err := r.validateChain(chainPEM, privateKey.Public(), params); err != nil {
+		return RequestResponse{}, fmt.Errorf("remote CA returned an invalid chain: %v", err)
+	}
+
+	keyPEM, err := encodePrivateKey(privateKey)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	r.Log.Infof("certificate %v has been issued", issued.ID)
+
+	r.Cert = chainPEM
+	r.Key = keyPEM
+	return r.newResponse(r.Cert, r.Key)
+}
+
+func (r *RemoteCAStrategy) Deposit(params DepositParams) (DepositResponse, error) {
+	if params.Target == DepositTargetKubernetes {
+		return r.Secret.depositLeaf(params.getContext(), r.usage, r.requested)
+	}
+	if err := checkDepositTarget(params.Target); err != nil {
+		return DepositResponse{}, err
+	}
+	location := r.getLocation(params.getBasePath(r.BasePath))
+	if r.Cert == nil {
+		return DepositResponse{Location: location}, nil
+	}
+	r.Log.Infof("storing certificates")
+
+	certPath, keyPath := location.pairPaths(r.usage)
+	if err := writeKeyPair(certPath, keyPath, r.Cert, r.Key); err != nil {
+		return DepositResponse{}, err
+	}
+
+	r.Log.Infof("certificates stored at: %v, %v", certPath, keyPath)
+	return DepositResponse{Location: location}, nil
+}
+
+func (r *RemoteCAStrategy) GetLocations(params GetLocationParams) (Location, error) {
+	return r.getLocation(r.BasePath), nil
+}
+
+func (r *RemoteCAStrategy) getLocation(basePath string) Location {
+	clientName := fmt.Sprintf("%v-%v", r.Domain, clientSuffix)
+	return Location{
+		CertPath:       r.getPath(basePath, r.Domain, certExt),
+		KeyPath:        r.getPath(basePath, r.Domain, keyExt),
+		CAPath:         r.RootCAPath,
+		ClientCertPath: r.getPath(basePath, clientName, certExt),
+		ClientKeyPath:  r.getPath(basePath, clientName, keyExt),
+	}
+}
+
+func (r *RemoteCAStrategy) newResponse(chainPEM, keyPEM []byte) (RequestResponse, error) {
+	var caPEM []byte
+	if r.RootCAPath != "" {
+		rootPEM, err := os.ReadFile(r.RootCAPath)
+		if err != nil {
+			return RequestResponse{}, fmt.Errorf("could not read root CA: %v", err)
+		}
+		caPEM = rootPEM
+	}
+	return newRequestResponse(chainPEM, keyPEM, caPEM)
+}
+
+func (r *RemoteCAStrategy) createCSR(key crypto.Signer, params RequestParams) ([]byte, error) {
+	// Client certificates are identified by their common name, the cluster names are not needed
+	dnsNames := r.getDNSNames(params)
+	ipAddresses := mergeNames(r.IPAddresses, params.IPAddresses)
+	if params.Usage == UsageClient {
+		dnsNames, ipAddresses = params.DNSNames, params.IPAddresses
+	}
+	parsedIPs, err := parseIPs(ipAddresses)
+	if err != nil {
+		return nil, err
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: r.getCommonName(params),
+		},
+		DNSNames:    dnsNames,
+		IPAddresses: parsedIPs,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csrBytes,
+	}), nil
+}
+
+func (r *RemoteCAStrategy) submit(ctx context.Context, csrPEM []byte, params RequestParams) (remoteCACertificate, error) {
+	signRequest := remoteCASignRequest{
+		CSR:   string(csrPEM),
+		Usage: params.Usage,
+	}
+	if params.Validity > 0 {
+		signRequest.Validity = params.Validity.String()
+	}
+	body, err := json.Marshal(signRequest)
+	if err != nil {
+		return remoteCACertificate{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.getURL("sign"), bytes.NewReader(body))
+	if err != nil {
+		return remoteCACertificate{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return r.do(req)
+}
+
+func (r *RemoteCAStrategy) waitForCertificate(ctx context.Context, issued remoteCACertificate) (remoteCACertificate, error) {
+	ticker := time.NewTicker(r.getPollInterval())
+	defer ticker.Stop()
+
+	for {
+		switch issued.Status {
+		case remoteCAStatusIssued:
+			return issued, nil
+		case remoteCAStatusRejected:
+			return remoteCACertificate{}, fmt.Errorf("remote CA rejected certificate %v: %v", issued.ID, issued.Reason)
+		case remoteCAStatusPending:
+		default:
+			return remoteCACertificate{}, fmt.Errorf("unknown status %q for certificate %v", issued.Status, issued.ID)
+		}
+
+		select {
+		case <-ctx.Done():
+			return remoteCACertificate{}, fmt.Errorf("certificate %v has not been issued in time: %v", issued.ID, ctx.Err())
+		case <-ticker.C:
+		}
+
+		r.Log.Debugf("polling remote CA for certificate %v", issued.ID)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.getURL("certificates", issued.ID), nil)
+		if err != nil {
+			return remoteCACertificate{}, err
+		}
+		polled, err := r.do(req)
+		if err != nil {
+			return remoteCACertificate{}, fmt.Errorf("could not poll certificate %v: %v", issued.ID, err)
+		}
+		issued = polled
+	}
+}
+
+func (r *RemoteCAStrategy) do(req *http.Request) (remoteCACertificate, error) {
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.getHTTPClient().Do(req)
+	if err != nil {
+		return remoteCACertificate{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return remoteCACertificate{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return remoteCACertificate{}, fmt.Errorf("remote CA answered with status %v: %s", resp.StatusCode, body)
+	}
+
+	var issued remoteCACertificate
+	if err := json.Unmarshal(body, &issued); err != nil {
+		return remoteCACertificate{}, fmt.Errorf("could not decode remote CA response: %v", err)
+	}
+	return issued, nil
+}
+
+// validateChain checks that the leaf is currently valid for the requested names and usage, that it chains up
+// to the trusted roots and, when a public key is given, that the leaf has been issued for it
+func (r *RemoteCAStrategy) validateChain(chainPEM []byte, publicKey crypto.PublicKey, params RequestParams) error {
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return err
+	}
+	leaf := chain[0]
+
+	if publicKey != nil {
+		leafKey, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !leafKey.Equal(publicKey) {
+			return fmt.Errorf("certificate public key does not match the requested key")
+		}
+	}
+	if err := checkStoredKeyAlgorithm(chainPEM, params.KeyAlgorithm); err != nil {
+		return err
+	}
+
+	roots, err := r.getRoots()
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	extKeyUsage, err := getExtKeyUsage(params.Usage)
+	if err != nil {
+		return err
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     extKeyUsage,
+	}); err != nil {
+		return err
+	}
+	if params.Usage == UsageClient {
+		return nil
+	}
+	return coversNames(chainPEM, r.getDNSNames(params), mergeNames(r.IPAddresses, params.IPAddresses))
+}
+
+// validateStored checks a stored chain as validateChain does, and that it has been issued for the requested common name
+func (r *RemoteCAStrategy) validateStored(chainPEM []byte, params RequestParams) error {
+	if err := checkLeafUsage(chainPEM, r.getCommonName(params), params.Usage); err != nil {
+		return err
+	}
+	return r.validateChain(chainPEM, nil, params)
+}
+
+func (r *RemoteCAStrategy) getRoots() (*x509.CertPool, error) {
+	if r.RootCAPath == "" {
+		return x509.SystemCertPool()
+	}
+	rootPEM, err := os.ReadFile(r.RootCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read root CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
+		return nil, fmt.Errorf("failed to parse root CA %v", r.RootCAPath)
+	}
+	return roots, nil
+}
+
+func (r *RemoteCAStrategy) getDNSNames(params RequestParams) []string {
+	return mergeNames([]string{r.Domain}, r.DNSNames, params.DNSNames)
+}
+
+func (r *RemoteCAStrategy) getURL(parts ...string) string {
+	return strings.TrimSuffix(r.Endpoint, "/") + "/" + strings.Join(parts, "/")
+}
+
+func (r *RemoteCAStrategy) getHTTPClient() *http.Client {
+	if r.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return r.HTTPClient
+}
+
+func (r *RemoteCAStrategy) getPollInterval() time.Duration {
+	if r.PollInterval <= 0 {
+		return defaultRemoteCAPollInterval
+	}
+	return r.PollInterval
 }
 
-func (r RemoteCAStrategy) Request(params RequestParams) (RequestResponse, error) {
-	// TODO make a http call to the remote CA to request certificates
-	return RequestResponse{}, nil
+func (r *RemoteCAStrategy) getTimeout() time.Duration {
+	if r.Timeout <= 0 {
+		return defaultRemoteCATimeout
+	}
+	return r.Timeout
 }
 
-func (r RemoteCAStrategy) Deposit(params DepositParams) (DepositResponse, error) {
-	return DepositResponse{}, nil
+func (r *RemoteCAStrategy) getCommonName(params RequestParams) string {
+	if params.CommonName != "" {
+		return params.CommonName
+	}
+	if r.CommonName != "" {
+		return r.CommonName
+	}
+	return r.Domain
 }
 
-func (r RemoteCAStrategy) GetLocations(params GetLocationParams) (Location, error) {
-	return Location{}, nil
+func (r *RemoteCAStrategy) getPath(basePath, name, extension string) string {
+	return fmt.Sprintf("%s/%s.%s", basePath, name, extension)
 }
@@ -0,0 +1,189 @@
+package certificates
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/borealisdb/commons/logger"
+)
+
+// fakeRemoteCA signs every CSR with its own root, answering "pending" to the first poll
+type fakeRemoteCA struct {
+	t      *testing.T
+	issuer *issuer
+	mu     sync.Mutex
+	csrs   map[string]*x509.CertificateRequest
+	usages map[string]Usage
+	polls  map[string]int
+	reject bool
+}
+
+func (f *fakeRemoteCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/sign":
+		var req remoteCASignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil || csr.CheckSignature() != nil {
+			http.Error(w, "invalid csr", http.StatusBadRequest)
+			return
+		}
+		id := csr.Subject.CommonName
+		f.csrs[id], f.usages[id] = csr, req.Usage
+		status := remoteCAStatusPending
+		if f.reject {
+			status = remoteCAStatusRejected
+		}
+		_ = json.NewEncoder(w).Encode(remoteCACertificate{ID: id, Status: status, Reason: "policy"})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/certificates/"):
+		id := strings.TrimPrefix(r.URL.Path, "/certificates/")
+		csr, ok := f.csrs[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.polls[id]++
+		if f.polls[id] < 2 {
+			_ = json.NewEncoder(w).Encode(remoteCACertificate{ID: id, Status: remoteCAStatusPending})
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(f.polls[id])),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			IPAddresses:  csr.IPAddresses,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		}
+		template.ExtKeyUsage, _ = getExtKeyUsage(f.usages[id])
+		certBytes, err := x509.CreateCertificate(rand.Reader, template, f.issuer.cert, csr.PublicKey, f.issuer.key)
+		if err != nil {
+			f.t.Errorf("could not sign csr: %v", err)
+			return
+		}
+		chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+		_ = json.NewEncoder(w).Encode(remoteCACertificate{ID: id, Status: remoteCAStatusIssued, Certificate: string(chain)})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestRemoteCAStrategy_Request(t *testing.T) {
+	iss, rootPair, err := makeRootCert(DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("makeRootCert(DefaultKeyAlgorithm) error = %v", err)
+	}
+	basePath := t.TempDir()
+	rootCAPath := filepath.Join(basePath, "root.crt")
+	if err := os.WriteFile(rootCAPath, rootPair.Cert.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		reject     bool
+		rootCAPath string
+		wantErr    bool
+	}{
+		{
+			name:       "certificate is issued after polling",
+			rootCAPath: rootCAPath,
+		},
+		{
+			name:       "certificate request is rejected",
+			reject:     true,
+			rootCAPath: rootCAPath,
+			wantErr:    true,
+		},
+		{
+			name:       "returned chain is not trusted",
+			rootCAPath: "",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(&fakeRemoteCA{
+				t:      t,
+				issuer: iss,
+				csrs:   map[string]*x509.CertificateRequest{},
+				usages: map[string]Usage{},
+				polls:  map[string]int{},
+				reject: tt.reject,
+			})
+			defer server.Close()
+
+			strategy := &RemoteCAStrategy{
+				Log:          logger.NewDefaultLogger("info", "certificates"),
+				Domain:       "mycluster.borealisdb.io",
+				CommonName:   "mycluster",
+				BasePath:     t.TempDir(),
+				DNSNames:     []string{"mycluster.default.svc.cluster.local"},
+				IPAddresses:  []string{"10.0.0.1"},
+				Endpoint:     server.URL,
+				RootCAPath:   tt.rootCAPath,
+				PollInterval: 10 * time.Millisecond,
+				Timeout:      5 * time.Second,
+			}
+			_, err := strategy.Request(RequestParams{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Request() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if _, err := strategy.Deposit(DepositParams{}); err != nil {
+				t.Fatalf("Deposit() error = %v", err)
+			}
+			location, _ := strategy.GetLocations(GetLocationParams{})
+			chain, err := parseCertificates(readFile(t, location.CertPath))
+			if err != nil {
+				t.Fatalf("parseCertificates() error = %v", err)
+			}
+			if got := chain[0].DNSNames; len(got) != 2 || got[1] != "mycluster.default.svc.cluster.local" {
+				t.Errorf("DNSNames = %v", got)
+			}
+			if got := chain[0].IPAddresses; len(got) != 1 || got[0].String() != "10.0.0.1" {
+				t.Errorf("IPAddresses = %v", got)
+			}
+
+			// A client certificate is requested and stored apart from the server one
+			client, err := strategy.Request(RequestParams{CommonName: "application", Usage: UsageClient})
+			if err != nil {
+				t.Fatalf("Request() of a client certificate error = %v", err)
+			}
+			if err := checkLeafUsage(client.Certificate, "application", UsageClient); err != nil {
+				t.Errorf("client certificate: %v", err)
+			}
+			if _, err := strategy.Deposit(DepositParams{}); err != nil {
+				t.Fatalf("Deposit() error = %v", err)
+			}
+			if err := checkLeafUsage(readFile(t, location.CertPath), "mycluster", UsageServer); err != nil {
+				t.Errorf("server certificate: %v", err)
+			}
+			if err := checkLeafUsage(readFile(t, location.ClientCertPath), "application", UsageClient); err != nil {
+				t.Errorf("stored client certificate: %v", err)
+			}
+		})
+	}
+}
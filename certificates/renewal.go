@@ -0,0 +1,185 @@
+package certificates
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRenewalFraction renews certificates once two thirds of their lifetime have passed
+	DefaultRenewalFraction = 2.0 / 3.0
+	DefaultCheckInterval   = time.Hour
+
+	subscriberBufferSize = 16
+)
+
+// RenewalEvent is sent to the subscribers every time a certificate has been renewed
+type RenewalEvent struct {
+	Name     string
+	Location Location
+	NotAfter time.Time
+}
+
+// RenewalManager watches the certificates of every strategy and renews them
+// ahead of expiry, so Postgres can reload TLS without any downtime
+type RenewalManager struct {
+	Log        *logrus.Entry
+	Strategies map[string]CertificateAuthority
+	// RenewalFraction of the certificate lifetime after which it gets renewed, between 0 and 1
+	RenewalFraction float64
+	CheckInterval   time.Duration
+	// OnRenew is called synchronously after every renewal, it can be nil
+	OnRenew func(event RenewalEvent)
+
+	mu          sync.Mutex
+	subscribers []chan RenewalEvent
+	now         func() time.Time
+}
+
+// Subscribe returns a channel receiving the renewal events.
+// Events are dropped for subscribers which are not keeping up
+func (m *RenewalManager) Subscribe() <-chan RenewalEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan RenewalEvent, subscriberBufferSize)
+	m.subscribers = append(m.subscribers, ch)
+	return ch
+}
+
+// Run checks the certificates every CheckInterval until the context is cancelled
+func (m *RenewalManager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.getCheckInterval())
+	defer ticker.Stop()
+	defer m.closeSubscribers()
+
+	for {
+		m.CheckAll()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll renews every certificate which reached its renewal time
+func (m *RenewalManager) CheckAll() {
+	for name, strategy := range m.Strategies {
+		if err := m.Check(name, strategy); err != nil {
+			m.Log.WithError(err).Errorf("could not renew certificates for %v", name)
+		}
+	}
+}
+
+// Check renews the certificate of a single strategy when it reached its renewal time
+func (m *RenewalManager) Check(name string, strategy CertificateAuthority) error {
+	location, err := strategy.GetLocations(GetLocationParams{})
+	if err != nil {
+		return fmt.Errorf("could not GetLocations: %v", err)
+	}
+	// Nothing is stored by this strategy, e.g. noop
+	if location.CertPath == "" {
+		return nil
+	}
+
+	previous, err := readLeaf(location.CertPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if previous != nil {
+		renewAt := m.computeRenewalTime(previous.NotBefore, previous.NotAfter)
+		if m.getNow().Before(renewAt) {
+			m.Log.Debugf("certificates for %v will be renewed at %v", name, renewAt)
+			return nil
+		}
+	}
+
+	return m.renew(name, strategy, previous)
+}
+
+func (m *RenewalManager) renew(name string, strategy CertificateAuthority, previous *x509.Certificate) error {
+	m.Log.Infof("renewing certificates for %v", name)
+	if _, err := strategy.Request(RequestParams{Force: true}); err != nil {
+		return fmt.Errorf("could not Request: %v", err)
+	}
+	if _, err := strategy.Deposit(DepositParams{}); err != nil {
+		return fmt.Errorf("could not Deposit: %v", err)
+	}
+
+	location, err := strategy.GetLocations(GetLocationParams{})
+	if err != nil {
+		return fmt.Errorf("could not GetLocations: %v", err)
+	}
+	leaf, err := readLeaf(location.CertPath)
+	if err != nil {
+		return err
+	}
+	// Certificates which are managed outside of Borealis, e.g. the custom strategy, are not renewed by Request
+	if previous != nil && bytes.Equal(previous.Raw, leaf.Raw) {
+		return fmt.Errorf("certificates have not been renewed by the strategy, they expire at %v", leaf.NotAfter)
+	}
+
+	m.Log.Infof("certificates for %v have been renewed, they expire at %v", name, leaf.NotAfter)
+	m.notify(RenewalEvent{
+		Name:     name,
+		Location: location,
+		NotAfter: leaf.NotAfter,
+	})
+	return nil
+}
+
+func (m *RenewalManager) computeRenewalTime(notBefore, notAfter time.Time) time.Time {
+	fraction := m.RenewalFraction
+	if fraction <= 0 || fraction >= 1 {
+		fraction = DefaultRenewalFraction
+	}
+	lifetime := notAfter.Sub(notBefore)
+	return notBefore.Add(time.Duration(float64(lifetime) * fraction))
+}
+
+func (m *RenewalManager) notify(event RenewalEvent) {
+	if m.OnRenew != nil {
+		m.OnRenew(event)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ch := range m.subscribers {
+		select {
+		case ch <- event:
+		default:
+			m.Log.Warnf("subscriber is not keeping up, dropping renewal event for %v", event.Name)
+		}
+	}
+}
+
+func (m *RenewalManager) closeSubscribers() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ch := range m.subscribers {
+		close(ch)
+	}
+	m.subscribers = nil
+}
+
+func (m *RenewalManager) getCheckInterval() time.Duration {
+	if m.CheckInterval <= 0 {
+		return DefaultCheckInterval
+	}
+	return m.CheckInterval
+}
+
+func (m *RenewalManager) getNow() time.Time {
+	if m.now == nil {
+		return time.Now()
+	}
+	return m.now()
+}
@@ -0,0 +1,139 @@
+package certificates
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/borealisdb/commons/logger"
+)
+
+func TestRenewalManager_Check(t *testing.T) {
+	tests := []struct {
+		name        string
+		strategy    string
+		elapsed     time.Duration
+		wantRenewed bool
+		wantErr     bool
+	}{
+		{
+			name:     "certificates are fresh",
+			strategy: Autogenerated,
+			elapsed:  24 * time.Hour,
+		},
+		{
+			name:        "two thirds of the lifetime have passed",
+			strategy:    Autogenerated,
+			elapsed:     125 * 24 * time.Hour,
+			wantRenewed: true,
+		},
+		{
+			name:     "custom certificates can not be renewed",
+			strategy: Custom,
+			elapsed:  125 * 24 * time.Hour,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basePath := t.TempDir()
+			log := logger.NewDefaultLogger("info", "certificates")
+			// Both strategies point to the same files, the custom one only reads them
+			autogenerated := GetStrategy(Autogenerated, StrategiesParams{
+				Domain:     "mycluster.borealisdb.io",
+				CommonName: "mycluster.borealisdb.io",
+				BasePath:   basePath,
+				Log:        log,
+			})
+			if _, err := autogenerated.Request(RequestParams{}); err != nil {
+				t.Fatalf("Request() error = %v", err)
+			}
+			if _, err := autogenerated.Deposit(DepositParams{}); err != nil {
+				t.Fatalf("Deposit() error = %v", err)
+			}
+			location, _ := autogenerated.GetLocations(GetLocationParams{})
+			strategy := GetStrategy(tt.strategy, StrategiesParams{
+				Domain:             "mycluster.borealisdb.io",
+				CommonName:         "mycluster.borealisdb.io",
+				BasePath:           basePath,
+				CertificatePath:    location.CertPath,
+				CertificateKeyPath: location.KeyPath,
+				Log:                log,
+			})
+			previous := readFile(t, location.CertPath)
+
+			var callbacks int
+			manager := &RenewalManager{
+				Log:        log,
+				Strategies: map[string]CertificateAuthority{"mycluster": strategy},
+				OnRenew:    func(event RenewalEvent) { callbacks++ },
+				now:        func() time.Time { return time.Now().Add(tt.elapsed) },
+			}
+			events := manager.Subscribe()
+
+			err := manager.Check("mycluster", strategy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			renewed := string(readFile(t, location.CertPath)) != string(previous)
+			if renewed != tt.wantRenewed {
+				t.Errorf("renewed = %v, want %v", renewed, tt.wantRenewed)
+			}
+			if !tt.wantRenewed {
+				if callbacks != 0 || len(events) != 0 {
+					t.Errorf("subscribers have been notified without renewal")
+				}
+				return
+			}
+			if callbacks != 1 {
+				t.Errorf("OnRenew called %v times, want 1", callbacks)
+			}
+			select {
+			case event := <-events:
+				if event.Name != "mycluster" || event.Location.CertPath != location.CertPath {
+					t.Errorf("unexpected event %+v", event)
+				}
+			default:
+				t.Errorf("no renewal event received")
+			}
+		})
+	}
+}
+
+func TestWriteKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	// A pair left by a previous release as regular files
+	if err := os.WriteFile(certPath, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, pair, err := makeRootCert(DefaultKeyAlgorithm)
+		if err != nil {
+			t.Fatalf("makeRootCert() error = %v", err)
+		}
+		if err := writeKeyPair(certPath, keyPath, pair.Cert.Bytes(), pair.Key.Bytes()); err != nil {
+			t.Fatalf("writeKeyPair() error = %v", err)
+		}
+		if _, _, err := readKeyPair(certPath, keyPath); err != nil {
+			t.Errorf("readKeyPair() error = %v", err)
+		}
+		if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("key should be stored with 0600 permissions, got %v", info.Mode().Perm())
+		}
+	}
+
+	// Both paths go through the current link, and only the current and the previous versions are kept
+	for _, path := range []string{certPath, keyPath} {
+		if info, err := os.Lstat(path); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%v is not a symlink", path)
+		}
+	}
+	versions, _ := filepath.Glob(filepath.Join(dir, ".server.crt.v*"))
+	if len(versions) != 2 {
+		t.Errorf("versions = %v, want 2", versions)
+	}
+}
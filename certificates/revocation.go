@@ -0,0 +1,261 @@
+package certificates
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultCRLValidity is the time after which clients consider a CRL stale, it must be published again before then
+	DefaultCRLValidity = 7 * 24 * time.Hour
+)
+
+// RevocationReason codes as defined by RFC 5280
+type RevocationReason int
+
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonCACompromise         RevocationReason = 2
+	ReasonAffiliationChanged   RevocationReason = 3
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+)
+
+// CertificateStatus answers an OCSP-style status query for a serial number
+type CertificateStatus string
+
+const (
+	StatusGood    CertificateStatus = "good"
+	StatusRevoked CertificateStatus = "revoked"
+	StatusUnknown CertificateStatus = "unknown"
+)
+
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// IssuedCertificate is the registry record of a leaf signed by the CA
+type IssuedCertificate struct {
+	SerialNumber string `json:"serialNumber"`
+	CommonName   string `json:"commonName"`
+	// AuthorityKeyID identifies the CA which signed the certificate, hex encoded
+	AuthorityKeyID string `json:"authorityKeyId,omitempty"`
+	// Scope is the cluster the certificate has been issued for, empty for records which predate it
+	Scope string `json:"scope,omitempty"`
+	// CA is set for the intermediates, which belong to no cluster when shared by a namespace
+	CA        bool             `json:"ca,omitempty"`
+	NotAfter  time.Time        `json:"notAfter"`
+	RevokedAt *time.Time       `json:"revokedAt,omitempty"`
+	Reason    RevocationReason `json:"reason,omitempty"`
+}
+
+type registryState struct {
+	CRLNumber    int64               `json:"crlNumber"`
+	Certificates []IssuedCertificate `json:"certificates"`
+}
+
+// RevocationRegistry records every serial issued by a CA in a JSON file next to the CA key,
+// so leaked certificates can be revoked and published in a CRL
+type RevocationRegistry struct {
+	Path string
+	// Scope is the cluster the registry records and revokes certificates for, as the clusters of a CA share its registry
+	Scope string
+}
+
+// Record adds an issued certificate to the registry
+func (r *RevocationRegistry) Record(cert *x509.Certificate) error {
+	// The clusters of a CA each have their own registry over the same file
+	defer lockPath(r.Path)()
+	state, err := r.load()
+	if err != nil {
+		return err
+	}
+	state.Certificates = append(state.Certificates, IssuedCertificate{
+		SerialNumber:   cert.SerialNumber.String(),
+		CommonName:     cert.Subject.CommonName,
+		AuthorityKeyID: hex.EncodeToString(cert.AuthorityKeyId),
+		Scope:          r.Scope,
+		CA:             cert.IsCA,
+		NotAfter:       cert.NotAfter,
+	})
+	return r.save(state)
+}
+
+// Revoke revokes a single certificate by serial number, issued in the scope of the registry
+func (r *RevocationRegistry) Revoke(serial *big.Int, reason RevocationReason) error {
+	defer lockPath(r.Path)()
+	state, err := r.load()
+	if err != nil {
+		return err
+	}
+	for i := range state.Certificates {
+		issued := &state.Certificates[i]
+		if issued.SerialNumber != serial.String() || issued.Scope != r.Scope {
+			continue
+		}
+		if issued.RevokedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		issued.RevokedAt = &now
+		issued.Reason = reason
+		return r.save(state)
+	}
+	return fmt.Errorf("certificate with serial %v has not been issued by this CA", serial)
+}
+
+// RevokeSubject revokes every unexpired leaf issued for the common name in the scope of the registry and returns them
+func (r *RevocationRegistry) RevokeSubject(commonName string, reason RevocationReason) ([]IssuedCertificate, error) {
+	defer lockPath(r.Path)()
+	state, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var revoked []IssuedCertificate
+	for i := range state.Certificates {
+		issued := &state.Certificates[i]
+		if issued.CommonName != commonName || issued.Scope != r.Scope || issued.CA {
+			continue
+		}
+		if issued.RevokedAt != nil || now.After(issued.NotAfter) {
+			continue
+		}
+		issued.RevokedAt = &now
+		issued.Reason = reason
+		revoked = append(revoked, *issued)
+	}
+	if len(revoked) == 0 {
+		return nil, fmt.Errorf("no valid certificate issued for %v", commonName)
+	}
+	return revoked, r.save(state)
+}
+
+// Status returns whether the certificate is good, revoked or has never been issued by this CA
+func (r *RevocationRegistry) Status(serial *big.Int) (CertificateStatus, error) {
+	defer lockPath(r.Path)()
+	state, err := r.load()
+	if err != nil {
+		return StatusUnknown, err
+	}
+	for _, issued := range state.Certificates {
+		if issued.SerialNumber != serial.String() || issued.Scope != r.Scope {
+			continue
+		}
+		if issued.RevokedAt != nil {
+			return StatusRevoked, nil
+		}
+		return StatusGood, nil
+	}
+	return StatusUnknown, nil
+}
+
+// createCRL returns a PEM encoded CRL signed by the issuer, listing every revoked certificate it issued which is not expired yet.
+// The leaves of the other clusters of a shared issuer are left out, the intermediates are listed by the root CRL of every cluster
+func (r *RevocationRegistry) createCRL(iss *issuer, validity time.Duration) ([]byte, error) {
+	if iss.cert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, fmt.Errorf("CA %v is not allowed to sign CRLs, it must be recreated", iss.cert.Subject.CommonName)
+	}
+	if validity <= 0 {
+		validity = DefaultCRLValidity
+	}
+
+	defer lockPath(r.Path)()
+	state, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	issuerKeyID := hex.EncodeToString(iss.cert.SubjectKeyId)
+	var revoked []pkix.RevokedCertificate
+	for _, issued := range state.Certificates {
+		if issued.RevokedAt == nil || now.After(issued.NotAfter) {
+			continue
+		}
+		if issued.AuthorityKeyID != "" && issued.AuthorityKeyID != issuerKeyID {
+			continue
+		}
+		if !issued.CA && issued.Scope != "" && issued.Scope != r.Scope {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(issued.SerialNumber, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %v in registry", issued.SerialNumber)
+		}
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: *issued.RevokedAt,
+		}
+		// The reason code extension should be absent instead of unspecified
+		if issued.Reason != ReasonUnspecified {
+			value, err := asn1.Marshal(asn1.Enumerated(issued.Reason))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidExtensionReasonCode, Value: value}}
+		}
+		revoked = append(revoked, entry)
+	}
+
+	// CRL numbers must be monotonically increasing
+	state.CRLNumber++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(state.CRLNumber),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(validity),
+		RevokedCertificates: revoked,
+	}, iss.cert, iss.key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create CRL: %v", err)
+	}
+	if err := r.save(state); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
+
+func (r *RevocationRegistry) load() (registryState, error) {
+	var state registryState
+	content, err := os.ReadFile(r.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("could not read revocation registry: %v", err)
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, fmt.Errorf("could not parse revocation registry %v: %v", r.Path, err)
+	}
+	return state, nil
+}
+
+func (r *RevocationRegistry) save(state registryState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+		return err
+	}
+	tmpPath, err := writeTempFile(r.Path, content, 0600)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, r.Path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
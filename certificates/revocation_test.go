@@ -0,0 +1,183 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/borealisdb/commons/logger"
+)
+
+func TestInternalCAStrategy_Revocation(t *testing.T) {
+	strategy := &InternalCAStrategy{
+		Log:        logger.NewDefaultLogger("info", "certificates"),
+		Domain:     "mycluster.borealisdb.io",
+		CommonName: "mycluster",
+		BasePath:   t.TempDir(),
+	}
+	server, err := strategy.Request(RequestParams{})
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if _, err := strategy.Deposit(DepositParams{}); err != nil {
+		t.Fatalf("Deposit() error = %v", err)
+	}
+	analyst, err := strategy.IssueClientCertificate("analyst", RequestParams{})
+	if err != nil {
+		t.Fatalf("IssueClientCertificate() error = %v", err)
+	}
+	serverLeaf, _ := parseCertificates(server.Certificate)
+	analystLeaf, _ := parseCertificates(analyst.Certificate)
+
+	if status, _ := strategy.Status(analystLeaf[0].SerialNumber); status != StatusGood {
+		t.Errorf("Status() = %v, want %v", status, StatusGood)
+	}
+	revoked, err := strategy.RevokeSubject("analyst", ReasonKeyCompromise)
+	if err != nil {
+		t.Fatalf("RevokeSubject() error = %v", err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber != analystLeaf[0].SerialNumber.String() {
+		t.Errorf("RevokeSubject() revoked %+v", revoked)
+	}
+	if err := strategy.Revoke(serverLeaf[0].SerialNumber, ReasonSuperseded); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if err := strategy.Revoke(big.NewInt(42), ReasonUnspecified); err == nil {
+		t.Errorf("Revoke() of an unknown serial should fail")
+	}
+
+	crlPEM, err := strategy.GenerateCRL(0)
+	if err != nil {
+		t.Fatalf("GenerateCRL() error = %v", err)
+	}
+	// The intermediate CRL comes first, followed by the root one
+	intermediateBlock, rest := pem.Decode(crlPEM)
+	rootBlock, _ := pem.Decode(rest)
+	if intermediateBlock == nil || rootBlock == nil {
+		t.Fatalf("CRL bundle does not hold both the intermediate and the root CRLs")
+	}
+	intermediateCRL, err := x509.ParseDERCRL(intermediateBlock.Bytes)
+	if err != nil {
+		t.Fatalf("could not parse CRL: %v", err)
+	}
+	if err := serverLeaf[1].CheckCRLSignature(intermediateCRL); err != nil {
+		t.Errorf("CRL is not signed by the intermediate: %v", err)
+	}
+	if got := len(intermediateCRL.TBSCertList.RevokedCertificates); got != 2 {
+		t.Errorf("CRL lists %v certificates, want 2", got)
+	}
+	rootCRL, err := x509.ParseDERCRL(rootBlock.Bytes)
+	if err != nil {
+		t.Fatalf("could not parse CRL: %v", err)
+	}
+	ca, _ := parseCertificates(server.CA)
+	if err := ca[0].CheckCRLSignature(rootCRL); err != nil {
+		t.Errorf("root CRL is not signed by the root: %v", err)
+	}
+	if got := len(rootCRL.TBSCertList.RevokedCertificates); got != 0 {
+		t.Errorf("root CRL lists %v certificates, want 0", got)
+	}
+
+	deposited, err := strategy.DepositCRL(crlPEM, DepositParams{})
+	if err != nil {
+		t.Fatalf("DepositCRL() error = %v", err)
+	}
+	if got := deposited.Location.PostgresParameters()["ssl_crl_file"]; got != deposited.Location.CRLPath || got == "" {
+		t.Errorf("ssl_crl_file = %v, want %v", got, deposited.Location.CRLPath)
+	}
+	if string(readFile(t, deposited.Location.CRLPath)) != string(crlPEM) {
+		t.Errorf("stored CRL does not match the generated one")
+	}
+}
+
+func TestInternalCAStrategy_RevocationScope(t *testing.T) {
+	basePath := t.TempDir()
+	var strategies []*InternalCAStrategy
+	var analysts []*x509.Certificate
+	for _, cluster := range []string{"tenant-a", "tenant-b"} {
+		// Both clusters share the root, the namespace intermediate and the registry
+		strategy := &InternalCAStrategy{
+			Log:               logger.NewDefaultLogger("info", "certificates"),
+			Domain:            cluster + ".borealisdb.io",
+			CommonName:        cluster,
+			ClusterName:       cluster,
+			BasePath:          basePath,
+			IntermediateScope: IntermediateScopeNamespace,
+		}
+		analyst, err := strategy.IssueClientCertificate("analyst", RequestParams{})
+		if err != nil {
+			t.Fatalf("IssueClientCertificate() error = %v", err)
+		}
+		leaf, _ := parseCertificates(analyst.Certificate)
+		strategies = append(strategies, strategy)
+		analysts = append(analysts, leaf[0])
+	}
+
+	revoked, err := strategies[0].RevokeSubject("analyst", ReasonKeyCompromise)
+	if err != nil {
+		t.Fatalf("RevokeSubject() error = %v", err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber != analysts[0].SerialNumber.String() {
+		t.Errorf("RevokeSubject() revoked %+v", revoked)
+	}
+	if status, _ := strategies[1].Status(analysts[1].SerialNumber); status != StatusGood {
+		t.Errorf("certificate of the other cluster is %v, want %v", status, StatusGood)
+	}
+	if status, _ := strategies[0].Status(analysts[1].SerialNumber); status != StatusUnknown {
+		t.Errorf("Status() of a certificate of the other cluster = %v, want %v", status, StatusUnknown)
+	}
+	if err := strategies[0].Revoke(analysts[1].SerialNumber, ReasonSuperseded); err == nil {
+		t.Errorf("Revoke() of a certificate of the other cluster should fail")
+	}
+	if err := strategies[1].Revoke(analysts[1].SerialNumber, ReasonSuperseded); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+
+	// Each CRL only lists the revoked leaves of its own cluster
+	for i, strategy := range strategies {
+		crlPEM, err := strategy.GenerateCRL(0)
+		if err != nil {
+			t.Fatalf("GenerateCRL() error = %v", err)
+		}
+		block, _ := pem.Decode(crlPEM)
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			t.Fatalf("could not parse CRL: %v", err)
+		}
+		listed := crl.TBSCertList.RevokedCertificates
+		if len(listed) != 1 || listed[0].SerialNumber.Cmp(analysts[i].SerialNumber) != 0 {
+			t.Errorf("CRL of %v lists %v", strategy.ClusterName, listed)
+		}
+	}
+}
+
+func TestRevocationRegistry_ConcurrentRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), registryName+".json")
+	const clusters = 8
+	var wg sync.WaitGroup
+	for i := 0; i < clusters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			registry := &RevocationRegistry{Path: path, Scope: fmt.Sprintf("test/tenant%d", i)}
+			cert := &x509.Certificate{SerialNumber: big.NewInt(int64(i + 1)), NotAfter: time.Now().Add(time.Hour)}
+			if err := registry.Record(cert); err != nil {
+				t.Errorf("Record() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := (&RevocationRegistry{Path: path}).load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if got := len(state.Certificates); got != clusters {
+		t.Errorf("registry holds %v certificates, want %v", got, clusters)
+	}
+}
@@ -2,29 +2,38 @@ package certificates
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 type issuer struct {
+	// key is nil when the CA key is kept offline
 	key  crypto.Signer
 	cert *x509.Certificate
+	// chain holds the PEM encoded intermediates bundled after every leaf signed by this issuer
+	chain []byte
 }
 
-func makeRootCert() (*issuer, certsPair, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+func makeRootCert(algorithm KeyAlgorithm) (*issuer, certsPair, error) {
+	privateKey, err := generateKey(algorithm)
 	if err != nil {
 		return nil, certsPair{}, err
 	}
@@ -46,11 +55,12 @@ func makeRootCert() (*issuer, certsPair, error) {
 
 		SubjectKeyId:          skid,
 		AuthorityKeyId:        skid,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
-		MaxPathLenZero:        true,
+		// Leaves are signed by the intermediates only
+		MaxPathLen: 1,
 	}
 
 	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
@@ -66,11 +76,8 @@ func makeRootCert() (*issuer, certsPair, error) {
 		return nil, certsPair{}, err
 	}
 
-	certPrivateKeyPEM := new(bytes.Buffer)
-	if err := pem.Encode(certPrivateKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	}); err != nil {
+	certPrivateKeyPEM, err := encodePrivateKey(privateKey)
+	if err != nil {
 		return nil, certsPair{}, err
 	}
 
@@ -80,12 +87,12 @@ func makeRootCert() (*issuer, certsPair, error) {
 	}
 
 	return &issuer{
-			key:  privateKey,
-			cert: certificate,
-		}, certsPair{
-			Key:  certPrivateKeyPEM,
-			Cert: certPEM,
-		}, nil
+		key:  privateKey,
+		cert: certificate,
+	}, certsPair{
+		Key:  bytes.NewBuffer(certPrivateKeyPEM),
+		Cert: certPEM,
+	}, nil
 }
 
 func parseIPs(ipAddresses []string) ([]net.IP, error) {
@@ -123,22 +130,41 @@ type certsPair struct {
 	Cert *bytes.Buffer
 }
 
-func sign(iss *issuer, domains []string, ipAddresses []string) (certsPair, error) {
-	var cn string
-	if len(domains) > 0 {
-		cn = domains[0]
-	} else if len(ipAddresses) > 0 {
-		cn = ipAddresses[0]
-	} else {
-		return certsPair{}, fmt.Errorf("must specify at least one domain name or IP address")
+type signRequest struct {
+	commonName  string
+	domains     []string
+	ipAddresses []string
+	extKeyUsage []x509.ExtKeyUsage
+	validity    time.Duration
+	algorithm   KeyAlgorithm
+}
+
+func sign(iss *issuer, req signRequest) (certsPair, error) {
+	cn := req.commonName
+	if cn == "" {
+		if len(req.domains) > 0 {
+			cn = req.domains[0]
+		} else if len(req.ipAddresses) > 0 {
+			cn = req.ipAddresses[0]
+		} else {
+			return certsPair{}, fmt.Errorf("must specify at least one domain name or IP address")
+		}
+	}
+	extKeyUsage := req.extKeyUsage
+	if len(extKeyUsage) == 0 {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
 	}
+	notAfter := getLeafNotAfter(req.validity)
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if iss.key == nil {
+		return certsPair{}, fmt.Errorf("key of %v is offline", iss.cert.Subject.CommonName)
+	}
+	privateKey, err := generateKey(req.algorithm)
 	if err != nil {
 		return certsPair{}, err
 	}
 
-	parsedIPs, err := parseIPs(ipAddresses)
+	parsedIPs, err := parseIPs(req.ipAddresses)
 	if err != nil {
 		return certsPair{}, err
 	}
@@ -147,17 +173,17 @@ func sign(iss *issuer, domains []string, ipAddresses []string) (certsPair, error
 		return certsPair{}, err
 	}
 	template := &x509.Certificate{
-		DNSNames:    domains,
+		DNSNames:    req.domains,
 		IPAddresses: parsedIPs,
 		Subject: pkix.Name{
 			CommonName: cn,
 		},
 		SerialNumber: serial,
 		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(2, 0, 30),
+		NotAfter:     notAfter,
 
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              getKeyUsage(privateKey.Public()),
+		ExtKeyUsage:           extKeyUsage,
 		BasicConstraintsValid: true,
 		IsCA:                  false,
 	}
@@ -173,26 +199,432 @@ func sign(iss *issuer, domains []string, ipAddresses []string) (certsPair, error
 	}); err != nil {
 		return certsPair{}, err
 	}
+	certPEM.Write(iss.chain)
 
-	certPrivateKeyPEM := new(bytes.Buffer)
-	if err := pem.Encode(certPrivateKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	}); err != nil {
+	certPrivateKeyPEM, err := encodePrivateKey(privateKey)
+	if err != nil {
 		return certsPair{}, err
 	}
 
 	return certsPair{
-		Key:  certPrivateKeyPEM,
+		Key:  bytes.NewBuffer(certPrivateKeyPEM),
 		Cert: certPEM,
 	}, nil
 }
 
-func main2() error {
-	issuer, _, err := makeRootCert()
+// getLeafNotAfter returns the expiry of a leaf, 2 years and a month by default
+func getLeafNotAfter(validity time.Duration) time.Time {
+	if validity > 0 {
+		return time.Now().Add(validity)
+	}
+	return time.Now().AddDate(2, 0, 30)
+}
+
+// loadIssuer parses a CA, keyPEM is nil when the key is kept offline
+func loadIssuer(certPEM, keyPEM []byte) (*issuer, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("failed to parse CA certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %v is not a CA", cert.Subject.CommonName)
+	}
+
+	if keyPEM == nil {
+		return &issuer{cert: cert}, nil
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key: %v", err)
+	}
+
+	return &issuer{
+		key:  key,
+		cert: cert,
+	}, nil
+}
+
+// verifyLeaf checks that the PEM encoded leaf, followed by its intermediates,
+// chains up to the given CA and is still valid for the given usage
+func verifyLeaf(certPEM, caPEM []byte, dnsName string, usage x509.ExtKeyUsage) error {
+	roots := x509.NewCertPool()
+	if ok := roots.AppendCertsFromPEM(caPEM); !ok {
+		return fmt.Errorf("failed to parse root certificate")
+	}
+
+	chain, err := parseCertificates(certPEM)
 	if err != nil {
 		return err
 	}
-	_, err = sign(issuer, []string{}, []string{})
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		DNSName:       dnsName,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
 	return err
 }
+
+// pathLocks serialize the strategies of the process which share a file, such as the root CA or the registry
+var pathLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: map[string]*sync.Mutex{}}
+
+// lockPath locks a file until the returned function is called
+func lockPath(path string) (unlock func()) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	pathLocks.Lock()
+	lock, ok := pathLocks.locks[path]
+	if !ok {
+		lock = &sync.Mutex{}
+		pathLocks.locks[path] = lock
+	}
+	pathLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func fileExists(paths ...string) bool {
+	for _, path := range paths {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	keyPairCertName = "cert.pem"
+	keyPairKeyName  = "key.pem"
+)
+
+// writeKeyPair stores the certificate world readable, while the key is readable only by its owner
+// as Postgres refuses to start with a private key which has group or world access.
+// Both files are written to a new version directory next to the certificate, and certPath and keyPath are symlinks
+// through a current link which is swapped by a single rename. Readers opening both paths after the swap never see
+// a new key with a previous certificate, the previous version is kept for those which opened one path before it
+func writeKeyPair(certPath, keyPath string, cert, key []byte) error {
+	certPath, err := filepath.Abs(certPath)
+	if err != nil {
+		return err
+	}
+	keyPath, err = filepath.Abs(keyPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(certPath)
+	for _, d := range []string{dir, filepath.Dir(keyPath)} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	versionPrefix := "." + filepath.Base(certPath) + ".v"
+	version, err := os.MkdirTemp(dir, versionPrefix)
+	if err != nil {
+		return err
+	}
+	if err := writeVersion(version, cert, key); err != nil {
+		os.RemoveAll(version)
+		return err
+	}
+
+	currentLink := filepath.Join(dir, "."+filepath.Base(certPath)+".current")
+	previous, _ := os.Readlink(currentLink)
+	if err := replaceSymlink(filepath.Base(version), currentLink); err != nil {
+		os.RemoveAll(version)
+		return err
+	}
+	if err := linkInto(certPath, currentLink, keyPairCertName); err != nil {
+		return err
+	}
+	if err := linkInto(keyPath, currentLink, keyPairKeyName); err != nil {
+		return err
+	}
+	return removeVersions(dir, versionPrefix, filepath.Base(version), previous)
+}
+
+func writeVersion(version string, cert, key []byte) error {
+	if err := os.Chmod(version, 0755); err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		name    string
+		content []byte
+		perm    os.FileMode
+	}{
+		{name: keyPairKeyName, content: key, perm: 0600},
+		{name: keyPairCertName, content: cert, perm: 0644},
+	} {
+		path := filepath.Join(version, file.name)
+		if err := os.WriteFile(path, file.content, file.perm); err != nil {
+			return err
+		}
+		// WriteFile is subject to the umask
+		if err := os.Chmod(path, file.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkInto points path at a file of the current version, unless it already does.
+// A regular file left by a previous release is replaced by the link
+func linkInto(path, currentLink, name string) error {
+	target, err := filepath.Rel(filepath.Dir(path), filepath.Join(currentLink, name))
+	if err != nil {
+		return err
+	}
+	if existing, err := os.Readlink(path); err == nil && existing == target {
+		return nil
+	}
+	return replaceSymlink(target, path)
+}
+
+// replaceSymlink atomically points path at target
+func replaceSymlink(target, path string) error {
+	tmpPath := fmt.Sprintf("%v.%d.tmp", path, time.Now().UnixNano())
+	if err := os.Symlink(target, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// removeVersions removes the versions of a pair but the current and the previous one
+func removeVersions(dir, versionPrefix string, keep ...string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	kept := map[string]bool{}
+	for _, name := range keep {
+		kept[name] = true
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), versionPrefix) && !kept[entry.Name()] {
+			if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readKeyPair reads a pair stored by writeKeyPair, reading it again when it has been swapped in between
+func readKeyPair(certPath, keyPath string) ([]byte, []byte, error) {
+	var matchErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		certPEM, err := os.ReadFile(certPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, matchErr = tls.X509KeyPair(certPEM, keyPEM); matchErr == nil {
+			return certPEM, keyPEM, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("certificate %v does not match key %v: %v", certPath, keyPath, matchErr)
+}
+
+// writeCertificate atomically stores a world readable certificate
+func writeCertificate(certPath string, cert []byte) error {
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return err
+	}
+	tmpCertPath, err := writeTempFile(certPath, cert, 0644)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpCertPath, certPath); err != nil {
+		os.Remove(tmpCertPath)
+		return err
+	}
+	return nil
+}
+
+// writeTempFile writes the content next to path and returns the temporary file name
+func writeTempFile(path string, content []byte, perm os.FileMode) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// parseCertificates decodes every certificate of a PEM bundle, keeping their order
+func parseCertificates(bundlePEM []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundlePEM = pem.Decode(bundlePEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certificates = append(certificates, cert)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificate found in PEM bundle")
+	}
+	return certificates, nil
+}
+
+// readLeaf returns the first certificate stored at path
+func readLeaf(path string) (*x509.Certificate, error) {
+	chainPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	return chain[0], nil
+}
+
+func checkDepositTarget(target string) error {
+	switch target {
+	case "", DepositTargetFilesystem:
+		return nil
+	}
+	return fmt.Errorf("unsupported deposit target %q", target)
+}
+
+func (p DepositParams) getBasePath(defaultBasePath string) string {
+	if p.BasePath == "" {
+		return defaultBasePath
+	}
+	return p.BasePath
+}
+
+func (p DepositParams) getContext() context.Context {
+	if p.Context == nil {
+		return context.Background()
+	}
+	return p.Context
+}
+
+func getExtKeyUsage(usage Usage) ([]x509.ExtKeyUsage, error) {
+	switch usage {
+	case "", UsageServer:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, nil
+	case UsageClient:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil
+	}
+	return nil, fmt.Errorf("unsupported certificate usage %q", usage)
+}
+
+// checkLeafUsage checks that the leaf of a stored chain has been issued for the common name and the usage of a request,
+// so a client certificate is never handed out for a server one
+func checkLeafUsage(chainPEM []byte, commonName string, usage Usage) error {
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return err
+	}
+	leaf := chain[0]
+	if leaf.Subject.CommonName != commonName {
+		return fmt.Errorf("certificate has been issued for %q instead of %q", leaf.Subject.CommonName, commonName)
+	}
+	extKeyUsage, err := getExtKeyUsage(usage)
+	if err != nil {
+		return err
+	}
+	for _, leafUsage := range leaf.ExtKeyUsage {
+		if leafUsage == extKeyUsage[0] || leafUsage == x509.ExtKeyUsageAny {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate can not be used as a %v certificate", usage)
+}
+
+// pairPaths returns the paths of the server or of the client key pair
+func (l Location) pairPaths(usage Usage) (string, string) {
+	if usage == UsageClient {
+		return l.ClientCertPath, l.ClientKeyPath
+	}
+	return l.CertPath, l.KeyPath
+}
+
+// mergeNames concatenates the names, dropping empty and duplicated ones
+func mergeNames(names ...[]string) []string {
+	var merged []string
+	seen := map[string]bool{}
+	for _, list := range names {
+		for _, name := range list {
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			merged = append(merged, name)
+		}
+	}
+	return merged
+}
+
+// coversNames checks that the leaf of the PEM chain is valid for every DNS name and IP address
+func coversNames(chainPEM []byte, dnsNames []string, ipAddresses []string) error {
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return err
+	}
+	for _, name := range mergeNames(dnsNames, ipAddresses) {
+		if err := chain[0].VerifyHostname(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newRequestResponse(certPEM, keyPEM, caPEM []byte) (RequestResponse, error) {
+	chain, err := parseCertificates(certPEM)
+	if err != nil {
+		return RequestResponse{}, err
+	}
+	return RequestResponse{
+		Certificate: certPEM,
+		Key:         keyPEM,
+		CA:          caPEM,
+		NotAfter:    chain[0].NotAfter,
+	}, nil
+}
@@ -19,6 +19,8 @@ const (
 	PasswordLength = 64
 
 	ClusterSecretsBackupEncryptionKey = "backupEncryptionKey"
+	// ClusterSecretsBackupEncryptionKeyHistory holds the retired keys as a JSON list of {key, retiredAt}
+	ClusterSecretsBackupEncryptionKeyHistory = "backupEncryptionKeyHistory"
 
 	ImageRepository          = "borealis"
 	BackupSystemImageName    = "chrislusf/seaweedfs"
@@ -49,8 +51,27 @@ const (
 	PostgresClusterSecretUsernameKey = "user"
 )
 
+// BuiltInUsernames are the roles created by Borealis in every cluster
+var BuiltInUsernames = []string{
+	AdminUsername,
+	ReplicationUsername,
+	MonitoringUsername,
+	BackupUsername,
+	Migrator,
+	Application,
+	Developer,
+	Analyst,
+}
+
+// Labels set on the Postgres pods by the operator
+const (
+	ClusterNameLabel = "cluster-name"
+	SpiloRoleLabel   = "spilo-role"
+)
+
 const (
 	RootCaCertName = "root.crt"
 	ServerCertName = "tls.crt"
 	ServerKeyName  = "tls.key"
+	RootCrlName    = "root.crl"
 )
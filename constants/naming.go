@@ -43,6 +43,11 @@ func GetTLSSecretName(clusterName string) string {
 	return fmt.Sprintf("%v-tls", clusterName)
 }
 
+// GetClientTLSSecretName returns the secret holding the client certificate of a Postgres role
+func GetClientTLSSecretName(username string, clusterName string) string {
+	return fmt.Sprintf("%v-%v-client-tls", clusterName, username)
+}
+
 func GetDefaultBackupEndpoint(namespace string) string {
 	return fmt.Sprintf("http://%v.%v.svc.cluster.local:%v", BackupHost, namespace, BackupSystemPort)
 }
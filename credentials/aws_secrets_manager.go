@@ -0,0 +1,116 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	AWSSecretsManagerProvider = "aws-secrets-manager"
+
+	defaultAWSSecretsManagerPrefix = "borealis/"
+)
+
+// awsPermissionDeniedCodes are the error codes of the AWS API for denied or invalid credentials
+var awsPermissionDeniedCodes = map[string]bool{
+	"AccessDeniedException":       true,
+	"UnrecognizedClientException": true,
+	"ExpiredTokenException":       true,
+}
+
+// AWSSecretsManager reads the cluster secrets from AWS Secrets Manager, named <prefix>[<namespace>/]<kubernetes secret name>.
+// Each secret holds the keys of its Kubernetes counterpart as a JSON object.
+// The credentials come from the default AWS credential chain: environment, shared config, web identity, then instance role
+type AWSSecretsManager struct {
+	// Region defaults to the one of the default AWS configuration
+	Region string
+	// Endpoint overrides https://secretsmanager.<region>.amazonaws.com, e.g. for moto
+	Endpoint string
+	// Prefix defaults to borealis/
+	Prefix string
+
+	client *secretsmanager.Client
+}
+
+func (a *AWSSecretsManager) Init() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloudSecretManagerTimeout)
+	defer cancel()
+
+	var loadOptions []func(*config.LoadOptions) error
+	if a.Region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(a.Region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return newError(ErrProviderUnavailable, err, "could not load aws configuration")
+	}
+	if cfg.Region == "" {
+		return newError(ErrProviderUnavailable, nil, "aws region is not configured")
+	}
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return newError(ErrProviderUnavailable, err, "could not retrieve aws credentials")
+	}
+
+	a.client = secretsmanager.NewFromConfig(cfg, func(options *secretsmanager.Options) {
+		if a.Endpoint != "" {
+			options.EndpointResolver = secretsmanager.EndpointResolverFromURL(a.Endpoint)
+		}
+	})
+	return nil
+}
+
+func (a *AWSSecretsManager) GetPostgresCredentials(ctx context.Context, clusterName string, username string, options Options) (GetPostgresCredentialsResponse, error) {
+	return a.manager().GetPostgresCredentials(ctx, clusterName, username, options)
+}
+
+func (a *AWSSecretsManager) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
+	return a.manager().GetClusterEndpoint(ctx, clusterName, role)
+}
+
+func (a *AWSSecretsManager) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
+	return a.manager().GetPostgresSSLRootCert(ctx, clusterName, options)
+}
+
+func (a *AWSSecretsManager) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	return a.manager().GetPostgresClientCertificate(ctx, clusterName, username, options)
+}
+
+func (a *AWSSecretsManager) GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error) {
+	return a.manager().GetClusterCredentials(ctx, clusterName, args)
+}
+
+func (a *AWSSecretsManager) manager() secretManager {
+	prefix := a.Prefix
+	if prefix == "" {
+		prefix = defaultAWSSecretsManagerPrefix
+	}
+	return secretManager{reader: a, prefix: prefix, separator: "/"}
+}
+
+func (a *AWSSecretsManager) readSecret(ctx context.Context, name string, notFound error) ([]byte, error) {
+	if a.client == nil {
+		return nil, newError(ErrProviderUnavailable, nil, "aws secrets manager is not initialized")
+	}
+	output, err := a.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		var resourceNotFound *types.ResourceNotFoundException
+		if errors.As(err, &resourceNotFound) {
+			return nil, newError(notFound, err, "secret %v not found in aws secrets manager", name)
+		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && awsPermissionDeniedCodes[apiErr.ErrorCode()] {
+			return nil, newError(ErrPermissionDenied, err, "could not GetSecretValue %v", name)
+		}
+		return nil, newError(ErrProviderUnavailable, err, "could not GetSecretValue %v", name)
+	}
+	if output.SecretString != nil {
+		return []byte(*output.SecretString), nil
+	}
+	return output.SecretBinary, nil
+}
@@ -0,0 +1,242 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheTTL         = time.Minute
+	DefaultCacheNegativeTTL = 5 * time.Second
+
+	cacheKeySeparator = "/"
+)
+
+// cacheKey keeps the cluster apart from the namespace of qualified names, so Invalidate matches it whichever
+// name it has been looked up by
+type cacheKey struct {
+	namespace string
+	cluster   string
+	lookup    string
+}
+
+// Cache wraps any Credentials provider, keeping responses for TTL and errors for NegativeTTL.
+// Concurrent lookups of the same key share a single call to the provider, lookups cut short by the context
+// of their caller are not cached and the other callers waiting for them try again.
+// Options.NoCache and Options.MaxAge force a lookup, whose response replaces the cached one
+type Cache struct {
+	Provider    Credentials
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	calls   map[cacheKey]*cacheCall
+	// generation is increased by invalidations so that lookups in flight do not cache stale responses
+	generation uint64
+	now        func() time.Time
+}
+
+type cacheEntry struct {
+	value     interface{}
+	err       error
+	loadedAt  time.Time
+	expiresAt time.Time
+}
+
+type cacheCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+	// cancelled is set when the call failed because of the context of its caller
+	cancelled bool
+}
+
+func (c *Cache) Init() error {
+	return c.Provider.Init()
+}
+
+func (c *Cache) GetPostgresCredentials(
+	ctx context.Context,
+	clusterName string,
+	username string,
+	options Options,
+) (GetPostgresCredentialsResponse, error) {
+	key := newCacheKey(options.QualifiedClusterName(clusterName), "postgres", username, options.Role, options.TTL.String())
+	value, err := c.get(ctx, key, options, func() (interface{}, time.Duration, error) {
+		response, err := c.Provider.GetPostgresCredentials(ctx, clusterName, username, options)
+		// Dynamic credentials must not outlive their lease
+		return response, response.LeaseDuration, err
+	})
+	response, _ := value.(GetPostgresCredentialsResponse)
+	return response, err
+}
+
+func (c *Cache) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
+	value, err := c.get(ctx, newCacheKey(clusterName, "endpoint", role), Options{}, func() (interface{}, time.Duration, error) {
+		response, err := c.Provider.GetClusterEndpoint(ctx, clusterName, role)
+		return response, 0, err
+	})
+	response, _ := value.(GetClusterEndpointResponse)
+	return response, err
+}
+
+func (c *Cache) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
+	value, err := c.get(ctx, newCacheKey(options.QualifiedClusterName(clusterName), "rootcert"), options, func() (interface{}, time.Duration, error) {
+		response, err := c.Provider.GetPostgresSSLRootCert(ctx, clusterName, options)
+		return response, 0, err
+	})
+	response, _ := value.(GetPostgresSSLRootCertResponse)
+	return response, err
+}
+
+func (c *Cache) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	value, err := c.get(ctx, newCacheKey(options.QualifiedClusterName(clusterName), "clientcert", username), options, func() (interface{}, time.Duration, error) {
+		response, err := c.Provider.GetPostgresClientCertificate(ctx, clusterName, username, options)
+		return response, 0, err
+	})
+	response, _ := value.(GetPostgresClientCertificateResponse)
+	return response, err
+}
+
+func (c *Cache) GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error) {
+	value, err := c.get(ctx, newCacheKey(args.QualifiedClusterName(clusterName), "cluster"), args, func() (interface{}, time.Duration, error) {
+		response, err := c.Provider.GetClusterCredentials(ctx, clusterName, args)
+		return response, 0, err
+	})
+	response, _ := value.(GetClusterCredentialsResponse)
+	return response, err
+}
+
+func (c *Cache) LeaseExpiry(leaseID string) (time.Time, bool) {
+	if leases, ok := c.Provider.(Leases); ok {
+		return leases.LeaseExpiry(leaseID)
+	}
+	return time.Time{}, false
+}
+
+func (c *Cache) ReleaseLease(leaseID string) {
+	if leases, ok := c.Provider.(Leases); ok {
+		leases.ReleaseLease(leaseID)
+	}
+}
+
+// Invalidate drops every cached response of a cluster, e.g. after its credentials have been rotated.
+// A bare name matches the cluster in every namespace, a qualified one in its namespace and the bare lookups
+func (c *Cache) Invalidate(clusterName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	target := newCacheKey(clusterName)
+	for key := range c.entries {
+		if key.cluster == target.cluster && (target.namespace == "" || key.namespace == "" || key.namespace == target.namespace) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *Cache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = nil
+}
+
+// get returns the cached value of key or loads it, a positive maxTTL shortens the TTL of the value.
+// load must use ctx, a call which fails once ctx is done is not cached
+func (c *Cache) get(ctx context.Context, key cacheKey, options Options, load func() (interface{}, time.Duration, error)) (interface{}, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && c.isFresh(entry, options) {
+		c.mu.Unlock()
+		return entry.value, entry.err
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		// The call has been cut short by the context of another caller
+		if call.cancelled && ctx.Err() == nil {
+			return c.get(ctx, key, options, load)
+		}
+		return call.value, call.err
+	}
+	call := &cacheCall{}
+	call.wg.Add(1)
+	if c.calls == nil {
+		c.calls = map[cacheKey]*cacheCall{}
+	}
+	c.calls[key] = call
+	generation := c.generation
+	c.mu.Unlock()
+
+	value, maxTTL, err := load()
+	call.value, call.err = value, err
+	call.cancelled = err != nil && isContextError(ctx, err)
+
+	c.mu.Lock()
+	ttl := c.getTTL()
+	if err != nil {
+		ttl = c.getNegativeTTL()
+	} else if maxTTL > 0 && maxTTL < ttl {
+		ttl = maxTTL
+	}
+	if c.entries == nil {
+		c.entries = map[cacheKey]cacheEntry{}
+	}
+	if generation == c.generation && !call.cancelled {
+		now := c.getNow()
+		c.entries[key] = cacheEntry{value: value, err: err, loadedAt: now, expiresAt: now.Add(ttl)}
+	}
+	delete(c.calls, key)
+	c.mu.Unlock()
+	call.wg.Done()
+
+	return value, err
+}
+
+// isContextError tells whether a lookup failed because ctx is done, rather than because of the provider
+func isContextError(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (c *Cache) isFresh(entry cacheEntry, options Options) bool {
+	if options.NoCache {
+		return false
+	}
+	now := c.getNow()
+	if options.MaxAge > 0 && now.Sub(entry.loadedAt) > options.MaxAge {
+		return false
+	}
+	return now.Before(entry.expiresAt)
+}
+
+func newCacheKey(clusterName string, parts ...string) cacheKey {
+	key := cacheKey{cluster: clusterName, lookup: strings.Join(parts, cacheKeySeparator)}
+	if namespace, name, ok := strings.Cut(clusterName, cacheKeySeparator); ok {
+		key.namespace, key.cluster = namespace, name
+	}
+	return key
+}
+
+func (c *Cache) getTTL() time.Duration {
+	if c.TTL <= 0 {
+		return DefaultCacheTTL
+	}
+	return c.TTL
+}
+
+func (c *Cache) getNegativeTTL() time.Duration {
+	if c.NegativeTTL <= 0 {
+		return DefaultCacheNegativeTTL
+	}
+	return c.NegativeTTL
+}
+
+func (c *Cache) getNow() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
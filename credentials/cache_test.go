@@ -0,0 +1,182 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingProvider counts the lookups reaching the provider, failing for unknown clusters
+type countingProvider struct {
+	Environment
+	calls   int32
+	release chan struct{}
+}
+
+func (p *countingProvider) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
+	atomic.AddInt32(&p.calls, 1)
+	if p.release != nil {
+		select {
+		case <-p.release:
+		case <-ctx.Done():
+			return GetClusterEndpointResponse{}, ctx.Err()
+		}
+	}
+	if clusterName != "mycluster" {
+		return GetClusterEndpointResponse{}, fmt.Errorf("no cluster found with name %v", clusterName)
+	}
+	return GetClusterEndpointResponse{Hostname: "mycluster.example.org", Port: "5432"}, nil
+}
+
+func (p *countingProvider) GetPostgresCredentials(ctx context.Context, clusterName string, username string, options Options) (GetPostgresCredentialsResponse, error) {
+	atomic.AddInt32(&p.calls, 1)
+	return GetPostgresCredentialsResponse{Username: username, Password: "secret", LeaseDuration: time.Second}, nil
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	provider := &countingProvider{}
+	cached := &Cache{Provider: provider, TTL: time.Minute, NegativeTTL: 5 * time.Second, now: func() time.Time { return now }}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cached.GetClusterEndpoint(ctx, "mycluster", "master"); err != nil {
+			t.Fatalf("GetClusterEndpoint() error = %v", err)
+		}
+		if _, err := cached.GetClusterEndpoint(ctx, "unknown", "master"); err == nil {
+			t.Fatalf("GetClusterEndpoint() for an unknown cluster should fail")
+		}
+	}
+	if provider.calls != 2 {
+		t.Errorf("provider called %v times, want 2", provider.calls)
+	}
+
+	now = now.Add(10 * time.Second)
+	cached.GetClusterEndpoint(ctx, "mycluster", "master")
+	cached.GetClusterEndpoint(ctx, "unknown", "master")
+	if provider.calls != 3 {
+		t.Errorf("provider called %v times, want only the negative entry to expire", provider.calls)
+	}
+
+	cached.Invalidate("mycluster")
+	cached.GetClusterEndpoint(ctx, "mycluster", "master")
+	if provider.calls != 4 {
+		t.Errorf("provider called %v times, want the invalidated entry to be loaded again", provider.calls)
+	}
+
+	cached.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+	now = now.Add(2 * time.Second)
+	cached.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+	if provider.calls != 6 {
+		t.Errorf("provider called %v times, want credentials to expire with their lease", provider.calls)
+	}
+
+	cached.GetPostgresCredentials(ctx, "mycluster", "application", Options{NoCache: true})
+	if provider.calls != 7 {
+		t.Errorf("provider called %v times, want NoCache to skip the cache", provider.calls)
+	}
+	now = now.Add(500 * time.Millisecond)
+	cached.GetPostgresCredentials(ctx, "mycluster", "application", Options{MaxAge: time.Minute})
+	cached.GetPostgresCredentials(ctx, "mycluster", "application", Options{MaxAge: 100 * time.Millisecond})
+	if provider.calls != 8 {
+		t.Errorf("provider called %v times, want MaxAge to reload older responses only", provider.calls)
+	}
+}
+
+func TestCache_SingleFlight(t *testing.T) {
+	provider := &countingProvider{release: make(chan struct{})}
+	cached := &Cache{Provider: provider}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cached.GetClusterEndpoint(context.Background(), "mycluster", "master"); err != nil {
+				t.Errorf("GetClusterEndpoint() error = %v", err)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&provider.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(provider.release)
+	wg.Wait()
+
+	if provider.calls != 1 {
+		t.Errorf("provider called %v times by concurrent lookups, want 1", provider.calls)
+	}
+}
+
+func TestCache_ContextCancelled(t *testing.T) {
+	provider := &countingProvider{release: make(chan struct{})}
+	cached := &Cache{Provider: provider}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelledErr := make(chan error)
+	go func() {
+		_, err := cached.GetClusterEndpoint(ctx, "mycluster", "master")
+		cancelledErr <- err
+	}()
+	for atomic.LoadInt32(&provider.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiterErr := make(chan error)
+	go func() {
+		_, err := cached.GetClusterEndpoint(context.Background(), "mycluster", "master")
+		waiterErr <- err
+	}()
+	// Let the second lookup wait for the first one
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-cancelledErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("GetClusterEndpoint() error = %v, want %v", err, context.Canceled)
+	}
+	for atomic.LoadInt32(&provider.calls) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(provider.release)
+	if err := <-waiterErr; err != nil {
+		t.Errorf("GetClusterEndpoint() of a waiting caller error = %v, want a retry", err)
+	}
+
+	if _, err := cached.GetClusterEndpoint(context.Background(), "mycluster", "master"); err != nil {
+		t.Errorf("GetClusterEndpoint() error = %v, the cancellation has been cached", err)
+	}
+	if provider.calls != 2 {
+		t.Errorf("provider called %v times, want 2", provider.calls)
+	}
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	ctx := context.Background()
+	provider := &countingProvider{}
+	cached := &Cache{Provider: provider}
+	lookups := []string{"databases/mycluster", "staging/mycluster", "databases/othercluster"}
+	for _, clusterName := range lookups {
+		cached.GetClusterEndpoint(ctx, clusterName, "master")
+	}
+
+	tests := []struct {
+		clusterName string
+		wantCalls   int32
+	}{
+		{clusterName: "databases", wantCalls: 0},
+		{clusterName: "databases/mycluster", wantCalls: 1},
+		{clusterName: "mycluster", wantCalls: 2},
+	}
+	for _, tt := range tests {
+		calls := atomic.LoadInt32(&provider.calls)
+		cached.Invalidate(tt.clusterName)
+		for _, clusterName := range lookups {
+			cached.GetClusterEndpoint(ctx, clusterName, "master")
+		}
+		if got := atomic.LoadInt32(&provider.calls) - calls; got != tt.wantCalls {
+			t.Errorf("Invalidate(%v) reloaded %v lookups, want %v", tt.clusterName, got, tt.wantCalls)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/borealisdb/commons/k8sutil"
+	"github.com/borealisdb/commons/logger"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ChainProvider = "chain"
+
+	// maxChainResolutions bounds the resolutions kept for LastResolution, the oldest one is dropped beyond
+	maxChainResolutions = 1024
+
+	MethodGetPostgresCredentials       = "GetPostgresCredentials"
+	MethodGetClusterEndpoint           = "GetClusterEndpoint"
+	MethodGetPostgresSSLRootCert       = "GetPostgresSSLRootCert"
+	MethodGetPostgresClientCertificate = "GetPostgresClientCertificate"
+	MethodGetClusterCredentials        = "GetClusterCredentials"
+)
+
+// ChainLink is a named provider of a Chain
+type ChainLink struct {
+	Name     string
+	Provider Credentials
+}
+
+// FallThroughFunc decides whether the next provider of the chain is tried after the given one failed
+type FallThroughFunc func(providerName string, err error) bool
+
+// ChainResolution records which provider answered a lookup
+type ChainResolution struct {
+	Method      string
+	ClusterName string
+	// Subject is the username or the role of the lookup, if any
+	Subject string
+	// Caller is Options.Caller of the lookup
+	Caller   string
+	Provider string
+	// Tried lists the providers which failed before, with their error
+	Tried      map[string]error
+	Err        error
+	ResolvedAt time.Time
+}
+
+// Chain tries its providers in order until one answers, e.g. Vault, then Kubernetes secrets, then environment variables.
+// MethodOrder overrides the order of the providers, by name, for a given method
+type Chain struct {
+	Providers   []ChainLink
+	MethodOrder map[string][]string
+	// FallThrough defaults to FallThroughAll
+	FallThrough FallThroughFunc
+	// OnResolution is called after every lookup, for auditing
+	OnResolution func(ChainResolution)
+	Log          *logrus.Entry
+
+	logOnce     sync.Once
+	mu          sync.RWMutex
+	initialized []ChainLink
+	last        map[string]ChainResolution
+}
+
+// FallThroughAll tries the next provider whatever the error
+func FallThroughAll(providerName string, err error) bool {
+	return true
+}
+
+// FallThroughNotFound tries the next provider only when the credentials do not exist in the previous one,
+// so that outages of a provider are not hidden by stale credentials of another
+func FallThroughNotFound(providerName string, err error) bool {
+	if errors.Is(err, ErrClusterNotFound) || errors.Is(err, ErrUserNotFound) {
+		return true
+	}
+	return k8sutil.ResourceNotFound(err) || os.IsNotExist(err)
+}
+
+// Init initializes every provider, skipping those which can not be used in the current environment.
+// It fails only when no provider could be initialized
+func (c *Chain) Init() error {
+	var initialized []ChainLink
+	var errs []string
+	for _, link := range c.Providers {
+		if err := link.Provider.Init(); err != nil {
+			c.getLog().WithError(err).Warnf("skipping credentials provider %v", link.Name)
+			errs = append(errs, fmt.Sprintf("%v: %v", link.Name, err))
+			continue
+		}
+		initialized = append(initialized, link)
+	}
+	if len(initialized) == 0 {
+		return fmt.Errorf("could not initialize any credentials provider: %v", strings.Join(errs, "; "))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.initialized = initialized
+	return nil
+}
+
+func (c *Chain) GetPostgresCredentials(
+	ctx context.Context,
+	clusterName string,
+	username string,
+	options Options,
+) (GetPostgresCredentialsResponse, error) {
+	var response GetPostgresCredentialsResponse
+	err := c.resolve(MethodGetPostgresCredentials, clusterName, username, options.Caller, func(provider Credentials) (err error) {
+		response, err = provider.GetPostgresCredentials(ctx, clusterName, username, options)
+		return err
+	})
+	return response, err
+}
+
+func (c *Chain) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
+	var response GetClusterEndpointResponse
+	err := c.resolve(MethodGetClusterEndpoint, clusterName, role, "", func(provider Credentials) (err error) {
+		response, err = provider.GetClusterEndpoint(ctx, clusterName, role)
+		return err
+	})
+	return response, err
+}
+
+func (c *Chain) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
+	var response GetPostgresSSLRootCertResponse
+	err := c.resolve(MethodGetPostgresSSLRootCert, clusterName, "", options.Caller, func(provider Credentials) (err error) {
+		response, err = provider.GetPostgresSSLRootCert(ctx, clusterName, options)
+		return err
+	})
+	return response, err
+}
+
+func (c *Chain) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	var response GetPostgresClientCertificateResponse
+	err := c.resolve(MethodGetPostgresClientCertificate, clusterName, username, options.Caller, func(provider Credentials) (err error) {
+		response, err = provider.GetPostgresClientCertificate(ctx, clusterName, username, options)
+		return err
+	})
+	return response, err
+}
+
+func (c *Chain) GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error) {
+	var response GetClusterCredentialsResponse
+	err := c.resolve(MethodGetClusterCredentials, clusterName, "", args.Caller, func(provider Credentials) (err error) {
+		response, err = provider.GetClusterCredentials(ctx, clusterName, args)
+		return err
+	})
+	return response, err
+}
+
+// LeaseExpiry asks every provider which holds leases, lease IDs are unique across them
+func (c *Chain) LeaseExpiry(leaseID string) (time.Time, bool) {
+	for _, link := range c.Providers {
+		if leases, ok := link.Provider.(Leases); ok {
+			if expiresAt, ok := leases.LeaseExpiry(leaseID); ok {
+				return expiresAt, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func (c *Chain) ReleaseLease(leaseID string) {
+	for _, link := range c.Providers {
+		if leases, ok := link.Provider.(Leases); ok {
+			leases.ReleaseLease(leaseID)
+		}
+	}
+}
+
+// LastResolution returns the last resolution of a method for a cluster and a username or role,
+// among the most recent ones
+func (c *Chain) LastResolution(method, clusterName, subject string) (ChainResolution, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolution, ok := c.last[resolutionKey(method, clusterName, subject)]
+	return resolution, ok
+}
+
+func (c *Chain) resolve(method, clusterName, subject, caller string, lookup func(provider Credentials) error) error {
+	resolution := ChainResolution{
+		Method:      method,
+		ClusterName: clusterName,
+		Subject:     subject,
+		Caller:      caller,
+		Tried:       map[string]error{},
+	}
+	fallThrough := c.getFallThrough()
+
+	var errs chainErrors
+	var kind error
+	for _, link := range c.getLinks(method) {
+		err := lookup(link.Provider)
+		if err == nil {
+			resolution.Provider = link.Name
+			break
+		}
+		// An unavailable provider may have held the credentials, so it prevails over not found errors
+		if kind != ErrProviderUnavailable {
+			kind = ErrorKind(err)
+		}
+		resolution.Tried[link.Name] = err
+		errs = append(errs, fmt.Errorf("%v: %w", link.Name, err))
+		if !fallThrough(link.Name, err) {
+			break
+		}
+	}
+	if resolution.Provider == "" {
+		if len(errs) == 0 {
+			kind = ErrProviderUnavailable
+			errs = append(errs, errors.New("no credentials provider configured"))
+		}
+		resolution.Err = newError(kind, errs, "could not %v for cluster %v", method, clusterName)
+	}
+	resolution.ResolvedAt = time.Now()
+	c.record(resolution)
+
+	return resolution.Err
+}
+
+func (c *Chain) record(resolution ChainResolution) {
+	c.mu.Lock()
+	if c.last == nil {
+		c.last = map[string]ChainResolution{}
+	}
+	key := resolutionKey(resolution.Method, resolution.ClusterName, resolution.Subject)
+	if _, ok := c.last[key]; !ok && len(c.last) >= maxChainResolutions {
+		c.dropOldestResolution()
+	}
+	c.last[key] = resolution
+	c.mu.Unlock()
+
+	c.getLog().WithFields(logrus.Fields{
+		"method":   resolution.Method,
+		"cluster":  resolution.ClusterName,
+		"subject":  resolution.Subject,
+		"caller":   resolution.Caller,
+		"provider": resolution.Provider,
+	}).Debugf("credentials lookup resolved")
+	if c.OnResolution != nil {
+		c.OnResolution(resolution)
+	}
+}
+
+func (c *Chain) dropOldestResolution() {
+	var oldestKey string
+	var oldest time.Time
+	for key, resolution := range c.last {
+		if oldestKey == "" || resolution.ResolvedAt.Before(oldest) {
+			oldestKey, oldest = key, resolution.ResolvedAt
+		}
+	}
+	delete(c.last, oldestKey)
+}
+
+// getLinks returns the providers to try for a method, only the initialized ones once Init has been called
+func (c *Chain) getLinks(method string) []ChainLink {
+	c.mu.RLock()
+	links := c.initialized
+	c.mu.RUnlock()
+	if links == nil {
+		links = c.Providers
+	}
+
+	order, ok := c.MethodOrder[method]
+	if !ok {
+		return links
+	}
+	var ordered []ChainLink
+	for _, name := range order {
+		for _, link := range links {
+			if link.Name == name {
+				ordered = append(ordered, link)
+			}
+		}
+	}
+	return ordered
+}
+
+// chainErrors are the failures of the providers of a lookup, in order. errors.Is and errors.As match any of them
+type chainErrors []error
+
+func (e chainErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e chainErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e chainErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolutionKey(method, clusterName, subject string) string {
+	return strings.Join([]string{method, clusterName, subject}, "/")
+}
+
+func (c *Chain) getFallThrough() FallThroughFunc {
+	if c.FallThrough == nil {
+		return FallThroughAll
+	}
+	return c.FallThrough
+}
+
+func (c *Chain) getLog() *logrus.Entry {
+	c.logOnce.Do(func() {
+		if c.Log == nil {
+			c.Log = logger.NewDefaultLogger("info", "credentials")
+		}
+	})
+	return c.Log
+}
@@ -0,0 +1,131 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// failingProvider fails every lookup with the same error
+type failingProvider struct {
+	Environment
+	err error
+}
+
+func (p failingProvider) GetPostgresCredentials(ctx context.Context, clusterName string, username string, options Options) (GetPostgresCredentialsResponse, error) {
+	return GetPostgresCredentialsResponse{}, p.err
+}
+
+func TestChain(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials.yaml")
+	writeTestFile(t, path, "clusters: {vmcluster: {users: {application: {password: secret}}}}", 0600)
+
+	tests := []struct {
+		name         string
+		firstErr     error
+		fallThrough  FallThroughFunc
+		wantProvider string
+		wantErr      bool
+	}{
+		{name: "falls through any error by default", firstErr: fmt.Errorf("connection refused"), wantProvider: "file"},
+		{name: "falls through missing credentials", firstErr: newError(ErrUserNotFound, nil, "secret not found"), fallThrough: FallThroughNotFound, wantProvider: "file"},
+		{name: "stops at untyped errors", firstErr: fmt.Errorf("secret not found"), fallThrough: FallThroughNotFound, wantErr: true},
+		{name: "stops at outages", firstErr: fmt.Errorf("connection refused"), fallThrough: FallThroughNotFound, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resolutions []ChainResolution
+			chain := &Chain{
+				Providers: []ChainLink{
+					{Name: "vault", Provider: failingProvider{err: tt.firstErr}},
+					{Name: "file", Provider: &File{Path: path}},
+				},
+				FallThrough:  tt.fallThrough,
+				OnResolution: func(resolution ChainResolution) { resolutions = append(resolutions, resolution) },
+			}
+			if err := chain.Init(); err != nil {
+				t.Fatalf("Init() error = %v", err)
+			}
+
+			response, err := chain.GetPostgresCredentials(context.Background(), "vmcluster", "application", Options{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetPostgresCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && response.Password != "secret" {
+				t.Errorf("GetPostgresCredentials() = %+v", response)
+			}
+			resolution, ok := chain.LastResolution(MethodGetPostgresCredentials, "vmcluster", "application")
+			if !ok || resolution.Provider != tt.wantProvider || resolution.Tried["vault"] == nil {
+				t.Errorf("LastResolution() = %+v", resolution)
+			}
+			if len(resolutions) != 1 {
+				t.Errorf("OnResolution called %v times, want 1", len(resolutions))
+			}
+		})
+	}
+
+	chain := &Chain{
+		Providers:   []ChainLink{{Name: "file", Provider: &File{Path: path}}, {Name: "environment", Provider: Environment{}}},
+		MethodOrder: map[string][]string{MethodGetClusterEndpoint: {"environment"}},
+	}
+	if err := chain.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	chain.GetClusterEndpoint(context.Background(), "vmcluster", "")
+	if resolution, _ := chain.LastResolution(MethodGetClusterEndpoint, "vmcluster", ""); resolution.Provider != "environment" {
+		t.Errorf("GetClusterEndpoint() answered by %v, want environment", resolution.Provider)
+	}
+
+	// Concurrent lookups share the default logger, go test -race catches unsynchronized defaults
+	shared := &Chain{Providers: chain.Providers}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shared.GetClusterEndpoint(context.Background(), "vmcluster", "")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestChain_Errors(t *testing.T) {
+	chain := &Chain{
+		Providers: []ChainLink{
+			{Name: "vault", Provider: failingProvider{err: vaultError(ErrUserNotFound, &vaultResponseError{StatusCode: 503, Path: "database/creds/mycluster-application"}, "could not get credentials")}},
+			{Name: "kubernetes", Provider: failingProvider{err: &AmbiguousClusterError{Name: "mycluster", Namespaces: []string{"a", "b"}}}},
+		},
+	}
+	_, err := chain.GetPostgresCredentials(context.Background(), "mycluster", "application", Options{})
+	if ErrorKind(err) != ErrProviderUnavailable {
+		t.Errorf("ErrorKind() = %v, want %v", ErrorKind(err), ErrProviderUnavailable)
+	}
+	var ambiguous *AmbiguousClusterError
+	if !errors.As(err, &ambiguous) || ambiguous.Name != "mycluster" {
+		t.Errorf("errors.As() does not find the AmbiguousClusterError of %v", err)
+	}
+	var responseErr *vaultResponseError
+	if !errors.As(err, &responseErr) || responseErr.StatusCode != 503 {
+		t.Errorf("errors.As() does not find the Vault cause of %v", err)
+	}
+	if !errors.Is(err, ErrAmbiguousCluster) {
+		t.Errorf("errors.Is(%v, ErrAmbiguousCluster) = false", err)
+	}
+}
+
+func TestChain_LastResolutionBound(t *testing.T) {
+	chain := &Chain{Providers: []ChainLink{{Name: "environment", Provider: Environment{}}}}
+	for i := 0; i <= maxChainResolutions; i++ {
+		chain.GetClusterEndpoint(context.Background(), fmt.Sprintf("cluster%d", i), "")
+	}
+	if len(chain.last) != maxChainResolutions {
+		t.Errorf("%v resolutions kept, want %v", len(chain.last), maxChainResolutions)
+	}
+	if _, ok := chain.LastResolution(MethodGetClusterEndpoint, fmt.Sprintf("cluster%d", maxChainResolutions), ""); !ok {
+		t.Errorf("latest resolution has been dropped")
+	}
+}
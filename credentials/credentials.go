@@ -2,8 +2,16 @@ package credentials
 
 import (
 	"context"
+	"strings"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/k8sutil"
 )
 
+// Credentials provides what is needed to connect to a cluster. Cluster names may be qualified with
+// their namespace as <namespace>/<name>, which is the String() of a k8sutil.NamespacedName.
+// Failures can be classified with ErrorKind, HTTPStatus and GRPCCode
 type Credentials interface {
 	Init() error
 	GetPostgresCredentials(
@@ -14,27 +22,102 @@ type Credentials interface {
 	) (GetPostgresCredentialsResponse, error)
 	GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error)
 	GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error)
+	// GetPostgresClientCertificate returns the mTLS client certificate of a Postgres role, its CN is the role name
+	GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error)
 	GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error)
 }
 
+// Leases is implemented by providers of dynamic credentials, and by the wrappers forwarding to them.
+// Credentials which are not used anymore should be released, so their lease is not renewed forever
+type Leases interface {
+	// LeaseExpiry returns when the lease expires, false once it is not renewed anymore
+	LeaseExpiry(leaseID string) (time.Time, bool)
+	ReleaseLease(leaseID string)
+}
+
 type GetPostgresCredentialsResponse struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// LeaseID and LeaseDuration are set for dynamic credentials, which are dropped once the lease expires
+	LeaseID       string        `json:"leaseId,omitempty"`
+	LeaseDuration time.Duration `json:"leaseDuration,omitempty"`
 }
 
+// GetClusterEndpointResponse holds the address of the requested role, reachable from inside the cluster.
+// Providers which know more about the deployment fill the other addresses
 type GetClusterEndpointResponse struct {
 	Hostname string `json:"hostname"`
 	Port     string `json:"port"`
+	// External is reachable from outside the cluster, through a load balancer or a DNS name
+	External *EndpointAddress `json:"external,omitempty"`
+	// Pooler is the connection pooler in front of the role, when enabled
+	Pooler *EndpointAddress `json:"pooler,omitempty"`
+	// Replicas are the addresses of every ready replica instance, returned for the replica role
+	Replicas []EndpointAddress `json:"replicas,omitempty"`
+	// TLSRequired tells whether the server expects TLS, SSLMode is the libpq sslmode to connect with
+	TLSRequired bool   `json:"tlsRequired,omitempty"`
+	SSLMode     string `json:"sslMode,omitempty"`
+}
+
+type EndpointAddress struct {
+	Hostname string `json:"hostname"`
+	Port     string `json:"port"`
 }
 
 type GetClusterCredentialsResponse struct {
 	AwsAccessKeyId      string `json:"awsAccessKeyId"`
 	AwsSecretAccessKey  string `json:"awsSecretAccessKey"`
 	BackupEncryptionKey string `json:"backupEncryptionKey"`
+	// PreviousBackupEncryptionKeys are the rotated keys older backups are encrypted with, the oldest first
+	PreviousBackupEncryptionKeys []string `json:"previousBackupEncryptionKeys,omitempty"`
 }
 
 type GetPostgresSSLRootCertResponse struct {
 	RootCertBytes []byte `json:"rootCertBytes"`
 }
 
-type Options struct{}
+type GetPostgresClientCertificateResponse struct {
+	Username  string `json:"username"`
+	CertBytes []byte `json:"certBytes"`
+	KeyBytes  []byte `json:"keyBytes"`
+}
+
+// Options of a credentials request, providers ignore the fields which do not apply to them
+type Options struct {
+	// Namespace qualifies the cluster name unless it already is, see QualifiedClusterName
+	Namespace string
+	// Role is the instance the credentials are for, master or replica.
+	// Providers issuing dynamic users return read-only ones for replicas, static credentials are the same for both
+	Role string
+	// Database the credentials are used for, recorded for auditing as Postgres roles are cluster-wide
+	Database string
+	// TTL bounds the validity of dynamic credentials, static credentials do not expire
+	TTL time.Duration
+	// NoCache skips every cache, MaxAge accepts cached responses up to that age only
+	NoCache bool
+	MaxAge  time.Duration
+	// Caller identifies who asked for the credentials, for auditing
+	Caller string
+}
+
+// QualifiedClusterName returns <namespace>/<name> when a namespace is requested and the cluster name has none
+func (o Options) QualifiedClusterName(clusterName string) string {
+	if o.Namespace == "" || strings.Contains(clusterName, "/") {
+		return clusterName
+	}
+	return k8sutil.NamespacedName{Namespace: o.Namespace, Name: clusterName}.String()
+}
+
+// isReplica tells whether read-only credentials are requested
+func (o Options) isReplica() bool {
+	return o.Role == constants.RoleReplica
+}
+
+// ParseClusterName splits a cluster name qualified as <namespace>/<name>, the namespace is empty otherwise
+func ParseClusterName(clusterName string) (k8sutil.NamespacedName, error) {
+	var name k8sutil.NamespacedName
+	if err := name.DecodeWorker(clusterName, ""); err != nil {
+		return k8sutil.NamespacedName{}, err
+	}
+	return name, nil
+}
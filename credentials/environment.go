@@ -13,6 +13,7 @@ const EnvironmentProvider = "environment"
 type Environment struct{}
 
 func (m Environment) GetClusterEndpoint(ctx context.Context, clusterName string, role string) (GetClusterEndpointResponse, error) {
+	clusterName = getEnvironmentClusterName(clusterName)
 	port, ok := os.LookupEnv(fmt.Sprintf("%v_CLUSTER_PORT", clusterName))
 	if !ok {
 		port = constants.PostgresDefaultPort
@@ -33,6 +34,7 @@ func (m Environment) GetPostgresCredentials(
 	username string,
 	options Options,
 ) (GetPostgresCredentialsResponse, error) {
+	clusterName = getEnvironmentClusterName(clusterName)
 	if username == "" {
 		username = os.Getenv(fmt.Sprintf("%v_CLUSTER_USERNAME", clusterName))
 	}
@@ -53,3 +55,51 @@ func (m Environment) GetClusterInfo(ctx context.Context, clusterName string) (bo
 func (m Environment) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
 	return GetPostgresSSLRootCertResponse{}, nil
 }
+
+// GetPostgresClientCertificate reads the certificate and key files pointed by
+// <cluster>_<user>_CLUSTER_SSLCERT and <cluster>_<user>_CLUSTER_SSLKEY
+func (m Environment) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	clusterName = getEnvironmentClusterName(clusterName)
+	if username == "" {
+		username = os.Getenv(fmt.Sprintf("%v_CLUSTER_USERNAME", clusterName))
+	}
+	certPath := os.Getenv(fmt.Sprintf("%v_%v_CLUSTER_SSLCERT", clusterName, username))
+	keyPath := os.Getenv(fmt.Sprintf("%v_%v_CLUSTER_SSLKEY", clusterName, username))
+	if certPath == "" || keyPath == "" {
+		return GetPostgresClientCertificateResponse{}, newError(ErrUserNotFound, nil, "client certificate for user %v is not configured", username)
+	}
+	cert, err := os.ReadFile(certPath)
+	if err != nil {
+		return GetPostgresClientCertificateResponse{}, environmentFileError(err, "could not read client certificate of user %v", username)
+	}
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return GetPostgresClientCertificateResponse{}, environmentFileError(err, "could not read client key of user %v", username)
+	}
+	return GetPostgresClientCertificateResponse{
+		Username:  username,
+		CertBytes: cert,
+		KeyBytes:  key,
+	}, nil
+}
+
+// environmentFileError classifies an error reading a file pointed by a variable
+func environmentFileError(err error, format string, args ...interface{}) error {
+	var kind error
+	switch {
+	case os.IsNotExist(err):
+		kind = ErrUserNotFound
+	case os.IsPermission(err):
+		kind = ErrPermissionDenied
+	}
+	return newError(kind, err, format, args...)
+}
+
+// getEnvironmentClusterName drops the namespace of a qualified cluster name, which variable names can not hold
+func getEnvironmentClusterName(clusterName string) string {
+	name, err := ParseClusterName(clusterName)
+	if err != nil {
+		return clusterName
+	}
+	return name.Name
+}
@@ -0,0 +1,165 @@
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Kinds of credential lookup failures, to be matched with errors.Is
+var (
+	ErrClusterNotFound     = errors.New("cluster not found")
+	ErrAmbiguousCluster    = errors.New("ambiguous cluster name")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrSecretMalformed     = errors.New("secret malformed")
+	ErrProviderUnavailable = errors.New("credentials provider unavailable")
+	ErrPermissionDenied    = errors.New("permission denied")
+)
+
+// Values of google.golang.org/grpc/codes.Code, which this module does not depend on
+const (
+	grpcCodeOK               uint32 = 0
+	grpcCodeUnknown          uint32 = 2
+	grpcCodeInvalidArgument  uint32 = 3
+	grpcCodeNotFound         uint32 = 5
+	grpcCodePermissionDenied uint32 = 7
+	grpcCodeInternal         uint32 = 13
+	grpcCodeUnavailable      uint32 = 14
+)
+
+// Error is a credential lookup failure of a given Kind, wrapping its cause.
+// errors.Is matches both the Kind and the cause
+type Error struct {
+	Kind    error
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%v: %v", e.Message, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// newError returns an Error of the given kind with a formatted message
+func newError(kind error, cause error, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...), Err: cause}
+}
+
+func (e *AmbiguousClusterError) Is(target error) bool {
+	return target == ErrAmbiguousCluster
+}
+
+// ErrorKind returns the kind of a credential lookup failure, nil when it is not one.
+// The kind of the outermost Error prevails over the ones of its causes
+func ErrorKind(err error) error {
+	var lookupErr *Error
+	if errors.As(err, &lookupErr) && lookupErr.Kind != nil {
+		return lookupErr.Kind
+	}
+	for _, kind := range []error{
+		ErrClusterNotFound,
+		ErrAmbiguousCluster,
+		ErrUserNotFound,
+		ErrSecretMalformed,
+		ErrProviderUnavailable,
+		ErrPermissionDenied,
+	} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	return nil
+}
+
+// HTTPStatus maps an error to the HTTP status code an API should answer with
+func HTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	switch ErrorKind(err) {
+	case ErrClusterNotFound, ErrUserNotFound:
+		return http.StatusNotFound
+	case ErrAmbiguousCluster:
+		return http.StatusBadRequest
+	case ErrPermissionDenied:
+		return http.StatusForbidden
+	case ErrProviderUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GRPCCode maps an error to a gRPC status code, to be converted with codes.Code(GRPCCode(err))
+func GRPCCode(err error) uint32 {
+	if err == nil {
+		return grpcCodeOK
+	}
+	switch ErrorKind(err) {
+	case ErrClusterNotFound, ErrUserNotFound:
+		return grpcCodeNotFound
+	case ErrAmbiguousCluster:
+		return grpcCodeInvalidArgument
+	case ErrPermissionDenied:
+		return grpcCodePermissionDenied
+	case ErrProviderUnavailable:
+		return grpcCodeUnavailable
+	case ErrSecretMalformed:
+		return grpcCodeInternal
+	default:
+		return grpcCodeUnknown
+	}
+}
+
+// kubernetesError classifies an error of the Kubernetes API, notFound being the kind of missing objects
+func kubernetesError(notFound error, err error, format string, args ...interface{}) error {
+	var kind error
+	var netErr net.Error
+	switch {
+	case apierrors.IsNotFound(err):
+		kind = notFound
+	case apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err):
+		kind = ErrPermissionDenied
+	case apierrors.IsServiceUnavailable(err) || apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err) ||
+		apierrors.IsTooManyRequests(err) || apierrors.IsInternalError(err) || errors.As(err, &netErr):
+		kind = ErrProviderUnavailable
+	}
+	return newError(kind, err, format, args...)
+}
+
+// vaultError classifies an error of the Vault API, notFound being the kind of missing secrets
+func vaultError(notFound error, err error, format string, args ...interface{}) error {
+	if kind := ErrorKind(err); kind != nil {
+		return newError(kind, err, format, args...)
+	}
+	var kind error
+	var responseErr *vaultResponseError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &responseErr):
+		switch {
+		case responseErr.StatusCode == http.StatusNotFound:
+			kind = notFound
+		case responseErr.StatusCode == http.StatusForbidden || responseErr.StatusCode == http.StatusUnauthorized:
+			kind = ErrPermissionDenied
+		case responseErr.StatusCode == http.StatusTooManyRequests || responseErr.StatusCode >= http.StatusInternalServerError:
+			kind = ErrProviderUnavailable
+		}
+	case errors.As(err, &netErr):
+		kind = ErrProviderUnavailable
+	}
+	return newError(kind, err, format, args...)
+}
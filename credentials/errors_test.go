@@ -0,0 +1,112 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	borealisdbv1 "github.com/borealisdb/commons/borealisdb.io/v1"
+	borealisfake "github.com/borealisdb/commons/generated/clientset/versioned/fake"
+	"github.com/borealisdb/commons/k8sutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestErrorMapping(t *testing.T) {
+	secrets := schema.GroupResource{Resource: "secrets"}
+	tests := []struct {
+		name     string
+		err      error
+		wantKind error
+		wantHTTP int
+		wantGRPC uint32
+	}{
+		{
+			name:     "no error",
+			wantHTTP: http.StatusOK,
+			wantGRPC: grpcCodeOK,
+		},
+		{
+			name:     "wrapped user not found",
+			err:      fmt.Errorf("could not GetCredentials: %w", kubernetesError(ErrUserNotFound, apierrors.NewNotFound(secrets, "s"), "could not get secret s")),
+			wantKind: ErrUserNotFound,
+			wantHTTP: http.StatusNotFound,
+			wantGRPC: grpcCodeNotFound,
+		},
+		{
+			name:     "ambiguous cluster",
+			err:      &AmbiguousClusterError{Name: "mycluster", Namespaces: []string{"a", "b"}},
+			wantKind: ErrAmbiguousCluster,
+			wantHTTP: http.StatusBadRequest,
+			wantGRPC: grpcCodeInvalidArgument,
+		},
+		{
+			name:     "forbidden",
+			err:      kubernetesError(ErrUserNotFound, apierrors.NewForbidden(secrets, "s", errors.New("rbac")), "could not get secret s"),
+			wantKind: ErrPermissionDenied,
+			wantHTTP: http.StatusForbidden,
+			wantGRPC: grpcCodePermissionDenied,
+		},
+		{
+			name:     "api server unavailable",
+			err:      kubernetesError(ErrUserNotFound, apierrors.NewServiceUnavailable("down"), "could not get secret s"),
+			wantKind: ErrProviderUnavailable,
+			wantHTTP: http.StatusServiceUnavailable,
+			wantGRPC: grpcCodeUnavailable,
+		},
+		{
+			name:     "malformed secret",
+			err:      newError(ErrSecretMalformed, nil, "pgPassword not found"),
+			wantKind: ErrSecretMalformed,
+			wantHTTP: http.StatusInternalServerError,
+			wantGRPC: grpcCodeInternal,
+		},
+		{
+			name:     "untyped error",
+			err:      errors.New("boom"),
+			wantHTTP: http.StatusInternalServerError,
+			wantGRPC: grpcCodeUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := ErrorKind(tt.err); kind != tt.wantKind {
+				t.Errorf("ErrorKind() = %v, want %v", kind, tt.wantKind)
+			}
+			if status := HTTPStatus(tt.err); status != tt.wantHTTP {
+				t.Errorf("HTTPStatus() = %v, want %v", status, tt.wantHTTP)
+			}
+			if code := GRPCCode(tt.err); code != tt.wantGRPC {
+				t.Errorf("GRPCCode() = %v, want %v", code, tt.wantGRPC)
+			}
+		})
+	}
+}
+
+func TestKubernetes_Errors(t *testing.T) {
+	borealisClient := borealisfake.NewSimpleClientset(&borealisdbv1.Postgresql{
+		ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "databases"},
+	})
+	provider := &Kubernetes{}
+	provider.SetKubeClient(k8sutil.KubernetesClient{
+		SecretsGetter:     fake.NewSimpleClientset().CoreV1(),
+		PostgresqlsGetter: borealisClient.BorealisdbV1(),
+	})
+	provider.SetAllowedNamespaces("databases")
+	ctx := context.Background()
+
+	if _, err := provider.GetPostgresCredentials(ctx, "unknown", "application", Options{}); !errors.Is(err, ErrClusterNotFound) {
+		t.Errorf("GetPostgresCredentials() of an unknown cluster error = %v, want ErrClusterNotFound", err)
+	}
+	_, err := provider.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+	if !errors.Is(err, ErrUserNotFound) || !apierrors.IsNotFound(errors.Unwrap(err)) {
+		t.Errorf("GetPostgresCredentials() of an unknown user error = %v, want ErrUserNotFound wrapping the API error", err)
+	}
+	if _, err := provider.GetPostgresCredentials(ctx, "other/mycluster", "application", Options{}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("GetPostgresCredentials() in a forbidden namespace error = %v, want ErrPermissionDenied", err)
+	}
+}
@@ -0,0 +1,555 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/logger"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	FileProvider = "file"
+	// FileProviderPathEnv points to the credentials file or directory when File.Path is empty
+	FileProviderPathEnv = "BOREALIS_CREDENTIALS_PATH"
+
+	DefaultFileReloadInterval = 5 * time.Second
+
+	fileEndpointDir = "endpoint"
+	fileUsersDir    = "users"
+	fileSecretsDir  = "secrets"
+	filePasswordKey = "password"
+	fileHostnameKey = "hostname"
+	filePortKey     = "port"
+)
+
+var (
+	fileEndpointKeys = []string{fileHostnameKey, filePortKey}
+	fileBackupKeys   = []string{"awsAccessKeyId", "awsSecretAccessKey", constants.ClusterSecretsBackupEncryptionKey}
+)
+
+// File reads the credentials of VM deployments from a YAML or JSON file:
+//
+//	clusters:
+//	  mycluster:
+//	    endpoints:
+//	      master: {hostname: 10.0.0.1, port: "5432"}
+//	    users:
+//	      application: {password: secret, sslCertFile: application.crt, sslKeyFile: application.key}
+//	    rootCertFile: root.crt
+//	    backup: {awsAccessKeyId: id, awsSecretAccessKey: key, backupEncryptionKey: encryption}
+//
+// or from a directory tree laid out like mounted secrets, one file per value:
+//
+//	<cluster>/endpoint/<role>/{hostname,port}
+//	<cluster>/users/<user>/{password,tls.crt,tls.key}
+//	<cluster>/root.crt
+//	<cluster>/secrets/{awsAccessKeyId,awsSecretAccessKey,backupEncryptionKey}
+//
+// Clusters of the file may be keyed by <namespace>/<name>, which Options.Namespace looks up.
+// Relative paths are resolved from the directory of the credentials file. Files holding secrets
+// must not be accessible by group or others. Changes of the content or the mode are picked up every ReloadInterval,
+// the last credentials which could be loaded are served as long as the files are broken
+type File struct {
+	Path           string
+	ReloadInterval time.Duration
+	Log            *logrus.Entry
+
+	logOnce   sync.Once
+	mu        sync.RWMutex
+	clusters  map[string]FileCluster
+	watched   map[string]watchedFile
+	checkedAt time.Time
+}
+
+// watchedFile is the state of a file the credentials depend on, a change of either field triggers a reload
+type watchedFile struct {
+	ModTime time.Time
+	Mode    os.FileMode
+}
+
+type FileCluster struct {
+	Endpoints    map[string]FileEndpoint `json:"endpoints,omitempty"`
+	Users        map[string]FileUser     `json:"users,omitempty"`
+	RootCert     string                  `json:"rootCert,omitempty"`
+	RootCertFile string                  `json:"rootCertFile,omitempty"`
+	Backup       FileBackup              `json:"backup,omitempty"`
+}
+
+type FileEndpoint struct {
+	Hostname string `json:"hostname"`
+	Port     string `json:"port,omitempty"`
+}
+
+type FileUser struct {
+	Password    string `json:"password,omitempty"`
+	SSLCert     string `json:"sslCert,omitempty"`
+	SSLKey      string `json:"sslKey,omitempty"`
+	SSLCertFile string `json:"sslCertFile,omitempty"`
+	SSLKeyFile  string `json:"sslKeyFile,omitempty"`
+}
+
+type FileBackup struct {
+	AwsAccessKeyId      string `json:"awsAccessKeyId,omitempty"`
+	AwsSecretAccessKey  string `json:"awsSecretAccessKey,omitempty"`
+	BackupEncryptionKey string `json:"backupEncryptionKey,omitempty"`
+}
+
+type fileDocument struct {
+	Clusters map[string]FileCluster `json:"clusters"`
+}
+
+func (f *File) Init() error {
+	if f.Path == "" {
+		f.Path = os.Getenv(FileProviderPathEnv)
+	}
+	if f.Path == "" {
+		return fmt.Errorf("credentials path is not configured")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.load()
+}
+
+func (f *File) GetPostgresCredentials(
+	ctx context.Context,
+	clusterName string,
+	username string,
+	options Options,
+) (GetPostgresCredentialsResponse, error) {
+	if username == "" {
+		username = constants.AdminUsername
+	}
+	cluster, err := f.getCluster(clusterName, options)
+	if err != nil {
+		return GetPostgresCredentialsResponse{}, err
+	}
+	user, ok := cluster.Users[username]
+	if !ok || user.Password == "" {
+		return GetPostgresCredentialsResponse{}, newError(ErrUserNotFound, nil, "password for user %v not found in cluster %v", username, clusterName)
+	}
+
+	return GetPostgresCredentialsResponse{
+		Username: username,
+		Password: user.Password,
+	}, nil
+}
+
+func (f *File) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
+	if role == "" {
+		role = constants.RoleMaster
+	}
+	cluster, err := f.getCluster(clusterName, Options{})
+	if err != nil {
+		return GetClusterEndpointResponse{}, err
+	}
+	endpoint, ok := cluster.Endpoints[role]
+	if !ok {
+		return GetClusterEndpointResponse{}, newError(ErrClusterNotFound, nil, "endpoint %v not found in cluster %v", role, clusterName)
+	}
+	port := endpoint.Port
+	if port == "" {
+		port = constants.PostgresDefaultPort
+	}
+
+	return GetClusterEndpointResponse{
+		Hostname: endpoint.Hostname,
+		Port:     port,
+	}, nil
+}
+
+func (f *File) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
+	cluster, err := f.getCluster(clusterName, options)
+	if err != nil {
+		return GetPostgresSSLRootCertResponse{}, err
+	}
+	if cluster.RootCert == "" {
+		return GetPostgresSSLRootCertResponse{}, newError(ErrClusterNotFound, nil, "root certificate not found in cluster %v", clusterName)
+	}
+
+	return GetPostgresSSLRootCertResponse{
+		RootCertBytes: []byte(cluster.RootCert),
+	}, nil
+}
+
+func (f *File) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	if username == "" {
+		username = constants.AdminUsername
+	}
+	cluster, err := f.getCluster(clusterName, options)
+	if err != nil {
+		return GetPostgresClientCertificateResponse{}, err
+	}
+	user, ok := cluster.Users[username]
+	if !ok || user.SSLCert == "" || user.SSLKey == "" {
+		return GetPostgresClientCertificateResponse{}, newError(ErrUserNotFound, nil, "client certificate for user %v not found in cluster %v", username, clusterName)
+	}
+
+	return GetPostgresClientCertificateResponse{
+		Username:  username,
+		CertBytes: []byte(user.SSLCert),
+		KeyBytes:  []byte(user.SSLKey),
+	}, nil
+}
+
+func (f *File) GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error) {
+	cluster, err := f.getCluster(clusterName, args)
+	if err != nil {
+		return GetClusterCredentialsResponse{}, err
+	}
+
+	return GetClusterCredentialsResponse{
+		AwsAccessKeyId:      cluster.Backup.AwsAccessKeyId,
+		AwsSecretAccessKey:  cluster.Backup.AwsSecretAccessKey,
+		BackupEncryptionKey: cluster.Backup.BackupEncryptionKey,
+	}, nil
+}
+
+// getCluster looks the cluster up by its qualified name when a namespace is requested, NoCache checks the files right away
+func (f *File) getCluster(clusterName string, options Options) (FileCluster, error) {
+	clusterName = options.QualifiedClusterName(clusterName)
+	if err := f.reloadIfChanged(options.NoCache); err != nil {
+		return FileCluster{}, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	cluster, ok := f.clusters[clusterName]
+	if !ok {
+		return FileCluster{}, newError(ErrClusterNotFound, nil, "no cluster found with name %v", clusterName)
+	}
+	return cluster, nil
+}
+
+// reloadIfChanged loads the credentials again when a watched file has been modified, added or removed.
+// The previous credentials are kept when the new ones can not be loaded, the error is only logged
+func (f *File) reloadIfChanged(force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !force && time.Since(f.checkedAt) < f.getReloadInterval() {
+		return nil
+	}
+	f.checkedAt = time.Now()
+
+	changed, err := f.hasChanged()
+	if err == nil && changed {
+		err = f.load()
+	}
+	if err != nil {
+		if f.clusters == nil {
+			return err
+		}
+		f.getLog().WithError(err).Errorf("could not reload credentials from %v, serving the previous ones", f.Path)
+	}
+	return nil
+}
+
+func (f *File) hasChanged() (bool, error) {
+	current, err := f.getWatchedFiles()
+	if err != nil {
+		return false, err
+	}
+	if len(current) != len(f.watched) {
+		return true, nil
+	}
+	for path, file := range current {
+		previous, ok := f.watched[path]
+		if !ok || !previous.ModTime.Equal(file.ModTime) || previous.Mode != file.Mode {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getWatchedFiles returns the state of every file the credentials depend on
+func (f *File) getWatchedFiles() (map[string]watchedFile, error) {
+	watched := map[string]watchedFile{}
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		watched[f.Path] = newWatchedFile(info)
+		// Referenced files are watched as well
+		for path := range f.watched {
+			if info, err := os.Stat(path); err == nil {
+				watched[path] = newWatchedFile(info)
+			}
+		}
+		return watched, nil
+	}
+
+	// Only the files load reads are watched, a change of ..data or of a dot file is picked up through the symlinks to it
+	paths, err := listCredentialsDirFiles(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		watched[path] = newWatchedFile(info)
+	}
+	return watched, nil
+}
+
+func newWatchedFile(info os.FileInfo) watchedFile {
+	return watchedFile{ModTime: info.ModTime(), Mode: info.Mode()}
+}
+
+func (f *File) load() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return fmt.Errorf("could not stat credentials path: %v", err)
+	}
+	watched := map[string]watchedFile{}
+	var clusters map[string]FileCluster
+	if info.IsDir() {
+		clusters, err = loadCredentialsDir(f.Path, watched)
+	} else {
+		clusters, err = loadCredentialsFile(f.Path, watched)
+	}
+	if err != nil {
+		return err
+	}
+
+	f.clusters = clusters
+	f.watched = watched
+	f.checkedAt = time.Now()
+	return nil
+}
+
+func loadCredentialsFile(path string, watched map[string]watchedFile) (map[string]FileCluster, error) {
+	content, err := readCredentialsFile(path, true, watched)
+	if err != nil {
+		return nil, err
+	}
+	var document fileDocument
+	// YAML is a superset of JSON, both are parsed the same way
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("could not parse %v: %v", path, err)
+	}
+
+	baseDir := filepath.Dir(path)
+	for name, cluster := range document.Clusters {
+		if cluster.RootCertFile != "" {
+			rootCert, err := readCredentialsFile(resolvePath(baseDir, cluster.RootCertFile), false, watched)
+			if err != nil {
+				return nil, err
+			}
+			cluster.RootCert = string(rootCert)
+		}
+		for username, user := range cluster.Users {
+			if user.SSLCertFile != "" {
+				cert, err := readCredentialsFile(resolvePath(baseDir, user.SSLCertFile), false, watched)
+				if err != nil {
+					return nil, err
+				}
+				user.SSLCert = string(cert)
+			}
+			if user.SSLKeyFile != "" {
+				key, err := readCredentialsFile(resolvePath(baseDir, user.SSLKeyFile), true, watched)
+				if err != nil {
+					return nil, err
+				}
+				user.SSLKey = string(key)
+			}
+			cluster.Users[username] = user
+		}
+		document.Clusters[name] = cluster
+	}
+	return document.Clusters, nil
+}
+
+func loadCredentialsDir(root string, watched map[string]watchedFile) (map[string]FileCluster, error) {
+	clusterNames, err := listDirs(root)
+	if err != nil {
+		return nil, err
+	}
+	clusters := map[string]FileCluster{}
+	for _, clusterName := range clusterNames {
+		clusterDir := filepath.Join(root, clusterName)
+		cluster := FileCluster{
+			Endpoints: map[string]FileEndpoint{},
+			Users:     map[string]FileUser{},
+		}
+
+		rootCert, err := readOptionalCredentialsFile(filepath.Join(clusterDir, constants.RootCaCertName), false, watched)
+		if err != nil {
+			return nil, err
+		}
+		cluster.RootCert = string(rootCert)
+
+		roles, err := listDirs(filepath.Join(clusterDir, fileEndpointDir))
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range roles {
+			values, err := readCredentialsDir(filepath.Join(clusterDir, fileEndpointDir, role), false, watched, fileEndpointKeys...)
+			if err != nil {
+				return nil, err
+			}
+			cluster.Endpoints[role] = FileEndpoint{Hostname: values[fileHostnameKey], Port: values[filePortKey]}
+		}
+
+		usernames, err := listDirs(filepath.Join(clusterDir, fileUsersDir))
+		if err != nil {
+			return nil, err
+		}
+		for _, username := range usernames {
+			userDir := filepath.Join(clusterDir, fileUsersDir, username)
+			secrets, err := readCredentialsDir(userDir, true, watched, filePasswordKey, constants.ServerKeyName)
+			if err != nil {
+				return nil, err
+			}
+			cert, err := readOptionalCredentialsFile(filepath.Join(userDir, constants.ServerCertName), false, watched)
+			if err != nil {
+				return nil, err
+			}
+			cluster.Users[username] = FileUser{
+				Password: secrets[filePasswordKey],
+				SSLCert:  string(cert),
+				SSLKey:   secrets[constants.ServerKeyName],
+			}
+		}
+
+		backup, err := readCredentialsDir(filepath.Join(clusterDir, fileSecretsDir), true, watched, fileBackupKeys...)
+		if err != nil {
+			return nil, err
+		}
+		cluster.Backup = FileBackup{
+			AwsAccessKeyId:      backup["awsAccessKeyId"],
+			AwsSecretAccessKey:  backup["awsSecretAccessKey"],
+			BackupEncryptionKey: backup[constants.ClusterSecretsBackupEncryptionKey],
+		}
+		clusters[clusterName] = cluster
+	}
+	return clusters, nil
+}
+
+// listCredentialsDirFiles returns every file loadCredentialsDir would read, whether it exists or not
+func listCredentialsDirFiles(root string) ([]string, error) {
+	clusterNames, err := listDirs(root)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, clusterName := range clusterNames {
+		clusterDir := filepath.Join(root, clusterName)
+		paths = append(paths, filepath.Join(clusterDir, constants.RootCaCertName))
+
+		roles, err := listDirs(filepath.Join(clusterDir, fileEndpointDir))
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range roles {
+			for _, key := range fileEndpointKeys {
+				paths = append(paths, filepath.Join(clusterDir, fileEndpointDir, role, key))
+			}
+		}
+
+		usernames, err := listDirs(filepath.Join(clusterDir, fileUsersDir))
+		if err != nil {
+			return nil, err
+		}
+		for _, username := range usernames {
+			for _, key := range []string{filePasswordKey, constants.ServerKeyName, constants.ServerCertName} {
+				paths = append(paths, filepath.Join(clusterDir, fileUsersDir, username, key))
+			}
+		}
+
+		for _, key := range fileBackupKeys {
+			paths = append(paths, filepath.Join(clusterDir, fileSecretsDir, key))
+		}
+	}
+	return paths, nil
+}
+
+// readCredentialsDir reads the given keys of a directory, missing ones are left empty
+func readCredentialsDir(dir string, secret bool, watched map[string]watchedFile, keys ...string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, key := range keys {
+		content, err := readOptionalCredentialsFile(filepath.Join(dir, key), secret, watched)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = strings.TrimSpace(string(content))
+	}
+	return values, nil
+}
+
+func readOptionalCredentialsFile(path string, secret bool, watched map[string]watchedFile) ([]byte, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return readCredentialsFile(path, secret, watched)
+}
+
+// readCredentialsFile reads a file, refusing secrets which are accessible by group or others
+func readCredentialsFile(path string, secret bool, watched map[string]watchedFile) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%v is accessible by group or others, its mode must be 0600 instead of %#o", path, info.Mode().Perm())
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	watched[path] = newWatchedFile(info)
+	return content, nil
+}
+
+func listDirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+func resolvePath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+func (f *File) getLog() *logrus.Entry {
+	f.logOnce.Do(func() {
+		if f.Log == nil {
+			f.Log = logger.NewDefaultLogger("info", "credentials")
+		}
+	})
+	return f.Log
+}
+
+func (f *File) getReloadInterval() time.Duration {
+	if f.ReloadInterval <= 0 {
+		return DefaultFileReloadInterval
+	}
+	return f.ReloadInterval
+}
@@ -0,0 +1,152 @@
+package credentials
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+	yamlDir := t.TempDir()
+	yamlPath := filepath.Join(yamlDir, "credentials.yaml")
+	writeTestFile(t, filepath.Join(yamlDir, "root.crt"), "root", 0644)
+	writeTestFile(t, filepath.Join(yamlDir, "application.key"), "key", 0600)
+	writeTestFile(t, yamlPath, `
+clusters:
+  mycluster:
+    endpoints:
+      master: {hostname: 10.0.0.1}
+    users:
+      application: {password: secret, sslCert: cert, sslKeyFile: application.key}
+    rootCertFile: root.crt
+    backup: {awsAccessKeyId: id, backupEncryptionKey: encryption}
+`, 0600)
+
+	treeDir := t.TempDir()
+	writeTestFile(t, filepath.Join(treeDir, "mycluster", "endpoint", "master", "hostname"), "10.0.0.1\n", 0644)
+	writeTestFile(t, filepath.Join(treeDir, "mycluster", "users", "application", "password"), "secret\n", 0600)
+	writeTestFile(t, filepath.Join(treeDir, "mycluster", "users", "application", "tls.crt"), "cert", 0644)
+	writeTestFile(t, filepath.Join(treeDir, "mycluster", "users", "application", "tls.key"), "key", 0600)
+	writeTestFile(t, filepath.Join(treeDir, "mycluster", "root.crt"), "root", 0644)
+	writeTestFile(t, filepath.Join(treeDir, "mycluster", "secrets", "awsAccessKeyId"), "id", 0600)
+	writeTestFile(t, filepath.Join(treeDir, "mycluster", "secrets", "backupEncryptionKey"), "encryption", 0600)
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "yaml file", path: yamlPath},
+		{name: "directory tree", path: treeDir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &File{Path: tt.path}
+			if err := provider.Init(); err != nil {
+				t.Fatalf("Init() error = %v", err)
+			}
+
+			postgresCredentials, err := provider.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+			if err != nil || postgresCredentials.Password != "secret" {
+				t.Errorf("GetPostgresCredentials() = %+v, %v", postgresCredentials, err)
+			}
+			if _, err := provider.GetPostgresCredentials(ctx, "unknown", "application", Options{}); err == nil {
+				t.Errorf("GetPostgresCredentials() for an unknown cluster should fail")
+			}
+			endpoint, err := provider.GetClusterEndpoint(ctx, "mycluster", "")
+			if err != nil || endpoint.Hostname != "10.0.0.1" || endpoint.Port != "5432" {
+				t.Errorf("GetClusterEndpoint() = %+v, %v", endpoint, err)
+			}
+			rootCert, err := provider.GetPostgresSSLRootCert(ctx, "mycluster", Options{})
+			if err != nil || string(rootCert.RootCertBytes) != "root" {
+				t.Errorf("GetPostgresSSLRootCert() = %+v, %v", rootCert, err)
+			}
+			clientCert, err := provider.GetPostgresClientCertificate(ctx, "mycluster", "application", Options{})
+			if err != nil || string(clientCert.CertBytes) != "cert" || string(clientCert.KeyBytes) != "key" {
+				t.Errorf("GetPostgresClientCertificate() = %+v, %v", clientCert, err)
+			}
+			clusterCredentials, err := provider.GetClusterCredentials(ctx, "mycluster", Options{})
+			if err != nil || clusterCredentials.AwsAccessKeyId != "id" || clusterCredentials.BackupEncryptionKey != "encryption" {
+				t.Errorf("GetClusterCredentials() = %+v, %v", clusterCredentials, err)
+			}
+		})
+	}
+}
+
+func TestFile_Reload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	passwordPath := filepath.Join(dir, "mycluster", "users", "application", "password")
+	writeTestFile(t, passwordPath, "secret", 0600)
+
+	provider := &File{Path: dir, ReloadInterval: time.Nanosecond}
+	if err := provider.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	writeTestFile(t, passwordPath, "rotated", 0600)
+	// Filesystems with a coarse timestamp resolution would not notice the change otherwise
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(passwordPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	postgresCredentials, err := provider.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+	if err != nil || postgresCredentials.Password != "rotated" {
+		t.Errorf("GetPostgresCredentials() after a change = %+v, %v", postgresCredentials, err)
+	}
+
+	// A change of mode alone triggers a reload, which refuses a password readable by others
+	// and keeps serving the previous credentials
+	if err := os.Chmod(passwordPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := provider.hasChanged(); err != nil || !changed {
+		t.Errorf("hasChanged() after a chmod = %v, %v", changed, err)
+	}
+	postgresCredentials, err = provider.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+	if err != nil || postgresCredentials.Password != "rotated" {
+		t.Errorf("GetPostgresCredentials() after a failed reload = %+v, %v", postgresCredentials, err)
+	}
+
+	if err := os.Chmod(passwordPath, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.reloadIfChanged(true); err != nil {
+		t.Fatalf("reloadIfChanged() error = %v", err)
+	}
+
+	// Files which are not loaded, such as the ..data directory of mounted secrets, are not watched
+	writeTestFile(t, filepath.Join(dir, "..data", "mycluster", "unrelated"), "ignored", 0600)
+	writeTestFile(t, filepath.Join(dir, "mycluster", "users", "application", "unrelated"), "ignored", 0600)
+	if changed, err := provider.hasChanged(); err != nil || changed {
+		t.Errorf("hasChanged() after a change of an unrelated file = %v, %v", changed, err)
+	}
+	// A missing optional file being added is a change
+	writeTestFile(t, filepath.Join(dir, "mycluster", "users", "application", "tls.crt"), "certificate", 0644)
+	if changed, err := provider.hasChanged(); err != nil || !changed {
+		t.Errorf("hasChanged() after a certificate has been added = %v, %v", changed, err)
+	}
+
+	if err := os.Remove(passwordPath); err != nil {
+		t.Fatal(err)
+	}
+	postgresCredentials, err = provider.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+	if err == nil {
+		t.Errorf("GetPostgresCredentials() of a removed password = %+v", postgresCredentials)
+	}
+}
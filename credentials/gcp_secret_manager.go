@@ -0,0 +1,108 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"google.golang.org/api/option"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	GCPSecretManagerProvider = "gcp-secret-manager"
+
+	defaultGCPSecretManagerPrefix = "borealis-"
+)
+
+// GCPSecretManager reads the latest version of the cluster secrets from GCP Secret Manager,
+// named <prefix>[<namespace>_]<kubernetes secret name> since secret ids can not contain slashes.
+// Each secret holds the keys of its Kubernetes counterpart as a JSON object.
+// The credentials are the Application Default Credentials: GOOGLE_APPLICATION_CREDENTIALS, workload identity, then the instance service account
+type GCPSecretManager struct {
+	// Project defaults to GOOGLE_CLOUD_PROJECT
+	Project string
+	// ClientOptions are passed to the client, e.g. option.WithEndpoint for an emulator
+	ClientOptions []option.ClientOption
+	// Prefix defaults to borealis-
+	Prefix string
+
+	client *secretmanager.Client
+}
+
+func (g *GCPSecretManager) Init() error {
+	if g.Project == "" {
+		g.Project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if g.Project == "" {
+		return newError(ErrProviderUnavailable, nil, "gcp project is not configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloudSecretManagerTimeout)
+	defer cancel()
+	client, err := secretmanager.NewClient(ctx, g.ClientOptions...)
+	if err != nil {
+		return newError(ErrProviderUnavailable, err, "could not create gcp secret manager client")
+	}
+	g.client = client
+	return nil
+}
+
+func (g *GCPSecretManager) GetPostgresCredentials(ctx context.Context, clusterName string, username string, options Options) (GetPostgresCredentialsResponse, error) {
+	return g.manager().GetPostgresCredentials(ctx, clusterName, username, options)
+}
+
+func (g *GCPSecretManager) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
+	return g.manager().GetClusterEndpoint(ctx, clusterName, role)
+}
+
+func (g *GCPSecretManager) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
+	return g.manager().GetPostgresSSLRootCert(ctx, clusterName, options)
+}
+
+func (g *GCPSecretManager) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	return g.manager().GetPostgresClientCertificate(ctx, clusterName, username, options)
+}
+
+func (g *GCPSecretManager) GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error) {
+	return g.manager().GetClusterCredentials(ctx, clusterName, args)
+}
+
+// Close closes the connection of the client
+func (g *GCPSecretManager) Close() error {
+	if g.client == nil {
+		return nil
+	}
+	return g.client.Close()
+}
+
+func (g *GCPSecretManager) manager() secretManager {
+	prefix := g.Prefix
+	if prefix == "" {
+		prefix = defaultGCPSecretManagerPrefix
+	}
+	return secretManager{reader: g, prefix: prefix, separator: "_"}
+}
+
+func (g *GCPSecretManager) readSecret(ctx context.Context, name string, notFound error) ([]byte, error) {
+	if g.client == nil {
+		return nil, newError(ErrProviderUnavailable, nil, "gcp secret manager is not initialized")
+	}
+	response, err := g.client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: fmt.Sprintf("projects/%v/secrets/%v/versions/latest", g.Project, name),
+	})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.NotFound:
+			return nil, newError(notFound, err, "secret %v not found in gcp secret manager", name)
+		case codes.PermissionDenied, codes.Unauthenticated:
+			return nil, newError(ErrPermissionDenied, err, "could not AccessSecretVersion %v", name)
+		default:
+			return nil, newError(ErrProviderUnavailable, err, "could not AccessSecretVersion %v", name)
+		}
+	}
+	return response.GetPayload().GetData(), nil
+}
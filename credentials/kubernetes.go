@@ -2,23 +2,64 @@ package credentials
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	borealisdbv1 "github.com/borealisdb/commons/borealisdb.io/v1"
 	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/generated/clientset/versioned"
+	"github.com/borealisdb/commons/generated/informers/externalversions"
 	"github.com/borealisdb/commons/k8sutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
-const KubernetesProvider = "kubernetes"
+const (
+	KubernetesProvider = "kubernetes"
+
+	DefaultInformerResync = 10 * time.Minute
+
+	clusterNameIndex = "clusterName"
+)
 
 type Kubernetes struct {
-	kubeClient k8sutil.KubernetesClient
+	kubeClient     k8sutil.KubernetesClient
+	borealisClient versioned.Interface
+
+	// allowedNamespaces scopes the lookups, all namespaces are visible when empty
+	allowedNamespaces []string
+
+	// clusterIndexers and the listers are set by StartInformers, lookups hit the API server otherwise.
+	// There is one of each per allowed namespace, the listers being keyed by namespace or v1.NamespaceAll
+	clusterIndexers []cache.Indexer
+	secretListers   map[string]corev1listers.SecretLister
+	serviceListers  map[string]corev1listers.ServiceLister
+	podListers      map[string]corev1listers.PodLister
+}
+
+// AmbiguousClusterError is returned when a cluster name without namespace matches clusters in several namespaces
+type AmbiguousClusterError struct {
+	Name       string
+	Namespaces []string
+}
+
+func (e *AmbiguousClusterError) Error() string {
+	return fmt.Sprintf("cluster name %v is ambiguous, it exists in namespaces %v: use <namespace>/%v",
+		e.Name, strings.Join(e.Namespaces, ", "), e.Name)
 }
 
 func (k *Kubernetes) Init() error {
 	kubeClient, err := k8sutil.InitializeKubeClient()
 	if err != nil {
-		return err
+		return newError(ErrProviderUnavailable, err, "could not InitializeKubeClient")
 	}
 
 	k.kubeClient = kubeClient
@@ -29,13 +70,120 @@ func (k *Kubernetes) SetKubeClient(client k8sutil.KubernetesClient) {
 	k.kubeClient = client
 }
 
+// SetAllowedNamespaces restricts the lookups to the namespaces the caller is allowed to see
+func (k *Kubernetes) SetAllowedNamespaces(namespaces ...string) {
+	k.allowedNamespaces = namespaces
+}
+
+// SetBorealisClient overrides the clientset the Postgresql informer is built from, which defaults to the one of the kube client
+func (k *Kubernetes) SetBorealisClient(client versioned.Interface) {
+	k.borealisClient = client
+}
+
+// StartInformers watches Postgresqls, secrets, Services and replica pods and serves lookups from the informer caches.
+// Services and pods are not watched when they can not be listed, GetClusterEndpoint only returns DNS names then.
+// There is one informer per allowed namespace, or a single one watching all namespaces when every namespace is allowed.
+// Only the secrets labelled with the cluster name by the operator are watched.
+// It returns once the caches are synced, the informers stop with stopCh
+func (k *Kubernetes) StartInformers(stopCh <-chan struct{}, resync time.Duration) error {
+	if resync <= 0 {
+		resync = DefaultInformerResync
+	}
+	borealisClient := k.borealisClient
+	if borealisClient == nil && k.kubeClient.BorealisdbV1ClientSet != nil {
+		borealisClient = k.kubeClient.BorealisdbV1ClientSet
+	}
+	if borealisClient == nil || k.kubeClient.SecretsGetter == nil {
+		return newError(ErrProviderUnavailable, nil, "kubernetes client is not configured")
+	}
+
+	namespaces := k.allowedNamespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{v1.NamespaceAll}
+	}
+	var hasSynced []cache.InformerSynced
+	var clusterIndexers []cache.Indexer
+	secretListers := map[string]corev1listers.SecretLister{}
+	serviceListers := map[string]corev1listers.ServiceLister{}
+	podListers := map[string]corev1listers.PodLister{}
+	for _, namespace := range namespaces {
+		factory := externalversions.NewSharedInformerFactoryWithOptions(borealisClient, resync, externalversions.WithNamespace(namespace))
+		clusterInformer := factory.Borealisdb().V1().Postgresqls().Informer()
+		// Clusters are looked up by name, the namespace being optional
+		err := clusterInformer.AddIndexers(cache.Indexers{clusterNameIndex: func(obj interface{}) ([]string, error) {
+			cluster, ok := obj.(*borealisdbv1.Postgresql)
+			if !ok {
+				return nil, nil
+			}
+			return []string{cluster.Name}, nil
+		}})
+		if err != nil {
+			return fmt.Errorf("could not add cluster name index: %v", err)
+		}
+		// Only the secrets the operator labels with the cluster name are watched
+		secrets := k.kubeClient.Secrets(namespace)
+		secretInformer := newLabelledInformer(&v1.Secret{}, constants.ClusterNameLabel, resync,
+			func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return secrets.List(ctx, options)
+			},
+			secrets.Watch)
+		serviceInformer, podInformer := k.newEndpointInformers(namespace, resync)
+
+		factory.Start(stopCh)
+		clusterIndexers = append(clusterIndexers, clusterInformer.GetIndexer())
+		hasSynced = append(hasSynced, clusterInformer.HasSynced)
+		for _, informer := range []cache.SharedIndexInformer{secretInformer, serviceInformer, podInformer} {
+			if informer != nil {
+				go informer.Run(stopCh)
+				hasSynced = append(hasSynced, informer.HasSynced)
+			}
+		}
+		secretListers[namespace] = corev1listers.NewSecretLister(secretInformer.GetIndexer())
+		if serviceInformer != nil {
+			serviceListers[namespace] = corev1listers.NewServiceLister(serviceInformer.GetIndexer())
+		}
+		if podInformer != nil {
+			podListers[namespace] = corev1listers.NewPodLister(podInformer.GetIndexer())
+		}
+	}
+	if !cache.WaitForCacheSync(stopCh, hasSynced...) {
+		return fmt.Errorf("could not sync informer caches")
+	}
+
+	k.clusterIndexers = clusterIndexers
+	k.secretListers = secretListers
+	k.serviceListers = serviceListers
+	k.podListers = podListers
+	return nil
+}
+
+// newLabelledInformer watches the objects of a namespace matching labelSelector, every object when it is empty
+func newLabelledInformer(
+	objType runtime.Object,
+	labelSelector string,
+	resync time.Duration,
+	list func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error),
+	watchObjects func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error),
+) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = labelSelector
+			return list(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = labelSelector
+			return watchObjects(context.TODO(), options)
+		},
+	}, objType, resync, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
 func (k *Kubernetes) GetPostgresCredentials(
 	ctx context.Context,
 	clusterName string,
 	username string,
 	options Options,
 ) (GetPostgresCredentialsResponse, error) {
-	info, err := k.getClusterInfo(ctx, clusterName)
+	info, err := k.getClusterInfo(ctx, options.QualifiedClusterName(clusterName), options.NoCache)
 	if err != nil {
 		return GetPostgresCredentialsResponse{}, err
 	}
@@ -44,14 +192,14 @@ func (k *Kubernetes) GetPostgresCredentials(
 		username = constants.AdminUsername
 	}
 
-	secretName := constants.GetCredentialSecretNameForCluster(username, clusterName)
-	secret, err := k.kubeClient.Secrets(info.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+	secretName := constants.GetCredentialSecretNameForCluster(username, info.Name)
+	secret, err := k.getSecret(ctx, info.Namespace, secretName, options.NoCache)
 	if err != nil {
-		return GetPostgresCredentialsResponse{}, err
+		return GetPostgresCredentialsResponse{}, kubernetesError(ErrUserNotFound, err, "could not get secret %v", secretName)
 	}
 	pgPassword := constants.GetPasswordFromSecret(secret)
 	if pgPassword == "" {
-		return GetPostgresCredentialsResponse{}, fmt.Errorf("pgPassword for user %v not found in secret %v", username, secretName)
+		return GetPostgresCredentialsResponse{}, newError(ErrSecretMalformed, nil, "pgPassword for user %v not found in secret %v", username, secretName)
 	}
 
 	return GetPostgresCredentialsResponse{
@@ -60,27 +208,45 @@ func (k *Kubernetes) GetPostgresCredentials(
 	}, nil
 }
 
+// GetClusterEndpoint resolves the Service of the role, its external address and the connection pooler in front of it,
+// and the ready replica pods for the replica role. The internal DNS name is returned alone when the Services
+// are missing or can not be read
 func (k *Kubernetes) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
-	info, err := k.getClusterInfo(ctx, clusterName)
+	info, err := k.getClusterInfo(ctx, clusterName, false)
 	if err != nil {
-		return GetClusterEndpointResponse{}, fmt.Errorf("could not getClusterInfo: %v", err)
+		return GetClusterEndpointResponse{}, fmt.Errorf("could not getClusterInfo: %w", err)
 	}
 
-	return GetClusterEndpointResponse{
-		Hostname: constants.GetClusterEndpoint(clusterName, info.Namespace, role),
-	}, nil
+	endpoint := GetClusterEndpointResponse{
+		Hostname: constants.GetClusterEndpoint(info.Name, info.Namespace, role),
+		Port:     constants.PostgresDefaultPort,
+	}
+	// The TLS plugin issues server certificates signed by the root CA returned by GetPostgresSSLRootCert
+	if info.Spec.TLS.PluginName != "" {
+		endpoint.TLSRequired = true
+		endpoint.SSLMode = "verify-ca"
+	}
+	if err := k.resolveServices(ctx, info, role, &endpoint); err != nil {
+		return GetClusterEndpointResponse{}, err
+	}
+	if role == constants.RoleReplica {
+		if err := k.resolveReplicas(ctx, info, &endpoint); err != nil {
+			return GetClusterEndpointResponse{}, err
+		}
+	}
+	return endpoint, nil
 }
 
 func (k *Kubernetes) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
-	info, err := k.getClusterInfo(ctx, clusterName)
+	info, err := k.getClusterInfo(ctx, options.QualifiedClusterName(clusterName), options.NoCache)
 	if err != nil {
 		return GetPostgresSSLRootCertResponse{}, err
 	}
 
-	tlsSecretName := constants.GetTLSSecretName(clusterName)
-	tlsSecret, err := k.kubeClient.Secrets(info.Namespace).Get(ctx, tlsSecretName, metav1.GetOptions{})
+	tlsSecretName := constants.GetTLSSecretName(info.Name)
+	tlsSecret, err := k.getSecret(ctx, info.Namespace, tlsSecretName, options.NoCache)
 	if err != nil {
-		return GetPostgresSSLRootCertResponse{}, fmt.Errorf("could not Get Secrets for %v: %v", tlsSecretName, err)
+		return GetPostgresSSLRootCertResponse{}, kubernetesError(ErrClusterNotFound, err, "could not Get Secrets for %v", tlsSecretName)
 	}
 
 	return GetPostgresSSLRootCertResponse{
@@ -88,38 +254,172 @@ func (k *Kubernetes) GetPostgresSSLRootCert(ctx context.Context, clusterName str
 	}, err
 }
 
+func (k *Kubernetes) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	info, err := k.getClusterInfo(ctx, options.QualifiedClusterName(clusterName), options.NoCache)
+	if err != nil {
+		return GetPostgresClientCertificateResponse{}, err
+	}
+
+	if username == "" {
+		username = constants.AdminUsername
+	}
+
+	secretName := constants.GetClientTLSSecretName(username, info.Name)
+	secret, err := k.getSecret(ctx, info.Namespace, secretName, options.NoCache)
+	if err != nil {
+		return GetPostgresClientCertificateResponse{}, kubernetesError(ErrUserNotFound, err, "could not Get Secrets for %v", secretName)
+	}
+	cert, key := secret.Data[constants.ServerCertName], secret.Data[constants.ServerKeyName]
+	if len(cert) == 0 || len(key) == 0 {
+		return GetPostgresClientCertificateResponse{}, newError(ErrSecretMalformed, nil, "client certificate for user %v not found in secret %v", username, secretName)
+	}
+
+	return GetPostgresClientCertificateResponse{
+		Username:  username,
+		CertBytes: cert,
+		KeyBytes:  key,
+	}, nil
+}
+
 func (k *Kubernetes) GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error) {
-	info, err := k.getClusterInfo(ctx, clusterName)
+	info, err := k.getClusterInfo(ctx, args.QualifiedClusterName(clusterName), args.NoCache)
 	if err != nil {
 		return GetClusterCredentialsResponse{}, err
 	}
 
-	secret, err := k.kubeClient.Secrets(info.Namespace).Get(ctx, info.Spec.ClusterSecretsName, metav1.GetOptions{})
+	secret, err := k.getSecret(ctx, info.Namespace, info.Spec.ClusterSecretsName, args.NoCache)
+	if err != nil {
+		return GetClusterCredentialsResponse{}, kubernetesError(ErrClusterNotFound, err, "could not get secret %v", info.Spec.ClusterSecretsName)
+	}
+
+	previousKeys, err := parseBackupEncryptionKeyHistory(secret.Data[constants.ClusterSecretsBackupEncryptionKeyHistory], secret.Name)
 	if err != nil {
 		return GetClusterCredentialsResponse{}, err
 	}
 
 	return GetClusterCredentialsResponse{
-		AwsAccessKeyId:      string(secret.Data["awsAccessKeyId"]),
-		AwsSecretAccessKey:  string(secret.Data["awsSecretAccessKey"]),
-		BackupEncryptionKey: string(secret.Data["backupEncryptionKey"]),
-	}, err
+		AwsAccessKeyId:               string(secret.Data["awsAccessKeyId"]),
+		AwsSecretAccessKey:           string(secret.Data["awsSecretAccessKey"]),
+		BackupEncryptionKey:          string(secret.Data["backupEncryptionKey"]),
+		PreviousBackupEncryptionKeys: previousKeys,
+	}, nil
+}
+
+// parseBackupEncryptionKeyHistory returns the retired keys of the history stored in the cluster secrets, the oldest first
+func parseBackupEncryptionKeyHistory(encoded []byte, secretName string) ([]string, error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	var history []struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(encoded, &history); err != nil {
+		return nil, newError(ErrSecretMalformed, err, "could not unmarshal %v of secret %v", constants.ClusterSecretsBackupEncryptionKeyHistory, secretName)
+	}
+	var keys []string
+	for _, retired := range history {
+		keys = append(keys, retired.Key)
+	}
+	return keys, nil
 }
 
-func (k *Kubernetes) getClusterInfo(ctx context.Context, clusterName string) (borealisdbv1.Postgresql, error) {
-	list, err := k.kubeClient.Postgresqls("").List(ctx, metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%v", clusterName)})
+// getClusterInfo finds the cluster named either <name> or <namespace>/<name> among the allowed namespaces,
+// noCache skips the informer cache
+func (k *Kubernetes) getClusterInfo(ctx context.Context, clusterName string, noCache bool) (borealisdbv1.Postgresql, error) {
+	name, err := ParseClusterName(clusterName)
 	if err != nil {
-		return borealisdbv1.Postgresql{}, err
+		return borealisdbv1.Postgresql{}, newError(ErrClusterNotFound, err, "invalid cluster name %v", clusterName)
 	}
-	if len(list.Items) == 0 {
-		return borealisdbv1.Postgresql{}, fmt.Errorf("no cluster found with name %v", clusterName)
+	if name.Namespace != "" && !k.isNamespaceAllowed(name.Namespace) {
+		return borealisdbv1.Postgresql{}, newError(ErrPermissionDenied, nil, "namespace %v is not allowed", name.Namespace)
 	}
 
-	cluster := getDefaults(list)
-	return cluster, nil
+	clusters, err := k.findClusters(ctx, name, noCache)
+	if err != nil {
+		return borealisdbv1.Postgresql{}, kubernetesError(ErrClusterNotFound, err, "could not find cluster %v", clusterName)
+	}
+	var found []borealisdbv1.Postgresql
+	var namespaces []string
+	for _, cluster := range clusters {
+		if cluster.Name != name.Name || !k.isNamespaceAllowed(cluster.Namespace) {
+			continue
+		}
+		if name.Namespace != "" && cluster.Namespace != name.Namespace {
+			continue
+		}
+		found = append(found, cluster)
+		namespaces = append(namespaces, cluster.Namespace)
+	}
+
+	switch len(found) {
+	case 0:
+		return borealisdbv1.Postgresql{}, newError(ErrClusterNotFound, nil, "no cluster found with name %v", clusterName)
+	case 1:
+		return found[0], nil
+	default:
+		sort.Strings(namespaces)
+		return borealisdbv1.Postgresql{}, &AmbiguousClusterError{Name: name.Name, Namespaces: namespaces}
+	}
 }
 
-func getDefaults(list *borealisdbv1.PostgresqlList) borealisdbv1.Postgresql {
-	cluster := list.Items[0]
-	return cluster
+// findClusters returns the candidates for a cluster name, which still have to be filtered
+func (k *Kubernetes) findClusters(ctx context.Context, name k8sutil.NamespacedName, noCache bool) ([]borealisdbv1.Postgresql, error) {
+	if k.clusterIndexers != nil && !noCache {
+		var clusters []borealisdbv1.Postgresql
+		for _, indexer := range k.clusterIndexers {
+			objects, err := indexer.ByIndex(clusterNameIndex, name.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, object := range objects {
+				clusters = append(clusters, *object.(*borealisdbv1.Postgresql))
+			}
+		}
+		return clusters, nil
+	}
+
+	namespaces := []string{name.Namespace}
+	if name.Namespace == "" && len(k.allowedNamespaces) > 0 {
+		namespaces = k.allowedNamespaces
+	}
+	var clusters []borealisdbv1.Postgresql
+	for _, namespace := range namespaces {
+		list, err := k.kubeClient.Postgresqls(namespace).List(ctx, metav1.ListOptions{FieldSelector: fmt.Sprintf("metadata.name=%v", name.Name)})
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, list.Items...)
+	}
+	return clusters, nil
+}
+
+func (k *Kubernetes) isNamespaceAllowed(namespace string) bool {
+	if len(k.allowedNamespaces) == 0 {
+		return true
+	}
+	for _, allowed := range k.allowedNamespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// getSecret reads the secret from the informer cache when started, the returned secret must not be modified.
+// Secrets missing from the cache, such as the ones created without the cluster name label, are read from the API server
+func (k *Kubernetes) getSecret(ctx context.Context, namespace, name string, noCache bool) (*v1.Secret, error) {
+	if lister := k.getSecretLister(namespace); lister != nil && !noCache {
+		secret, err := lister.Secrets(namespace).Get(name)
+		if !apierrors.IsNotFound(err) {
+			return secret, err
+		}
+	}
+	return k.kubeClient.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (k *Kubernetes) getSecretLister(namespace string) corev1listers.SecretLister {
+	if lister, ok := k.secretListers[namespace]; ok {
+		return lister
+	}
+	return k.secretListers[v1.NamespaceAll]
 }
@@ -0,0 +1,213 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	borealisdbv1 "github.com/borealisdb/commons/borealisdb.io/v1"
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/k8sutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	postgresPortName = "postgresql"
+
+	// endpointAccessCheckTimeout bounds the List StartInformers checks its access to Services and pods with
+	endpointAccessCheckTimeout = 10 * time.Second
+)
+
+// replicaSelector selects the replica pods of every cluster, the informers narrow it down to one cluster
+var replicaSelector = labels.SelectorFromSet(labels.Set{constants.SpiloRoleLabel: constants.RoleReplica})
+
+// newEndpointInformers watches the Services and the replica pods of a namespace, an informer is nil when its objects
+// can not be listed, as it would never sync
+func (k *Kubernetes) newEndpointInformers(namespace string, resync time.Duration) (services, pods cache.SharedIndexInformer) {
+	ctx, cancel := context.WithTimeout(context.Background(), endpointAccessCheckTimeout)
+	defer cancel()
+	if k.kubeClient.ServicesGetter != nil {
+		client := k.kubeClient.Services(namespace)
+		list := func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.List(ctx, options)
+		}
+		if canList(ctx, list) {
+			services = newLabelledInformer(&v1.Service{}, "", resync, list, client.Watch)
+		}
+	}
+	if k.kubeClient.PodsGetter != nil {
+		client := k.kubeClient.Pods(namespace)
+		list := func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return client.List(ctx, options)
+		}
+		if canList(ctx, list) {
+			pods = newLabelledInformer(&v1.Pod{}, replicaSelector.String(), resync, list, client.Watch)
+		}
+	}
+	return services, pods
+}
+
+func canList(ctx context.Context, list func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error)) bool {
+	_, err := list(ctx, metav1.ListOptions{Limit: 1})
+	return err == nil
+}
+
+// resolveServices reads the port and the external address of the role Service and the connection pooler Service.
+// Missing Services, or Services the provider may not read, leave the endpoint as is
+func (k *Kubernetes) resolveServices(ctx context.Context, info borealisdbv1.Postgresql, role string, endpoint *GetClusterEndpointResponse) error {
+	serviceName := info.Name
+	if role == constants.RoleReplica {
+		serviceName = fmt.Sprintf("%v-repl", info.Name)
+	}
+	service, err := k.getService(ctx, info.Namespace, serviceName)
+	if err != nil {
+		return kubernetesError(nil, err, "could not get service %v", serviceName)
+	}
+	if service != nil {
+		port := getServicePort(service, constants.PostgresDefaultPort)
+		endpoint.Port = port
+		endpoint.External = getExternalAddress(service, port)
+	}
+
+	if info.Spec.LoadBalancer.Disabled {
+		return nil
+	}
+	poolerName := constants.GetLoadBalancerName(info.Name)
+	pooler, err := k.getService(ctx, info.Namespace, poolerName)
+	if err != nil {
+		return kubernetesError(nil, err, "could not get service %v", poolerName)
+	}
+	if pooler == nil {
+		return nil
+	}
+	poolerPort := constants.PostgresDefaultPort
+	if info.Spec.LoadBalancer.PgPort != 0 {
+		poolerPort = strconv.Itoa(int(info.Spec.LoadBalancer.PgPort))
+	}
+	poolerPort = getServicePort(pooler, poolerPort)
+	endpoint.Pooler = &EndpointAddress{
+		Hostname: fmt.Sprintf("%v.%v.svc.cluster.local", poolerName, info.Namespace),
+		Port:     poolerPort,
+	}
+	// Out-of-cluster clients go through the pooler when it is exposed
+	if external := getExternalAddress(pooler, poolerPort); external != nil && endpoint.External == nil {
+		endpoint.External = external
+	}
+	return nil
+}
+
+// getService reads a Service from the informer cache when started, it returns nil when the Service is missing
+// or can not be read
+func (k *Kubernetes) getService(ctx context.Context, namespace, name string) (*v1.Service, error) {
+	var service *v1.Service
+	var err error
+	if lister := k.getServiceLister(namespace); lister != nil {
+		service, err = lister.Services(namespace).Get(name)
+	} else if k.kubeClient.ServicesGetter != nil {
+		service, err = k.kubeClient.Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) || apierrors.IsForbidden(err) {
+		return nil, nil
+	}
+	return service, err
+}
+
+// resolveReplicas lists the addresses of the ready replica pods, none when they can not be read
+func (k *Kubernetes) resolveReplicas(ctx context.Context, info borealisdbv1.Postgresql, endpoint *GetClusterEndpointResponse) error {
+	selector := labels.SelectorFromSet(labels.Set{
+		constants.ClusterNameLabel: info.Name,
+		constants.SpiloRoleLabel:   constants.RoleReplica,
+	})
+	var pods []*v1.Pod
+	if lister := k.getPodLister(info.Namespace); lister != nil {
+		listed, err := lister.Pods(info.Namespace).List(selector)
+		if err != nil {
+			return kubernetesError(ErrProviderUnavailable, err, "could not list replica pods")
+		}
+		pods = listed
+	} else if k.kubeClient.PodsGetter != nil {
+		list, err := k.kubeClient.Pods(info.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if apierrors.IsForbidden(err) {
+			return nil
+		}
+		if err != nil {
+			return kubernetesError(ErrProviderUnavailable, err, "could not list replica pods")
+		}
+		for i := range list.Items {
+			pods = append(pods, &list.Items[i])
+		}
+	}
+	// Listers do not sort their objects
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	for _, pod := range pods {
+		if pod.Status.PodIP == "" || !isPodReady(*pod) {
+			continue
+		}
+		endpoint.Replicas = append(endpoint.Replicas, EndpointAddress{
+			Hostname: pod.Status.PodIP,
+			Port:     constants.PostgresDefaultPort,
+		})
+	}
+	return nil
+}
+
+func (k *Kubernetes) getServiceLister(namespace string) corev1listers.ServiceLister {
+	if lister, ok := k.serviceListers[namespace]; ok {
+		return lister
+	}
+	return k.serviceListers[v1.NamespaceAll]
+}
+
+func (k *Kubernetes) getPodLister(namespace string) corev1listers.PodLister {
+	if lister, ok := k.podListers[namespace]; ok {
+		return lister
+	}
+	return k.podListers[v1.NamespaceAll]
+}
+
+// getServicePort returns the Postgres port of a Service, the only one or the one named postgresql
+func getServicePort(service *v1.Service, defaultPort string) string {
+	for _, port := range service.Spec.Ports {
+		if port.Name == postgresPortName || len(service.Spec.Ports) == 1 {
+			return strconv.Itoa(int(port.Port))
+		}
+	}
+	return defaultPort
+}
+
+// getExternalAddress prefers the external DNS name of the Service over the address of its load balancer
+func getExternalAddress(service *v1.Service, port string) *EndpointAddress {
+	if hostnames := service.Annotations[k8sutil.BorealisDNSNameAnnotation]; hostnames != "" {
+		return &EndpointAddress{Hostname: strings.TrimSpace(strings.Split(hostnames, ",")[0]), Port: port}
+	}
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.Hostname != "" {
+			return &EndpointAddress{Hostname: ingress.Hostname, Port: port}
+		}
+		if ingress.IP != "" {
+			return &EndpointAddress{Hostname: ingress.IP, Port: port}
+		}
+	}
+	return nil
+}
+
+func isPodReady(pod v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	borealisdbv1 "github.com/borealisdb/commons/borealisdb.io/v1"
+	"github.com/borealisdb/commons/constants"
+	borealisfake "github.com/borealisdb/commons/generated/clientset/versioned/fake"
+	"github.com/borealisdb/commons/k8sutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestKubernetes_Informers(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      constants.GetTLSSecretName("mycluster"),
+			Namespace: "databases",
+			Labels:    map[string]string{constants.ClusterNameLabel: "mycluster"},
+		},
+		Data: map[string][]byte{constants.RootCaCertName: []byte("root")},
+	}, &v1.Secret{
+		// Secrets without the cluster name label are not watched
+		ObjectMeta: metav1.ObjectMeta{Name: constants.GetTLSSecretName("unlabelled"), Namespace: "databases"},
+		Data:       map[string][]byte{constants.RootCaCertName: []byte("unlabelled")},
+	})
+	borealisClient := borealisfake.NewSimpleClientset(&borealisdbv1.Postgresql{
+		ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "databases"},
+	}, &borealisdbv1.Postgresql{
+		ObjectMeta: metav1.ObjectMeta{Name: "unlabelled", Namespace: "databases"},
+	})
+
+	provider := &Kubernetes{}
+	provider.SetKubeClient(k8sutil.KubernetesClient{SecretsGetter: clientset.CoreV1()})
+	provider.SetBorealisClient(borealisClient)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := provider.StartInformers(stopCh, 0); err != nil {
+		t.Fatalf("StartInformers() error = %v", err)
+	}
+	clientset.ClearActions()
+	borealisClient.ClearActions()
+
+	ctx := context.Background()
+	rootCert, err := provider.GetPostgresSSLRootCert(ctx, "mycluster", Options{})
+	if err != nil || string(rootCert.RootCertBytes) != "root" {
+		t.Errorf("GetPostgresSSLRootCert() = %+v, %v", rootCert, err)
+	}
+	endpoint, err := provider.GetClusterEndpoint(ctx, "mycluster", constants.RoleMaster)
+	if err != nil || endpoint.Hostname != constants.GetClusterEndpoint("mycluster", "databases", constants.RoleMaster) {
+		t.Errorf("GetClusterEndpoint() = %+v, %v", endpoint, err)
+	}
+	if _, err := provider.GetClusterEndpoint(ctx, "unknown", constants.RoleMaster); err == nil {
+		t.Errorf("GetClusterEndpoint() for an unknown cluster should fail")
+	}
+
+	if actions := append(clientset.Actions(), borealisClient.Actions()...); len(actions) != 0 {
+		t.Errorf("lookups reached the API server: %v", actions)
+	}
+
+	rootCert, err = provider.GetPostgresSSLRootCert(ctx, "unlabelled", Options{})
+	if err != nil || string(rootCert.RootCertBytes) != "unlabelled" {
+		t.Errorf("GetPostgresSSLRootCert() of an unlabelled secret = %+v, %v", rootCert, err)
+	}
+	if actions := clientset.Actions(); len(actions) != 1 || !actions[0].Matches("get", "secrets") {
+		t.Errorf("unlabelled secret should be read from the API server, got %v", actions)
+	}
+}
+
+func TestKubernetes_NamespacedClusterNames(t *testing.T) {
+	var objects []runtime.Object
+	var clusters []runtime.Object
+	for _, namespace := range []string{"team-a", "team-b"} {
+		objects = append(objects, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: constants.GetTLSSecretName("mycluster"), Namespace: namespace},
+			Data:       map[string][]byte{constants.RootCaCertName: []byte(namespace)},
+		})
+		clusters = append(clusters, &borealisdbv1.Postgresql{
+			ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: namespace},
+		})
+	}
+
+	tests := []struct {
+		name              string
+		clusterName       string
+		namespace         string
+		allowedNamespaces []string
+		want              string
+		wantAmbiguous     bool
+		wantErr           bool
+	}{
+		{name: "bare name in several namespaces", clusterName: "mycluster", wantAmbiguous: true, wantErr: true},
+		{name: "qualified name", clusterName: "team-b/mycluster", want: "team-b"},
+		{name: "qualified name from a namespaced identifier", clusterName: k8sutil.NamespacedName{Namespace: "team-a", Name: "mycluster"}.String(), want: "team-a"},
+		{name: "bare name scoped to allowed namespaces", clusterName: "mycluster", allowedNamespaces: []string{"team-a"}, want: "team-a"},
+		{name: "qualified name in a namespace not allowed", clusterName: "team-b/mycluster", allowedNamespaces: []string{"team-a", "team-c"}, wantErr: true},
+		{name: "unknown namespace", clusterName: "team-c/mycluster", wantErr: true},
+		{name: "namespace from the options", clusterName: "mycluster", namespace: "team-b", want: "team-b"},
+	}
+	for _, informers := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%v informers=%v", tt.name, informers), func(t *testing.T) {
+				provider := &Kubernetes{}
+				borealisClient := borealisfake.NewSimpleClientset(clusters...)
+				provider.SetKubeClient(k8sutil.KubernetesClient{
+					SecretsGetter:     fake.NewSimpleClientset(objects...).CoreV1(),
+					PostgresqlsGetter: borealisClient.BorealisdbV1(),
+				})
+				provider.SetBorealisClient(borealisClient)
+				provider.SetAllowedNamespaces(tt.allowedNamespaces...)
+				if informers {
+					stopCh := make(chan struct{})
+					defer close(stopCh)
+					if err := provider.StartInformers(stopCh, 0); err != nil {
+						t.Fatalf("StartInformers() error = %v", err)
+					}
+					// Each allowed namespace has its own informers, no other namespace is watched
+					for _, action := range borealisClient.Actions() {
+						if len(tt.allowedNamespaces) > 0 && !provider.isNamespaceAllowed(action.GetNamespace()) {
+							t.Errorf("informers watch namespace %q", action.GetNamespace())
+						}
+					}
+				}
+
+				rootCert, err := provider.GetPostgresSSLRootCert(context.Background(), tt.clusterName, Options{Namespace: tt.namespace})
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("GetPostgresSSLRootCert() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				var ambiguous *AmbiguousClusterError
+				if errors.As(err, &ambiguous) != tt.wantAmbiguous {
+					t.Errorf("GetPostgresSSLRootCert() error = %v, wantAmbiguous %v", err, tt.wantAmbiguous)
+				}
+				if string(rootCert.RootCertBytes) != tt.want {
+					t.Errorf("GetPostgresSSLRootCert() read the secret of namespace %s, want %v", rootCert.RootCertBytes, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestKubernetes_GetClusterEndpoint(t *testing.T) {
+	readyReplica := func(name, ip string, ready v1.ConditionStatus) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "databases", Labels: map[string]string{
+				constants.ClusterNameLabel: "mycluster",
+				constants.SpiloRoleLabel:   constants.RoleReplica,
+			}},
+			Status: v1.PodStatus{PodIP: ip, Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: ready}}},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "databases", Annotations: map[string]string{
+				k8sutil.BorealisDNSNameAnnotation: "mycluster.example.org",
+			}},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Name: "postgresql", Port: 6432}}},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "mycluster-repl", Namespace: "databases"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "postgresql", Port: 5432}}},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: constants.GetLoadBalancerName("mycluster"), Namespace: "databases"},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Port: 7432}}},
+			Status:     v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "203.0.113.10"}}}},
+		},
+		readyReplica("mycluster-1", "10.0.0.2", v1.ConditionTrue),
+		readyReplica("mycluster-2", "10.0.0.3", v1.ConditionFalse),
+	)
+	borealisClient := borealisfake.NewSimpleClientset(&borealisdbv1.Postgresql{
+		ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "databases"},
+		Spec:       borealisdbv1.PostgresSpec{TLS: borealisdbv1.TLS{PluginName: "internal-ca"}},
+	}, &borealisdbv1.Postgresql{
+		// A cluster without Services falls back to its DNS name
+		ObjectMeta: metav1.ObjectMeta{Name: "noservices", Namespace: "databases"},
+	})
+	provider := &Kubernetes{}
+	provider.SetKubeClient(k8sutil.KubernetesClient{
+		SecretsGetter:     clientset.CoreV1(),
+		ServicesGetter:    clientset.CoreV1(),
+		PodsGetter:        clientset.CoreV1(),
+		PostgresqlsGetter: borealisClient.BorealisdbV1(),
+	})
+	provider.SetBorealisClient(borealisClient)
+
+	for _, role := range []string{constants.RoleMaster, constants.RoleReplica} {
+		got, err := provider.GetClusterEndpoint(context.Background(), "noservices", role)
+		want := GetClusterEndpointResponse{Hostname: constants.GetClusterEndpoint("noservices", "databases", role), Port: "5432"}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("GetClusterEndpoint() of a cluster without Services = %+v, %v, want %+v", got, err, want)
+		}
+	}
+
+	forbiddenClientset := fake.NewSimpleClientset()
+	forbiddenClientset.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(v1.Resource(action.GetResource().Resource), "", fmt.Errorf("forbidden"))
+	})
+	forbidden := &Kubernetes{}
+	forbidden.SetKubeClient(k8sutil.KubernetesClient{
+		ServicesGetter:    forbiddenClientset.CoreV1(),
+		PodsGetter:        forbiddenClientset.CoreV1(),
+		PostgresqlsGetter: borealisClient.BorealisdbV1(),
+	})
+	got, err := forbidden.GetClusterEndpoint(context.Background(), "mycluster", constants.RoleReplica)
+	if err != nil || got.Hostname != "mycluster-repl.databases.svc.cluster.local" || got.External != nil || got.Replicas != nil {
+		t.Errorf("GetClusterEndpoint() without access to Services and pods = %+v, %v", got, err)
+	}
+
+	tests := []struct {
+		role string
+		want GetClusterEndpointResponse
+	}{
+		{
+			role: constants.RoleMaster,
+			want: GetClusterEndpointResponse{
+				Hostname:    "mycluster.databases.svc.cluster.local",
+				Port:        "6432",
+				External:    &EndpointAddress{Hostname: "mycluster.example.org", Port: "6432"},
+				Pooler:      &EndpointAddress{Hostname: "mycluster-loadbalancer.databases.svc.cluster.local", Port: "7432"},
+				TLSRequired: true,
+				SSLMode:     "verify-ca",
+			},
+		},
+		{
+			role: constants.RoleReplica,
+			want: GetClusterEndpointResponse{
+				Hostname:    "mycluster-repl.databases.svc.cluster.local",
+				Port:        "5432",
+				External:    &EndpointAddress{Hostname: "203.0.113.10", Port: "7432"},
+				Pooler:      &EndpointAddress{Hostname: "mycluster-loadbalancer.databases.svc.cluster.local", Port: "7432"},
+				Replicas:    []EndpointAddress{{Hostname: "10.0.0.2", Port: "5432"}},
+				TLSRequired: true,
+				SSLMode:     "verify-ca",
+			},
+		},
+	}
+	for _, informers := range []bool{false, true} {
+		if informers {
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			if err := provider.StartInformers(stopCh, 0); err != nil {
+				t.Fatalf("StartInformers() error = %v", err)
+			}
+			clientset.ClearActions()
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%v informers=%v", tt.role, informers), func(t *testing.T) {
+				got, err := provider.GetClusterEndpoint(context.Background(), "mycluster", tt.role)
+				if err != nil {
+					t.Fatalf("GetClusterEndpoint() error = %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("GetClusterEndpoint() = %+v, want %+v", got, tt.want)
+				}
+			})
+		}
+		if actions := clientset.Actions(); informers && len(actions) != 0 {
+			t.Errorf("lookups reached the API server: %v", actions)
+		}
+	}
+}
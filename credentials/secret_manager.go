@@ -0,0 +1,182 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+)
+
+// defaultCloudSecretManagerTimeout bounds the initialization of the cloud secret manager clients
+const defaultCloudSecretManagerTimeout = 30 * time.Second
+
+// secretReader reads the latest value of a secret from a cloud secret manager, notFound being the kind of the error of a missing secret
+type secretReader interface {
+	readSecret(ctx context.Context, name string, notFound error) ([]byte, error)
+}
+
+// secretManager implements Credentials over a secretReader, with secrets named like the Kubernetes ones:
+//   - <prefix><cluster>-<user>-credentials holds {"username", "password"} or the bare password
+//   - <prefix><cluster>-secrets holds {"awsAccessKeyId", "awsSecretAccessKey", "backupEncryptionKey", "backupEncryptionKeyHistory"}
+//   - <prefix><cluster>-tls holds {"root.crt"}
+//   - <prefix><cluster>-<user>-client-tls holds {"tls.crt", "tls.key"}
+//   - <prefix><cluster>-endpoint holds {"<role>": {"hostname", "port"}}
+//
+// The namespace of qualified cluster names is inserted after the prefix, followed by the separator
+type secretManager struct {
+	reader    secretReader
+	prefix    string
+	separator string
+}
+
+func (s secretManager) GetPostgresCredentials(ctx context.Context, clusterName string, username string, options Options) (GetPostgresCredentialsResponse, error) {
+	if username == "" {
+		username = constants.AdminUsername
+	}
+	value, err := s.read(ctx, options.QualifiedClusterName(clusterName), func(name string) string {
+		return constants.GetCredentialSecretNameForCluster(username, name)
+	}, ErrUserNotFound)
+	if err != nil {
+		return GetPostgresCredentialsResponse{}, err
+	}
+
+	response := GetPostgresCredentialsResponse{Username: username}
+	var data map[string]string
+	if json.Unmarshal(value, &data) == nil {
+		response.Password = data[constants.PostgresClusterSecretPasswordKey]
+		if data["username"] != "" {
+			response.Username = data["username"]
+		}
+	} else {
+		response.Password = strings.TrimSpace(string(value))
+	}
+	if response.Password == "" {
+		return GetPostgresCredentialsResponse{}, newError(ErrUserNotFound, nil, "password for user %v not found in cluster %v", username, clusterName)
+	}
+	return response, nil
+}
+
+func (s secretManager) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
+	if role == "" {
+		role = constants.RoleMaster
+	}
+	value, err := s.read(ctx, clusterName, func(name string) string {
+		return fmt.Sprintf("%v-endpoint", name)
+	}, ErrClusterNotFound)
+	if err != nil {
+		return GetClusterEndpointResponse{}, err
+	}
+	var endpoints map[string]EndpointAddress
+	if err := json.Unmarshal(value, &endpoints); err != nil {
+		return GetClusterEndpointResponse{}, newError(ErrSecretMalformed, err, "could not parse endpoints of cluster %v", clusterName)
+	}
+	endpoint, ok := endpoints[role]
+	if !ok {
+		return GetClusterEndpointResponse{}, newError(ErrClusterNotFound, nil, "endpoint %v not found in cluster %v", role, clusterName)
+	}
+	if endpoint.Port == "" {
+		endpoint.Port = constants.PostgresDefaultPort
+	}
+	return GetClusterEndpointResponse{
+		Hostname: endpoint.Hostname,
+		Port:     endpoint.Port,
+	}, nil
+}
+
+func (s secretManager) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
+	data, err := s.readJSON(ctx, options.QualifiedClusterName(clusterName), constants.GetTLSSecretName, ErrClusterNotFound)
+	if err != nil {
+		return GetPostgresSSLRootCertResponse{}, err
+	}
+	if data[constants.RootCaCertName] == "" {
+		return GetPostgresSSLRootCertResponse{}, newError(ErrClusterNotFound, nil, "root certificate not found in cluster %v", clusterName)
+	}
+	return GetPostgresSSLRootCertResponse{
+		RootCertBytes: []byte(data[constants.RootCaCertName]),
+	}, nil
+}
+
+func (s secretManager) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	if username == "" {
+		username = constants.AdminUsername
+	}
+	data, err := s.readJSON(ctx, options.QualifiedClusterName(clusterName), func(name string) string {
+		return constants.GetClientTLSSecretName(username, name)
+	}, ErrUserNotFound)
+	if err != nil {
+		return GetPostgresClientCertificateResponse{}, err
+	}
+	cert, key := data[constants.ServerCertName], data[constants.ServerKeyName]
+	if cert == "" || key == "" {
+		return GetPostgresClientCertificateResponse{}, newError(ErrUserNotFound, nil, "client certificate for user %v not found in cluster %v", username, clusterName)
+	}
+	return GetPostgresClientCertificateResponse{
+		Username:  username,
+		CertBytes: []byte(cert),
+		KeyBytes:  []byte(key),
+	}, nil
+}
+
+func (s secretManager) GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error) {
+	data, err := s.readJSON(ctx, args.QualifiedClusterName(clusterName), constants.GetClusterSecrets, ErrClusterNotFound)
+	if err != nil {
+		return GetClusterCredentialsResponse{}, err
+	}
+	previousKeys, err := parseBackupEncryptionKeyHistory(
+		[]byte(data[constants.ClusterSecretsBackupEncryptionKeyHistory]),
+		s.getSecretName(args.QualifiedClusterName(clusterName), constants.GetClusterSecrets),
+	)
+	if err != nil {
+		return GetClusterCredentialsResponse{}, err
+	}
+	return GetClusterCredentialsResponse{
+		AwsAccessKeyId:               data["awsAccessKeyId"],
+		AwsSecretAccessKey:           data["awsSecretAccessKey"],
+		BackupEncryptionKey:          data[constants.ClusterSecretsBackupEncryptionKey],
+		PreviousBackupEncryptionKeys: previousKeys,
+	}, nil
+}
+
+// readJSON reads a secret holding a JSON object, values which are not strings are returned as raw JSON,
+// e.g. the backup encryption key history
+func (s secretManager) readJSON(ctx context.Context, clusterName string, secretName func(clusterName string) string, notFound error) (map[string]string, error) {
+	value, err := s.read(ctx, clusterName, secretName, notFound)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(value, &raw); err != nil {
+		return nil, newError(ErrSecretMalformed, err, "could not parse secret %v", s.getSecretName(clusterName, secretName))
+	}
+	return decodeSecretValues(raw), nil
+}
+
+// decodeSecretValues unquotes the string values of a JSON object and keeps the others raw
+func decodeSecretValues(raw map[string]json.RawMessage) map[string]string {
+	data := make(map[string]string, len(raw))
+	for key, value := range raw {
+		var text string
+		if json.Unmarshal(value, &text) == nil {
+			data[key] = text
+		} else {
+			data[key] = string(value)
+		}
+	}
+	return data
+}
+
+func (s secretManager) read(ctx context.Context, clusterName string, secretName func(clusterName string) string, notFound error) ([]byte, error) {
+	return s.reader.readSecret(ctx, s.getSecretName(clusterName, secretName), notFound)
+}
+
+// getSecretName returns <prefix>[<namespace><separator>]<secret>
+func (s secretManager) getSecretName(clusterName string, secretName func(clusterName string) string) string {
+	name, err := ParseClusterName(clusterName)
+	if err != nil || name.Namespace == "" {
+		return s.prefix + secretName(clusterName)
+	}
+	return s.prefix + name.Namespace + s.separator + secretName(name.Name)
+}
@@ -0,0 +1,156 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var testCloudSecrets = map[string]string{
+	"mycluster-application-credentials":  `{"username": "application", "password": "secret"}`,
+	"prod/mycluster-analyst-credentials": "analyst-secret\n",
+	"mycluster-secrets":                  `{"awsAccessKeyId": "AKID", "awsSecretAccessKey": "key", "backupEncryptionKey": "backup", "backupEncryptionKeyHistory": [{"key": "retired", "retiredAt": "2023-01-02T03:04:05Z"}]}`,
+	"mycluster-tls":                      `{"root.crt": "ROOT"}`,
+	"mycluster-endpoint":                 `{"master": {"hostname": "mycluster.example.com"}}`,
+}
+
+// fakeAWSSecretsManager serves GetSecretValue like moto, for secrets stored under borealis/
+func fakeAWSSecretsManager(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request") ||
+			r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if strings.HasPrefix(body["SecretId"], "borealis/denied-") {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "AccessDeniedException", "message": "User is not authorized to perform: secretsmanager:GetSecretValue"})
+			return
+		}
+		value, ok := testCloudSecrets[strings.TrimPrefix(body["SecretId"], "borealis/")]
+		if !ok {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ResourceNotFoundException", "message": "Secrets Manager can't find the specified secret."})
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string]string{"Name": body["SecretId"], "SecretString": value})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fakeGCPSecretManager serves AccessSecretVersion over gRPC, for secrets stored under borealis-
+type fakeGCPSecretManager struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+}
+
+func (f *fakeGCPSecretManager) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(req.GetName(), "projects/myproject/secrets/borealis-"), "/versions/latest")
+	if strings.HasPrefix(name, "denied-") {
+		return nil, status.Errorf(codes.PermissionDenied, "permission denied on %v", req.GetName())
+	}
+	value, ok := testCloudSecrets[strings.Replace(name, "_", "/", 1)]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "secret %v not found", req.GetName())
+	}
+	return &secretmanagerpb.AccessSecretVersionResponse{
+		Name:    req.GetName(),
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte(value)},
+	}, nil
+}
+
+func newFakeGCPSecretManager(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(server, &fakeGCPSecretManager{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestCloudSecretManagers(t *testing.T) {
+	// The default AWS credential chain reads the environment first
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	awsServer := fakeAWSSecretsManager(t)
+	gcpAddress := newFakeGCPSecretManager(t)
+
+	providers := map[string]Credentials{
+		AWSSecretsManagerProvider: &AWSSecretsManager{
+			Region:   "eu-west-1",
+			Endpoint: awsServer.URL,
+		},
+		GCPSecretManagerProvider: &GCPSecretManager{
+			Project: "myproject",
+			ClientOptions: []option.ClientOption{
+				option.WithEndpoint(gcpAddress),
+				option.WithoutAuthentication(),
+				option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			},
+		},
+	}
+	for name, provider := range providers {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := provider.Init(); err != nil {
+				t.Fatalf("Init() error = %v", err)
+			}
+
+			credentials, err := provider.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+			if err != nil || credentials.Username != "application" || credentials.Password != "secret" {
+				t.Errorf("GetPostgresCredentials() = %v, %v", credentials, err)
+			}
+			credentials, err = provider.GetPostgresCredentials(ctx, "mycluster", "analyst", Options{Namespace: "prod"})
+			if err != nil || credentials.Username != "analyst" || credentials.Password != "analyst-secret" {
+				t.Errorf("GetPostgresCredentials() in namespace = %v, %v", credentials, err)
+			}
+			if _, err := provider.GetPostgresCredentials(ctx, "mycluster", "developer", Options{}); err == nil || !FallThroughNotFound(name, err) {
+				t.Errorf("GetPostgresCredentials() of missing secret error = %v, want not found", err)
+			}
+			if _, err := provider.GetPostgresCredentials(ctx, "denied", "application", Options{}); !errors.Is(err, ErrPermissionDenied) {
+				t.Errorf("GetPostgresCredentials() of a denied secret error = %v, want ErrPermissionDenied", err)
+			}
+
+			clusterCredentials, err := provider.GetClusterCredentials(ctx, "mycluster", Options{})
+			if err != nil || clusterCredentials.AwsAccessKeyId != "AKID" || clusterCredentials.BackupEncryptionKey != "backup" {
+				t.Errorf("GetClusterCredentials() = %v, %v", clusterCredentials, err)
+			}
+			if !reflect.DeepEqual(clusterCredentials.PreviousBackupEncryptionKeys, []string{"retired"}) {
+				t.Errorf("GetClusterCredentials() PreviousBackupEncryptionKeys = %v, want [retired]", clusterCredentials.PreviousBackupEncryptionKeys)
+			}
+			rootCert, err := provider.GetPostgresSSLRootCert(ctx, "mycluster", Options{})
+			if err != nil || string(rootCert.RootCertBytes) != "ROOT" {
+				t.Errorf("GetPostgresSSLRootCert() = %v, %v", rootCert, err)
+			}
+			endpoint, err := provider.GetClusterEndpoint(ctx, "mycluster", "")
+			if err != nil || endpoint.Hostname != "mycluster.example.com" || endpoint.Port != "5432" {
+				t.Errorf("GetClusterEndpoint() = %v, %v", endpoint, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,677 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/logger"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	VaultProvider = "vault"
+
+	defaultVaultKVMount             = "secret"
+	defaultVaultDatabaseMount       = "database"
+	defaultVaultPKIMount            = "pki"
+	defaultVaultPKIClientRole       = "borealis-client"
+	defaultVaultKubernetesAuthMount = "kubernetes"
+	defaultVaultRenewInterval       = time.Minute
+	defaultVaultTimeout             = 30 * time.Second
+
+	vaultServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	vaultReadOnlyRoleSuffix      = "readonly"
+	vaultClusterPlaceholder      = "{cluster}"
+)
+
+// Vault reads the cluster secrets from HashiCorp Vault:
+//   - Postgres users are short-lived dynamic users of the database secrets engine, role <cluster>-<user>,
+//     or <cluster>-<user>-readonly for replicas. The namespace of qualified names prefixes the role as <namespace>-
+//   - endpoints and backup keys are static KV v2 secrets under borealis/<cluster>
+//   - the root CA and the client certificates come from the PKI secrets engine, which can be mounted per cluster
+//
+// The leases of the dynamic users are tracked, so Run can renew them and revoke them on shutdown.
+// Run also renews the token, or logs in again with the service account once it can not be renewed anymore
+type Vault struct {
+	// Address and Token default to VAULT_ADDR and VAULT_TOKEN
+	Address   string
+	Token     string
+	Namespace string
+	// KubernetesAuthRole logs in with the pod service account when no token is given
+	KubernetesAuthRole  string
+	KubernetesAuthMount string
+
+	KVMount       string
+	DatabaseMount string
+	// PKIMount and PKIClientRole may contain {cluster}, replaced by the cluster name as in the database roles,
+	// e.g. pki-{cluster} for a CA per cluster
+	PKIMount      string
+	PKIClientRole string
+
+	RenewInterval time.Duration
+	HTTPClient    *http.Client
+	Log           *logrus.Entry
+
+	logOnce sync.Once
+	mu      sync.Mutex
+	leases  map[string]VaultLease
+	// token is the one in use, which replaces Token after a login
+	token vaultToken
+	now   func() time.Time
+	// serviceAccountTokenPath is the JWT of the Kubernetes login, the one of the pod by default
+	serviceAccountTokenPath string
+}
+
+type vaultToken struct {
+	ID        string
+	Renewable bool
+	// TTL and ExpiresAt are zero for tokens which never expire, such as root tokens
+	TTL       time.Duration
+	ExpiresAt time.Time
+}
+
+// VaultLease of a dynamic secret
+type VaultLease struct {
+	ID        string
+	Renewable bool
+	Duration  time.Duration
+	ExpiresAt time.Time
+	// MaxExpiresAt is set by Options.TTL, the lease is revoked then instead of being renewed
+	MaxExpiresAt time.Time
+}
+
+type vaultSecret struct {
+	LeaseID       string          `json:"lease_id"`
+	Renewable     bool            `json:"renewable"`
+	LeaseDuration int             `json:"lease_duration"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		Renewable     bool   `json:"renewable"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+type vaultErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// vaultResponseError is an error status of the Vault API
+type vaultResponseError struct {
+	StatusCode int
+	Path       string
+	Errors     []string
+}
+
+func (e *vaultResponseError) Error() string {
+	return fmt.Sprintf("vault returned %v for %v: %v", e.StatusCode, e.Path, strings.Join(e.Errors, ", "))
+}
+
+func (v *Vault) Init() error {
+	if v.Address == "" {
+		v.Address = os.Getenv("VAULT_ADDR")
+	}
+	if v.Address == "" {
+		return newError(ErrProviderUnavailable, nil, "vault address is not configured")
+	}
+	if v.Token == "" {
+		v.Token = os.Getenv("VAULT_TOKEN")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultVaultTimeout)
+	defer cancel()
+	if v.Token == "" && v.KubernetesAuthRole != "" {
+		if err := v.loginWithKubernetes(ctx); err != nil {
+			return vaultError(ErrPermissionDenied, err, "could not loginWithKubernetes")
+		}
+	}
+	if v.getToken().ID == "" {
+		return newError(ErrProviderUnavailable, nil, "vault token is not configured")
+	}
+
+	if err := v.lookupToken(ctx); err != nil {
+		return vaultError(ErrPermissionDenied, err, "could not lookup vault token")
+	}
+	return nil
+}
+
+// GetPostgresCredentials requests a dynamic user from the database secrets engine, it is dropped once its lease expires
+func (v *Vault) GetPostgresCredentials(
+	ctx context.Context,
+	clusterName string,
+	username string,
+	options Options,
+) (GetPostgresCredentialsResponse, error) {
+	if username == "" {
+		username = constants.AdminUsername
+	}
+
+	role := getVaultDatabaseRole(options.QualifiedClusterName(clusterName), username, options)
+	secret, err := v.do(ctx, http.MethodGet, fmt.Sprintf("%v/creds/%v", v.getDatabaseMount(), role), nil)
+	if err != nil {
+		return GetPostgresCredentialsResponse{}, vaultError(ErrUserNotFound, err, "could not get credentials for role %v", role)
+	}
+	var data struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(secret.Data, &data); err != nil {
+		return GetPostgresCredentialsResponse{}, newError(ErrSecretMalformed, err, "could not parse credentials for role %v", role)
+	}
+	if data.Username == "" || data.Password == "" {
+		return GetPostgresCredentialsResponse{}, newError(ErrSecretMalformed, nil, "vault returned empty credentials for role %v", role)
+	}
+	lease := v.track(secret)
+	if options.TTL > 0 && lease.ID != "" {
+		lease = v.limit(lease.ID, options.TTL)
+	}
+	duration := lease.Duration
+	if !lease.MaxExpiresAt.IsZero() && lease.MaxExpiresAt.Before(lease.ExpiresAt) {
+		duration = options.TTL
+	}
+	v.getLog().WithFields(logrus.Fields{
+		"role":     role,
+		"lease":    lease.ID,
+		"caller":   options.Caller,
+		"database": options.Database,
+	}).Infof("issued dynamic credentials")
+
+	return GetPostgresCredentialsResponse{
+		Username:      data.Username,
+		Password:      data.Password,
+		LeaseID:       lease.ID,
+		LeaseDuration: duration,
+	}, nil
+}
+
+// GetClusterEndpoint reads the hostname and port keys of borealis/<cluster>/endpoint/<role>
+func (v *Vault) GetClusterEndpoint(ctx context.Context, clusterName, role string) (GetClusterEndpointResponse, error) {
+	if role == "" {
+		role = constants.RoleMaster
+	}
+	data, err := v.readKV(ctx, fmt.Sprintf("borealis/%v/endpoint/%v", clusterName, role))
+	if err != nil {
+		return GetClusterEndpointResponse{}, err
+	}
+	port := data["port"]
+	if port == "" {
+		port = constants.PostgresDefaultPort
+	}
+	return GetClusterEndpointResponse{
+		Hostname: data["hostname"],
+		Port:     port,
+	}, nil
+}
+
+// GetPostgresSSLRootCert returns the CA of the PKI secrets engine
+func (v *Vault) GetPostgresSSLRootCert(ctx context.Context, clusterName string, options Options) (GetPostgresSSLRootCertResponse, error) {
+	ca, err := v.doRaw(ctx, http.MethodGet, fmt.Sprintf("%v/ca/pem", v.getPKIMount(options.QualifiedClusterName(clusterName))), nil)
+	if err != nil {
+		return GetPostgresSSLRootCertResponse{}, vaultError(ErrClusterNotFound, err, "could not get CA")
+	}
+	return GetPostgresSSLRootCertResponse{
+		RootCertBytes: ca,
+	}, nil
+}
+
+// GetPostgresClientCertificate issues a client certificate with the PKIClientRole of the PKI secrets engine,
+// valid for options.TTL when set instead of the TTL of the role
+func (v *Vault) GetPostgresClientCertificate(ctx context.Context, clusterName string, username string, options Options) (GetPostgresClientCertificateResponse, error) {
+	if username == "" {
+		username = constants.AdminUsername
+	}
+	qualifiedClusterName := options.QualifiedClusterName(clusterName)
+	body := map[string]string{
+		"common_name": username,
+	}
+	if options.TTL > 0 {
+		body["ttl"] = fmt.Sprintf("%ds", int64(options.TTL.Seconds()))
+	}
+	path := fmt.Sprintf("%v/issue/%v", v.getPKIMount(qualifiedClusterName), v.getPKIClientRole(qualifiedClusterName))
+	secret, err := v.do(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return GetPostgresClientCertificateResponse{}, vaultError(ErrUserNotFound, err, "could not issue client certificate for user %v", username)
+	}
+	var data struct {
+		Certificate string `json:"certificate"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(secret.Data, &data); err != nil {
+		return GetPostgresClientCertificateResponse{}, newError(ErrSecretMalformed, err, "could not parse client certificate")
+	}
+	return GetPostgresClientCertificateResponse{
+		Username:  username,
+		CertBytes: []byte(data.Certificate),
+		KeyBytes:  []byte(data.PrivateKey),
+	}, nil
+}
+
+// GetClusterCredentials reads the backup keys from borealis/<cluster>/secrets
+func (v *Vault) GetClusterCredentials(ctx context.Context, clusterName string, args Options) (GetClusterCredentialsResponse, error) {
+	path := fmt.Sprintf("borealis/%v/secrets", args.QualifiedClusterName(clusterName))
+	data, err := v.readKV(ctx, path)
+	if err != nil {
+		return GetClusterCredentialsResponse{}, err
+	}
+	previousKeys, err := parseBackupEncryptionKeyHistory([]byte(data[constants.ClusterSecretsBackupEncryptionKeyHistory]), path)
+	if err != nil {
+		return GetClusterCredentialsResponse{}, err
+	}
+	return GetClusterCredentialsResponse{
+		AwsAccessKeyId:               data["awsAccessKeyId"],
+		AwsSecretAccessKey:           data["awsSecretAccessKey"],
+		BackupEncryptionKey:          data[constants.ClusterSecretsBackupEncryptionKey],
+		PreviousBackupEncryptionKeys: previousKeys,
+	}, nil
+}
+
+// Run renews the tracked leases every RenewInterval and revokes them once the context is cancelled
+func (v *Vault) Run(ctx context.Context) error {
+	ticker := time.NewTicker(v.getRenewInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			revokeCtx, cancel := context.WithTimeout(context.Background(), defaultVaultTimeout)
+			defer cancel()
+			if err := v.RevokeLeases(revokeCtx); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-ticker.C:
+			if err := v.RenewToken(ctx); err != nil {
+				v.getLog().WithError(err).Errorf("could not renew vault token")
+			}
+			if err := v.RenewLeases(ctx); err != nil {
+				v.getLog().WithError(err).Errorf("could not renew vault leases")
+			}
+		}
+	}
+}
+
+// RenewToken extends the token once it reached two thirds of its TTL. A token which can not be renewed
+// is replaced by logging in again with the service account, when KubernetesAuthRole is set
+func (v *Vault) RenewToken(ctx context.Context) error {
+	token := v.getToken()
+	now := v.getNow()
+	if token.ExpiresAt.IsZero() || now.Before(token.ExpiresAt.Add(-token.TTL/3)) {
+		return nil
+	}
+
+	var renewErr error
+	if token.Renewable {
+		secret, err := v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{})
+		if err == nil && secret.Auth != nil {
+			v.setToken(token.ID, secret.Auth.Renewable, secret.Auth.LeaseDuration)
+			return nil
+		}
+		renewErr = err
+	}
+	if v.KubernetesAuthRole != "" {
+		if err := v.loginWithKubernetes(ctx); err != nil {
+			return vaultError(ErrPermissionDenied, err, "could not loginWithKubernetes")
+		}
+		v.getLog().Infof("logged in to vault again")
+		return nil
+	}
+	if renewErr != nil {
+		return vaultError(ErrPermissionDenied, renewErr, "could not renew vault token")
+	}
+	return newError(ErrPermissionDenied, nil, "vault token expires at %v and can not be renewed", token.ExpiresAt)
+}
+
+// RenewLeases extends the leases which reached two thirds of their duration.
+// Leases which can not be renewed are forgotten, the applications must ask for new credentials
+func (v *Vault) RenewLeases(ctx context.Context) error {
+	now := v.getNow()
+	var failed []string
+	for _, lease := range v.getLeases() {
+		if !lease.MaxExpiresAt.IsZero() && !now.Before(lease.MaxExpiresAt) {
+			if err := v.RevokeLease(ctx, lease.ID); err != nil {
+				failed = append(failed, err.Error())
+			}
+			continue
+		}
+		if now.Before(lease.ExpiresAt.Add(-lease.Duration / 3)) {
+			continue
+		}
+		if !lease.Renewable || now.After(lease.ExpiresAt) {
+			v.forget(lease.ID)
+			continue
+		}
+		increment := lease.Duration
+		if !lease.MaxExpiresAt.IsZero() && lease.MaxExpiresAt.Sub(now) < increment {
+			increment = lease.MaxExpiresAt.Sub(now)
+		}
+		secret, err := v.do(ctx, http.MethodPut, "sys/leases/renew", map[string]interface{}{
+			"lease_id":  lease.ID,
+			"increment": int(increment.Seconds()),
+		})
+		if err != nil {
+			v.forget(lease.ID)
+			failed = append(failed, fmt.Sprintf("could not renew lease %v: %v", lease.ID, err))
+			continue
+		}
+		v.track(secret)
+	}
+	if len(failed) > 0 {
+		return newError(ErrProviderUnavailable, nil, "%v", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// RevokeLease revokes a single lease, the dynamic user is dropped right away
+func (v *Vault) RevokeLease(ctx context.Context, leaseID string) error {
+	if _, err := v.do(ctx, http.MethodPut, "sys/leases/revoke", map[string]string{"lease_id": leaseID}); err != nil {
+		return vaultError(nil, err, "could not revoke lease %v", leaseID)
+	}
+	v.forget(leaseID)
+	return nil
+}
+
+// RevokeLeases revokes every tracked lease
+func (v *Vault) RevokeLeases(ctx context.Context) error {
+	var failed []string
+	for _, lease := range v.getLeases() {
+		if err := v.RevokeLease(ctx, lease.ID); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return newError(ErrProviderUnavailable, nil, "could not revoke every lease: %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Leases returns the tracked leases
+func (v *Vault) Leases() []VaultLease {
+	return v.getLeases()
+}
+
+// LeaseExpiry returns when a tracked lease expires, unless it is renewed before, or when it is revoked for its TTL
+func (v *Vault) LeaseExpiry(leaseID string) (time.Time, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	lease, ok := v.leases[leaseID]
+	if !lease.MaxExpiresAt.IsZero() && lease.MaxExpiresAt.Before(lease.ExpiresAt) {
+		return lease.MaxExpiresAt, ok
+	}
+	return lease.ExpiresAt, ok
+}
+
+// ReleaseLease stops renewing the lease of credentials which are not used anymore, the dynamic user is dropped
+// once the lease expires. It is not revoked right away, as the Cache may have handed the credentials to others
+func (v *Vault) ReleaseLease(leaseID string) {
+	v.forget(leaseID)
+}
+
+// lookupToken reads the TTL of the token
+func (v *Vault) lookupToken(ctx context.Context) error {
+	secret, err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil)
+	if err != nil {
+		return err
+	}
+	var data struct {
+		TTL       int  `json:"ttl"`
+		Renewable bool `json:"renewable"`
+	}
+	if err := json.Unmarshal(secret.Data, &data); err != nil {
+		return newError(ErrSecretMalformed, err, "could not parse token")
+	}
+	v.setToken(v.getToken().ID, data.Renewable, data.TTL)
+	return nil
+}
+
+func (v *Vault) loginWithKubernetes(ctx context.Context) error {
+	jwt, err := os.ReadFile(v.getServiceAccountTokenPath())
+	if err != nil {
+		return newError(ErrPermissionDenied, err, "could not read service account token")
+	}
+	mount := v.KubernetesAuthMount
+	if mount == "" {
+		mount = defaultVaultKubernetesAuthMount
+	}
+	secret, err := v.do(ctx, http.MethodPost, fmt.Sprintf("auth/%v/login", mount), map[string]string{
+		"role": v.KubernetesAuthRole,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return err
+	}
+	if secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return newError(ErrPermissionDenied, nil, "vault did not return a token")
+	}
+	v.setToken(secret.Auth.ClientToken, secret.Auth.Renewable, secret.Auth.LeaseDuration)
+	return nil
+}
+
+// getToken returns the token in use, Token until the first login
+func (v *Vault) getToken() vaultToken {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token.ID == "" {
+		return vaultToken{ID: v.Token}
+	}
+	return v.token
+}
+
+func (v *Vault) setToken(id string, renewable bool, ttlSeconds int) {
+	token := vaultToken{ID: id, Renewable: renewable, TTL: time.Duration(ttlSeconds) * time.Second}
+	if token.TTL > 0 {
+		token.ExpiresAt = v.getNow().Add(token.TTL)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.token = token
+}
+
+func (v *Vault) readKV(ctx context.Context, path string) (map[string]string, error) {
+	secret, err := v.do(ctx, http.MethodGet, fmt.Sprintf("%v/data/%v", v.getKVMount(), path), nil)
+	if err != nil {
+		return nil, vaultError(ErrClusterNotFound, err, "could not read secret %v", path)
+	}
+	var kv struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(secret.Data, &kv); err != nil {
+		return nil, newError(ErrSecretMalformed, err, "could not parse secret %v", path)
+	}
+	return decodeSecretValues(kv.Data), nil
+}
+
+func (v *Vault) track(secret vaultSecret) VaultLease {
+	lease := VaultLease{
+		ID:        secret.LeaseID,
+		Renewable: secret.Renewable,
+		Duration:  time.Duration(secret.LeaseDuration) * time.Second,
+	}
+	lease.ExpiresAt = v.getNow().Add(lease.Duration)
+	if lease.ID == "" {
+		return lease
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.leases == nil {
+		v.leases = map[string]VaultLease{}
+	}
+	// Renewals keep the limit set by the TTL of the request
+	lease.MaxExpiresAt = v.leases[lease.ID].MaxExpiresAt
+	v.leases[lease.ID] = lease
+	return lease
+}
+
+// limit sets the time after which a tracked lease is revoked
+func (v *Vault) limit(leaseID string, ttl time.Duration) VaultLease {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	lease := v.leases[leaseID]
+	lease.MaxExpiresAt = v.getNow().Add(ttl)
+	v.leases[leaseID] = lease
+	return lease
+}
+
+// getVaultDatabaseRole returns the role of the database secrets engine, which can not contain slashes
+func getVaultDatabaseRole(clusterName, username string, options Options) string {
+	role := fmt.Sprintf("%v-%v", getVaultClusterName(clusterName), username)
+	if options.isReplica() {
+		role = fmt.Sprintf("%v-%v", role, vaultReadOnlyRoleSuffix)
+	}
+	return role
+}
+
+// getVaultClusterName replaces the slash of qualified cluster names, which would nest mounts and roles
+func getVaultClusterName(clusterName string) string {
+	return strings.ReplaceAll(clusterName, "/", "-")
+}
+
+// expandVaultClusterName replaces {cluster} in a mount or role template
+func expandVaultClusterName(template, clusterName string) string {
+	return strings.ReplaceAll(template, vaultClusterPlaceholder, getVaultClusterName(clusterName))
+}
+
+func (v *Vault) forget(leaseID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.leases, leaseID)
+}
+
+func (v *Vault) getLeases() []VaultLease {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	leases := make([]VaultLease, 0, len(v.leases))
+	for _, lease := range v.leases {
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+func (v *Vault) do(ctx context.Context, method, path string, body interface{}) (vaultSecret, error) {
+	content, err := v.doRaw(ctx, method, path, body)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+	var secret vaultSecret
+	if len(content) == 0 {
+		return secret, nil
+	}
+	if err := json.Unmarshal(content, &secret); err != nil {
+		return vaultSecret{}, newError(ErrSecretMalformed, err, "could not parse vault response")
+	}
+	return secret, nil
+}
+
+func (v *Vault) doRaw(ctx context.Context, method, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(content)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%v/v1/%v", strings.TrimSuffix(v.Address, "/"), path), reader)
+	if err != nil {
+		return nil, err
+	}
+	if token := v.getToken().ID; token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.getHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		var errs vaultErrors
+		_ = json.Unmarshal(content, &errs)
+		return nil, &vaultResponseError{StatusCode: resp.StatusCode, Path: path, Errors: errs.Errors}
+	}
+	return content, nil
+}
+
+func (v *Vault) getHTTPClient() *http.Client {
+	if v.HTTPClient == nil {
+		return &http.Client{Timeout: defaultVaultTimeout}
+	}
+	return v.HTTPClient
+}
+
+func (v *Vault) getKVMount() string {
+	if v.KVMount == "" {
+		return defaultVaultKVMount
+	}
+	return v.KVMount
+}
+
+func (v *Vault) getDatabaseMount() string {
+	if v.DatabaseMount == "" {
+		return defaultVaultDatabaseMount
+	}
+	return v.DatabaseMount
+}
+
+func (v *Vault) getPKIMount(clusterName string) string {
+	if v.PKIMount == "" {
+		return defaultVaultPKIMount
+	}
+	return expandVaultClusterName(v.PKIMount, clusterName)
+}
+
+func (v *Vault) getPKIClientRole(clusterName string) string {
+	if v.PKIClientRole == "" {
+		return defaultVaultPKIClientRole
+	}
+	return expandVaultClusterName(v.PKIClientRole, clusterName)
+}
+
+func (v *Vault) getLog() *logrus.Entry {
+	v.logOnce.Do(func() {
+		if v.Log == nil {
+			v.Log = logger.NewDefaultLogger("info", "credentials")
+		}
+	})
+	return v.Log
+}
+
+func (v *Vault) getNow() time.Time {
+	if v.now == nil {
+		return time.Now()
+	}
+	return v.now()
+}
+
+func (v *Vault) getServiceAccountTokenPath() string {
+	if v.serviceAccountTokenPath == "" {
+		return vaultServiceAccountTokenPath
+	}
+	return v.serviceAccountTokenPath
+}
+
+func (v *Vault) getRenewInterval() time.Duration {
+	if v.RenewInterval <= 0 {
+		return defaultVaultRenewInterval
+	}
+	return v.RenewInterval
+}
@@ -0,0 +1,298 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeVaultToken = "s.test"
+
+// fakeVault serves the subset of the Vault API used by the provider
+type fakeVault struct {
+	mu      sync.Mutex
+	leases  map[string]bool
+	renewed int
+	// tokenRenewable tells whether the token can be renewed, otherwise the provider must log in again
+	tokenRenewable bool
+	tokenRenewed   int
+	logins         int
+	// issued are the request bodies of the client certificates
+	issued []map[string]interface{}
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	fake := &fakeVault{leases: map[string]bool{}, tokenRenewable: true}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/auth/kubernetes/login" {
+		f.mu.Lock()
+		f.logins++
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": fakeVaultToken, "renewable": true, "lease_duration": 60},
+		})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != fakeVaultToken {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch r.URL.Path {
+	case "/v1/auth/token/lookup-self":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"id": fakeVaultToken, "ttl": 60, "renewable": f.tokenRenewable},
+		})
+	case "/v1/auth/token/renew-self":
+		if !f.tokenRenewable {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"token is not renewable"}})
+			return
+		}
+		f.tokenRenewed++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": fakeVaultToken, "renewable": true, "lease_duration": 60},
+		})
+	case "/v1/database/creds/mycluster-application":
+		f.leases["database/creds/mycluster-application/1"] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_id":       "database/creds/mycluster-application/1",
+			"renewable":      true,
+			"lease_duration": 30,
+			"data":           map[string]string{"username": "v-application-1", "password": "secret"},
+		})
+	case "/v1/database/creds/mycluster-application-readonly":
+		f.leases["database/creds/mycluster-application-readonly/1"] = true
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_id":       "database/creds/mycluster-application-readonly/1",
+			"renewable":      true,
+			"lease_duration": 30,
+			"data":           map[string]string{"username": "v-application-ro-1", "password": "secret"},
+		})
+	case "/v1/secret/data/borealis/mycluster/secrets":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data": map[string]interface{}{
+					"awsAccessKeyId":             "id",
+					"awsSecretAccessKey":         "key",
+					"backupEncryptionKey":        "encryption",
+					"backupEncryptionKeyHistory": []map[string]string{{"key": "retired"}},
+				},
+			},
+		})
+	case "/v1/secret/data/borealis/mycluster/endpoint/master":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": map[string]string{"hostname": "mycluster.example.org"}},
+		})
+	case "/v1/pki/ca/pem":
+		w.Write([]byte("-----BEGIN CERTIFICATE-----"))
+	case "/v1/pki-test-mycluster/ca/pem":
+		w.Write([]byte("-----BEGIN CERTIFICATE----- mycluster"))
+	case "/v1/pki-test-mycluster/issue/test-mycluster-client":
+		f.issued = append(f.issued, body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]string{"certificate": "certificate", "private_key": "key"},
+		})
+	case "/v1/sys/leases/renew":
+		if !f.leases[body["lease_id"].(string)] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"lease not found"}})
+			return
+		}
+		f.renewed++
+		json.NewEncoder(w).Encode(map[string]interface{}{"lease_id": body["lease_id"], "renewable": true, "lease_duration": 3})
+	case "/v1/sys/leases/revoke":
+		delete(f.leases, body["lease_id"].(string))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {}})
+	}
+}
+
+func TestVault(t *testing.T) {
+	fake, server := newFakeVault(t)
+	ctx := context.Background()
+
+	if err := (&Vault{Address: server.URL, Token: "wrong"}).Init(); err == nil {
+		t.Errorf("Init() with a wrong token should fail")
+	}
+	vault := &Vault{Address: server.URL, Token: fakeVaultToken}
+	if err := vault.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	postgresCredentials, err := vault.GetPostgresCredentials(ctx, "mycluster", "application", Options{})
+	if err != nil {
+		t.Fatalf("GetPostgresCredentials() error = %v", err)
+	}
+	if postgresCredentials.Username != "v-application-1" || postgresCredentials.Password != "secret" {
+		t.Errorf("GetPostgresCredentials() = %+v", postgresCredentials)
+	}
+	if postgresCredentials.LeaseDuration != 30*time.Second {
+		t.Errorf("LeaseDuration = %v, want 30s", postgresCredentials.LeaseDuration)
+	}
+	if _, err := vault.GetPostgresCredentials(ctx, "mycluster", "unknown", Options{}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetPostgresCredentials() for an unknown role error = %v, want ErrUserNotFound", err)
+	}
+
+	clusterCredentials, err := vault.GetClusterCredentials(ctx, "mycluster", Options{})
+	if err != nil {
+		t.Fatalf("GetClusterCredentials() error = %v", err)
+	}
+	if clusterCredentials.BackupEncryptionKey != "encryption" || clusterCredentials.AwsAccessKeyId != "id" ||
+		len(clusterCredentials.PreviousBackupEncryptionKeys) != 1 || clusterCredentials.PreviousBackupEncryptionKeys[0] != "retired" {
+		t.Errorf("GetClusterCredentials() = %+v", clusterCredentials)
+	}
+
+	endpoint, err := vault.GetClusterEndpoint(ctx, "mycluster", "")
+	if err != nil {
+		t.Fatalf("GetClusterEndpoint() error = %v", err)
+	}
+	if endpoint.Hostname != "mycluster.example.org" || endpoint.Port != "5432" {
+		t.Errorf("GetClusterEndpoint() = %+v", endpoint)
+	}
+
+	rootCert, err := vault.GetPostgresSSLRootCert(ctx, "mycluster", Options{})
+	if err != nil {
+		t.Fatalf("GetPostgresSSLRootCert() error = %v", err)
+	}
+	if string(rootCert.RootCertBytes) != "-----BEGIN CERTIFICATE-----" {
+		t.Errorf("GetPostgresSSLRootCert() = %s", rootCert.RootCertBytes)
+	}
+
+	if err := vault.RenewLeases(ctx); err != nil {
+		t.Fatalf("RenewLeases() error = %v", err)
+	}
+	if fake.renewed != 0 {
+		t.Errorf("lease renewed %v times before two thirds of its duration", fake.renewed)
+	}
+	vault.now = func() time.Time { return time.Now().Add(25 * time.Second) }
+	if err := vault.RenewLeases(ctx); err != nil {
+		t.Fatalf("RenewLeases() error = %v", err)
+	}
+	if fake.renewed != 1 {
+		t.Errorf("renewed %v leases, want 1", fake.renewed)
+	}
+
+	vault.ReleaseLease(postgresCredentials.LeaseID)
+	if _, ok := vault.LeaseExpiry(postgresCredentials.LeaseID); ok {
+		t.Errorf("released lease %v is still renewed", postgresCredentials.LeaseID)
+	}
+	if !fake.leases[postgresCredentials.LeaseID] {
+		t.Errorf("released lease %v has been revoked, it must expire on its own", postgresCredentials.LeaseID)
+	}
+	delete(fake.leases, postgresCredentials.LeaseID)
+
+	if err := vault.RevokeLeases(ctx); err != nil {
+		t.Fatalf("RevokeLeases() error = %v", err)
+	}
+	if len(fake.leases) != 0 || len(vault.Leases()) != 0 {
+		t.Errorf("leases have not been revoked")
+	}
+
+	replica, err := vault.GetPostgresCredentials(ctx, "mycluster", "application", Options{Role: "replica", TTL: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("GetPostgresCredentials() for a replica error = %v", err)
+	}
+	if replica.Username != "v-application-ro-1" || replica.LeaseDuration != 10*time.Second {
+		t.Errorf("GetPostgresCredentials() for a replica = %+v", replica)
+	}
+	vault.now = func() time.Time { return time.Now().Add(35 * time.Second) }
+	if err := vault.RenewLeases(ctx); err != nil {
+		t.Fatalf("RenewLeases() error = %v", err)
+	}
+	if fake.leases[replica.LeaseID] {
+		t.Errorf("lease %v has not been revoked after its TTL", replica.LeaseID)
+	}
+}
+
+func TestVault_RenewToken(t *testing.T) {
+	fake, server := newFakeVault(t)
+	ctx := context.Background()
+
+	vault := &Vault{Address: server.URL, Token: fakeVaultToken}
+	if err := vault.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	if err := vault.RenewToken(ctx); err != nil || fake.tokenRenewed != 0 {
+		t.Fatalf("RenewToken() before two thirds of the TTL renewed %v times, error = %v", fake.tokenRenewed, err)
+	}
+	vault.now = func() time.Time { return time.Now().Add(45 * time.Second) }
+	if err := vault.RenewToken(ctx); err != nil {
+		t.Fatalf("RenewToken() error = %v", err)
+	}
+	if fake.tokenRenewed != 1 {
+		t.Errorf("token renewed %v times, want 1", fake.tokenRenewed)
+	}
+
+	// A token which can not be renewed anymore is replaced by a login
+	fake.tokenRenewable = false
+	vault.now = func() time.Time { return time.Now().Add(90 * time.Second) }
+	if err := vault.RenewToken(ctx); err == nil {
+		t.Errorf("RenewToken() without a Kubernetes role should fail")
+	}
+	jwtPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwtPath, []byte("jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	vault.KubernetesAuthRole = "borealis"
+	vault.serviceAccountTokenPath = jwtPath
+	if err := vault.RenewToken(ctx); err != nil {
+		t.Fatalf("RenewToken() error = %v", err)
+	}
+	if fake.logins != 1 {
+		t.Errorf("logged in %v times, want 1", fake.logins)
+	}
+	if token := vault.getToken(); !token.ExpiresAt.After(time.Now().Add(120 * time.Second)) {
+		t.Errorf("token expires at %v after the login", token.ExpiresAt)
+	}
+}
+
+func TestVault_ClusterPKI(t *testing.T) {
+	fake, server := newFakeVault(t)
+	ctx := context.Background()
+	vault := &Vault{Address: server.URL, Token: fakeVaultToken, PKIMount: "pki-{cluster}", PKIClientRole: "{cluster}-client"}
+	if err := vault.Init(); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	options := Options{Namespace: "test", TTL: time.Hour}
+	rootCert, err := vault.GetPostgresSSLRootCert(ctx, "mycluster", options)
+	if err != nil {
+		t.Fatalf("GetPostgresSSLRootCert() error = %v", err)
+	}
+	if string(rootCert.RootCertBytes) != "-----BEGIN CERTIFICATE----- mycluster" {
+		t.Errorf("GetPostgresSSLRootCert() = %s", rootCert.RootCertBytes)
+	}
+	clientCert, err := vault.GetPostgresClientCertificate(ctx, "mycluster", "application", options)
+	if err != nil {
+		t.Fatalf("GetPostgresClientCertificate() error = %v", err)
+	}
+	if string(clientCert.CertBytes) != "certificate" || string(clientCert.KeyBytes) != "key" {
+		t.Errorf("GetPostgresClientCertificate() = %+v", clientCert)
+	}
+	if len(fake.issued) != 1 || fake.issued[0]["common_name"] != "application" || fake.issued[0]["ttl"] != "3600s" {
+		t.Errorf("issue requests = %v", fake.issued)
+	}
+	if _, err := vault.GetPostgresSSLRootCert(ctx, "othercluster", options); !errors.Is(err, ErrClusterNotFound) {
+		t.Errorf("GetPostgresSSLRootCert() of another cluster error = %v, want ErrClusterNotFound", err)
+	}
+}
@@ -65,6 +65,21 @@ func (mr *MockCredentialsMockRecorder) GetClusterEndpoint(ctx, clusterName, role
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetClusterEndpoint", reflect.TypeOf((*MockCredentials)(nil).GetClusterEndpoint), ctx, clusterName, role)
 }
 
+// GetPostgresClientCertificate mocks base method.
+func (m *MockCredentials) GetPostgresClientCertificate(ctx context.Context, clusterName, username string, options credentials.Options) (credentials.GetPostgresClientCertificateResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPostgresClientCertificate", ctx, clusterName, username, options)
+	ret0, _ := ret[0].(credentials.GetPostgresClientCertificateResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPostgresClientCertificate indicates an expected call of GetPostgresClientCertificate.
+func (mr *MockCredentialsMockRecorder) GetPostgresClientCertificate(ctx, clusterName, username, options interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPostgresClientCertificate", reflect.TypeOf((*MockCredentials)(nil).GetPostgresClientCertificate), ctx, clusterName, username, options)
+}
+
 // GetPostgresCredentials mocks base method.
 func (m *MockCredentials) GetPostgresCredentials(ctx context.Context, clusterName, username string, options credentials.Options) (credentials.GetPostgresCredentialsResponse, error) {
 	m.ctrl.T.Helper()
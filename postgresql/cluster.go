@@ -0,0 +1,239 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/credentials"
+	"github.com/borealisdb/commons/logger"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMaxReplicationLag = 10 * time.Second
+	DefaultLagCheckInterval  = 5 * time.Second
+
+	// replicationLagQuery returns whether a replica streams from the primary, whether it has replayed everything
+	// it received and the delay of the last replayed transaction in seconds
+	replicationLagQuery = `SELECT COALESCE((SELECT status = 'streaming' FROM pg_stat_wal_receiver), false),
+		COALESCE(pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn(), false),
+		COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)`
+)
+
+type roleContextKey struct{}
+
+// WithRole overrides the routing of the reads made with the context: constants.RoleMaster reads its own writes,
+// constants.RoleReplica reads from the replicas whatever their lag
+func WithRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleContextKey{}, role)
+}
+
+// RoleFromContext returns the role set by WithRole, if any
+func RoleFromContext(ctx context.Context) (string, bool) {
+	role, ok := ctx.Value(roleContextKey{}).(string)
+	return role, ok
+}
+
+// ClusterClient holds pools to the master and the replicas of a cluster, reads go to the replicas unless
+// they lag behind by more than MaxReplicationLag and writes go to the master
+type ClusterClient struct {
+	CredentialsProvider credentials.Credentials
+	ClusterName         string
+	Username            string
+	// Options of both pools, Role is set for each of them
+	Options           Options
+	MaxReplicationLag time.Duration
+	LagCheckInterval  time.Duration
+	Log               *logrus.Entry
+
+	master  *Pool
+	replica *Pool
+
+	logOnce        sync.Once
+	mu             sync.RWMutex
+	replicaHealthy bool
+	replicaLag     time.Duration
+
+	// newPostgres returns the Postgresql of a pool, a PG of CredentialsProvider by default
+	newPostgres func() Postgresql
+}
+
+// Open connects to the master, it fails when it can not. The replicas are optional, reads go to the master without them
+func (c *ClusterClient) Open(ctx context.Context) error {
+	c.master = c.newPool(constants.RoleMaster)
+	if err := c.master.Open(ctx); err != nil {
+		return fmt.Errorf("could not open master pool: %w", err)
+	}
+
+	c.replica = c.newPool(constants.RoleReplica)
+	if err := c.replica.Open(ctx); err != nil {
+		c.getLog().WithError(err).Warnf("could not open replica pool of cluster %v, reads go to the master", c.ClusterName)
+		return nil
+	}
+	c.CheckReplicationLag(ctx)
+	return nil
+}
+
+// Run health checks the pools and the replication lag until the context is done
+func (c *ClusterClient) Run(ctx context.Context) {
+	go c.master.Run(ctx)
+	go c.replica.Run(ctx)
+
+	ticker := time.NewTicker(c.getLagCheckInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.CheckReplicationLag(ctx)
+		}
+	}
+}
+
+// Writer returns the master pool
+func (c *ClusterClient) Writer() *sqlx.DB {
+	return c.master.DB()
+}
+
+// Reader returns the pool reads should use, see WithRole for the overrides
+func (c *ClusterClient) Reader(ctx context.Context) *sqlx.DB {
+	role, _ := RoleFromContext(ctx)
+	switch role {
+	case constants.RoleMaster:
+		return c.master.DB()
+	case constants.RoleReplica:
+		if db := c.replica.DB(); db != nil {
+			return db
+		}
+		return c.master.DB()
+	}
+
+	c.mu.RLock()
+	healthy := c.replicaHealthy
+	c.mu.RUnlock()
+	if db := c.replica.DB(); healthy && db != nil {
+		return db
+	}
+	return c.master.DB()
+}
+
+// HandleError fails over the pools when the error of a query calls for it, e.g. after Patroni promoted a replica,
+// and tells whether it did
+func (c *ClusterClient) HandleError(ctx context.Context, err error) bool {
+	if !c.master.HandleError(ctx, err) {
+		return false
+	}
+	// The former master may now be a replica, and a replica the master
+	if c.replica.DB() != nil {
+		if failoverErr := c.replica.Failover(ctx); failoverErr != nil {
+			c.getLog().WithError(failoverErr).Warnf("could not fail over the replica pool of cluster %v", c.ClusterName)
+		}
+	}
+	return true
+}
+
+// ReplicationLag returns the last measured lag of the replicas, and whether they are used for reads
+func (c *ClusterClient) ReplicationLag() (time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.replicaLag, c.replicaHealthy
+}
+
+// CheckReplicationLag measures the lag of the replicas, which are left out of the reads when it is too high
+func (c *ClusterClient) CheckReplicationLag(ctx context.Context) {
+	db := c.replica.DB()
+	if db == nil {
+		if err := c.replica.Open(ctx); err != nil {
+			c.setReplicaState(0, false)
+			return
+		}
+		db = c.replica.DB()
+	}
+
+	var streaming, replayedAll bool
+	var seconds sql.NullFloat64
+	if err := db.QueryRowContext(ctx, replicationLagQuery).Scan(&streaming, &replayedAll, &seconds); err != nil {
+		c.getLog().WithError(err).Warnf("could not check the replication lag of cluster %v, reads go to the master", c.ClusterName)
+		c.setReplicaState(0, false)
+		return
+	}
+	// A disconnected replica has replayed everything it received but misses what the primary wrote since
+	var lag time.Duration
+	if !streaming || !replayedAll {
+		lag = time.Duration(seconds.Float64 * float64(time.Second))
+	}
+	healthy := lag <= c.getMaxReplicationLag()
+	if !healthy {
+		c.getLog().WithField("lag", lag).Warnf("replicas of cluster %v lag behind, reads go to the master", c.ClusterName)
+	}
+	c.setReplicaState(lag, healthy)
+}
+
+func (c *ClusterClient) setReplicaState(lag time.Duration, healthy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replicaLag, c.replicaHealthy = lag, healthy
+}
+
+func (c *ClusterClient) Close() error {
+	var replicaErr error
+	if c.replica != nil {
+		replicaErr = c.replica.Close()
+	}
+	if c.master != nil {
+		if err := c.master.Close(); err != nil {
+			return err
+		}
+	}
+	return replicaErr
+}
+
+func (c *ClusterClient) newPool(role string) *Pool {
+	options := c.Options
+	options.Role = role
+	return &Pool{
+		Postgres:    c.getNewPostgres()(),
+		ClusterName: c.ClusterName,
+		Username:    c.Username,
+		Options:     options,
+		Log:         c.getLog(),
+	}
+}
+
+func (c *ClusterClient) getNewPostgres() func() Postgresql {
+	if c.newPostgres == nil {
+		return func() Postgresql {
+			return &PG{CredentialsProvider: c.CredentialsProvider}
+		}
+	}
+	return c.newPostgres
+}
+
+func (c *ClusterClient) getMaxReplicationLag() time.Duration {
+	if c.MaxReplicationLag <= 0 {
+		return DefaultMaxReplicationLag
+	}
+	return c.MaxReplicationLag
+}
+
+func (c *ClusterClient) getLagCheckInterval() time.Duration {
+	if c.LagCheckInterval <= 0 {
+		return DefaultLagCheckInterval
+	}
+	return c.LagCheckInterval
+}
+
+func (c *ClusterClient) getLog() *logrus.Entry {
+	c.logOnce.Do(func() {
+		if c.Log == nil {
+			c.Log = logger.NewDefaultLogger("info", "postgresql")
+		}
+	})
+	return c.Log
+}
@@ -0,0 +1,59 @@
+package postgresql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+)
+
+func TestClusterClient_Reader(t *testing.T) {
+	tests := []struct {
+		name         string
+		noReplica    bool
+		lag          float64
+		disconnected bool
+		role         string
+		want         string
+	}{
+		{name: "reads go to the replicas", want: constants.RoleReplica},
+		{name: "lagging replicas", lag: 30, want: constants.RoleMaster},
+		{name: "replicas disconnected from the master", lag: 30, disconnected: true, want: constants.RoleMaster},
+		{name: "read your writes", role: constants.RoleMaster, want: constants.RoleMaster},
+		{name: "replicas whatever their lag", lag: 30, role: constants.RoleReplica, want: constants.RoleReplica},
+		{name: "no replica", noReplica: true, want: constants.RoleMaster},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			testServer.setPassword("secret")
+			testServer.setLag(tt.lag, tt.disconnected)
+			defer testServer.setLag(0, false)
+
+			client := &ClusterClient{
+				ClusterName:       "mycluster",
+				Username:          "analyst",
+				MaxReplicationLag: 5 * time.Second,
+				newPostgres: func() Postgresql {
+					return fakePostgres{noReplica: tt.noReplica}
+				},
+			}
+			if err := client.Open(ctx); err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer client.Close()
+
+			if tt.role != "" {
+				ctx = WithRole(ctx, tt.role)
+			}
+			got := constants.RoleReplica
+			if client.Reader(ctx) == client.Writer() {
+				got = constants.RoleMaster
+			}
+			if got != tt.want {
+				t.Errorf("Reader() went to %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/avast/retry-go"
+	"github.com/borealisdb/commons/constants"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	DefaultFailoverAttempts = 10
+	DefaultFailoverDelay    = 500 * time.Millisecond
+	DefaultFailoverMaxDelay = 10 * time.Second
+
+	recoveryQuery = "SELECT pg_is_in_recovery()"
+)
+
+// errWrongRole is returned when a pool reaches a server which is not of its role, e.g. a demoted master
+var errWrongRole = errors.New("server is not of the expected role")
+
+// SQLSTATEs of the errors raised by a server which is demoted, shut down or restarting
+var failoverCodes = map[pq.ErrorCode]bool{
+	"25006": true, // read_only_sql_transaction
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// IsFailoverError tells whether an error means that the server no longer has the role it was connected for,
+// or can not be reached anymore
+func IsFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errWrongRole) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 are connection exceptions
+		return failoverCodes[pqErr.Code] || pqErr.Code.Class() == "08"
+	}
+	return false
+}
+
+// HandleError fails over when the error of a query calls for it, and tells whether it did
+func (p *Pool) HandleError(ctx context.Context, err error) bool {
+	if !IsFailoverError(err) {
+		return false
+	}
+	if failoverErr := p.Failover(ctx); failoverErr != nil {
+		p.getLog().WithError(failoverErr).Errorf("could not fail over to the new %v of cluster %v", p.getRole(), p.ClusterName)
+	}
+	return true
+}
+
+// Failover re-resolves the endpoint of the cluster and reopens the pool with backoff, until it reaches a server of its role.
+// Concurrent calls fail over once
+func (p *Pool) Failover(ctx context.Context) error {
+	p.failoverMu.Lock()
+	defer p.failoverMu.Unlock()
+	if db := p.DB(); db != nil && p.verifyRole(ctx, db) == nil {
+		return nil
+	}
+
+	p.getLog().WithField("cluster", p.ClusterName).Warnf("lost the %v, failing over", p.getRole())
+	return retry.Do(
+		func() error {
+			p.invalidateEndpoint()
+			return p.Reopen(ctx)
+		},
+		retry.Context(ctx),
+		retry.Attempts(p.getFailoverAttempts()),
+		retry.Delay(p.getFailoverDelay()),
+		retry.MaxDelay(p.getFailoverMaxDelay()),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+	)
+}
+
+// verifyRole checks with pg_is_in_recovery that the pool reaches a server of its role
+func (p *Pool) verifyRole(ctx context.Context, db *sqlx.DB) error {
+	var inRecovery bool
+	if err := db.QueryRowContext(ctx, recoveryQuery).Scan(&inRecovery); err != nil {
+		return fmt.Errorf("could not check the role of the server: %w", err)
+	}
+	if inRecovery != (p.getRole() == constants.RoleReplica) {
+		return fmt.Errorf("%w: want %v, in recovery %v", errWrongRole, p.getRole(), inRecovery)
+	}
+	return nil
+}
+
+// invalidateEndpoint drops the cached endpoint of the cluster, if the credentials provider caches it
+func (p *Pool) invalidateEndpoint() {
+	pg, ok := p.Postgres.(*PG)
+	if !ok {
+		return
+	}
+	if cache, ok := pg.CredentialsProvider.(interface{ Invalidate(clusterName string) }); ok {
+		cache.Invalidate(p.ClusterName)
+	}
+}
+
+func (p *Pool) getRole() string {
+	if p.Options.Role == "" {
+		return constants.RoleMaster
+	}
+	return p.Options.Role
+}
+
+func (p *Pool) getFailoverAttempts() uint {
+	if p.FailoverAttempts == 0 {
+		return DefaultFailoverAttempts
+	}
+	return p.FailoverAttempts
+}
+
+func (p *Pool) getFailoverDelay() time.Duration {
+	if p.FailoverDelay <= 0 {
+		return DefaultFailoverDelay
+	}
+	return p.FailoverDelay
+}
+
+func (p *Pool) getFailoverMaxDelay() time.Duration {
+	if p.FailoverMaxDelay <= 0 {
+		return DefaultFailoverMaxDelay
+	}
+	return p.FailoverMaxDelay
+}
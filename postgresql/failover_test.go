@@ -0,0 +1,79 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestIsFailoverError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "no error", err: nil, want: false},
+		{name: "read only transaction", err: &pq.Error{Code: "25006"}, want: true},
+		{name: "admin shutdown", err: fmt.Errorf("could not query: %w", &pq.Error{Code: "57P01"}), want: true},
+		{name: "connection exception", err: &pq.Error{Code: "08006"}, want: true},
+		{name: "bad connection", err: driver.ErrBadConn, want: true},
+		{name: "unique violation", err: &pq.Error{Code: "23505"}, want: false},
+		{name: "other error", err: errors.New("boom"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsFailoverError(tt.err); got != tt.want {
+				t.Errorf("IsFailoverError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPool_Failover(t *testing.T) {
+	ctx := context.Background()
+	testServer.setPassword("secret")
+	defer testServer.failover("master", 0)
+
+	pool := &Pool{
+		Postgres:      fakePostgres{},
+		ClusterName:   "mycluster",
+		Username:      "application",
+		FailoverDelay: time.Millisecond,
+	}
+	if err := pool.Open(ctx); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer pool.Close()
+	first := pool.DB()
+
+	if pool.HandleError(ctx, &pq.Error{Code: "23505"}) || pool.DB() != first {
+		t.Fatalf("HandleError() failed over on a unique violation")
+	}
+
+	// The endpoint still resolves to the demoted master twice, the backoff must retry until the new one is reached
+	testServer.failover("new-master", 2)
+	if !pool.HandleError(ctx, &pq.Error{Code: "25006", Message: "cannot execute INSERT in a read-only transaction"}) {
+		t.Fatalf("HandleError() did not fail over on a read-only transaction")
+	}
+	if pool.DB() == first {
+		t.Fatalf("pool has not been reopened")
+	}
+	if err := pool.verifyRole(ctx, pool.DB()); err != nil {
+		t.Errorf("pool does not reach the new master: %v", err)
+	}
+
+	// Health checks detect the failover without any query failing
+	second := pool.DB()
+	testServer.failover("master", 0)
+	if err := pool.HealthCheck(ctx); err != nil {
+		t.Fatalf("HealthCheck() error = %v", err)
+	}
+	if pool.DB() == second || pool.verifyRole(ctx, pool.DB()) != nil {
+		t.Errorf("HealthCheck() did not fail over to the master")
+	}
+}
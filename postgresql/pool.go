@@ -0,0 +1,361 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/borealisdb/commons/credentials"
+	"github.com/borealisdb/commons/logger"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	// DefaultMaxIdleConns is the database/sql default, kept when PoolSettings.MaxIdleConns is unset
+	DefaultMaxIdleConns = 2
+
+	// invalidPasswordCode is the SQLSTATE of a rejected password, the credentials have likely been rotated
+	invalidPasswordCode = "28P01"
+)
+
+// PoolSettings of the database/sql connection pool. Unset counts keep the database/sql defaults, unlimited open
+// and DefaultMaxIdleConns idle connections, unset durations no limit.
+// PG.Connect and V2.Connect keep a single connection when the counts are unset, as they always did
+type PoolSettings struct {
+	MaxIdleConns    int
+	MaxOpenConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+func (s PoolSettings) apply(db *sqlx.DB) {
+	maxIdleConns := s.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = DefaultMaxIdleConns
+	}
+	db.SetMaxIdleConns(maxIdleConns)
+	// A count of zero leaves the open connections unlimited
+	db.SetMaxOpenConns(s.MaxOpenConns)
+	db.SetConnMaxLifetime(s.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(s.ConnMaxIdleTime)
+}
+
+// singleConnection defaults the unset counts to a single connection, for PG.Connect and V2.Connect
+func (s PoolSettings) singleConnection() PoolSettings {
+	if s.MaxIdleConns <= 0 {
+		s.MaxIdleConns = 1
+	}
+	if s.MaxOpenConns <= 0 {
+		s.MaxOpenConns = 1
+	}
+	return s
+}
+
+// rootCertDownloader is implemented by the Postgresql which can store the root certificate of Options.SSLDownload,
+// as the pool connects with a DSN
+type rootCertDownloader interface {
+	DownloadSSLRootCert(ctx context.Context, clusterName string, options Options) error
+}
+
+// Pool is a connection pool to a cluster which is health checked and reopened when the password of its user rotates,
+// or before the lease of its dynamic credentials expires.
+// Callers should get DB for every use rather than keep it, since a reopened pool closes the previous one
+type Pool struct {
+	Postgres    Postgresql
+	ClusterName string
+	Username    string
+	Options     Options
+	// Leases tells when the leases of dynamic credentials expire, it defaults to the credentials provider of a *PG.
+	// Without it, a lease is assumed to expire after the duration it was issued with
+	Leases credentials.Leases
+	// HealthCheckInterval is how often Run pings the pool and checks the credentials and the role of the server
+	HealthCheckInterval time.Duration
+	// FailoverAttempts, FailoverDelay and FailoverMaxDelay bound the exponential backoff of Failover
+	FailoverAttempts uint
+	FailoverDelay    time.Duration
+	FailoverMaxDelay time.Duration
+	Log              *logrus.Entry
+
+	logOnce sync.Once
+	mu      sync.RWMutex
+	db      *sqlx.DB
+	// lease is empty for static passwords, which are compared instead
+	lease poolLease
+	// stale is set by Invalidate, the next health check reopens the pool
+	stale bool
+	// connectMu serializes the connections, so that a rotation and a failover do not reopen the pool twice
+	connectMu  sync.Mutex
+	failoverMu sync.Mutex
+}
+
+// Open connects the pool, it fails when the cluster can not be reached
+func (p *Pool) Open(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db != nil {
+		return nil
+	}
+	db, lease, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+	p.db, p.lease = db, lease
+	return nil
+}
+
+// DB returns the current pool, nil before Open
+func (p *Pool) DB() *sqlx.DB {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.db
+}
+
+// Run health checks the pool until the context is done
+func (p *Pool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.getHealthCheckInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.HealthCheck(ctx); err != nil {
+				p.getLog().WithError(err).Warnf("connection pool of cluster %v is unhealthy", p.ClusterName)
+			}
+		}
+	}
+}
+
+// HealthCheck reopens the pool when the password of its user has changed or has been rejected, or when its lease
+// expires before the next health check, and fails over when the server can not be reached or is not of the role of the pool anymore
+func (p *Pool) HealthCheck(ctx context.Context) error {
+	db := p.DB()
+	if db == nil {
+		return fmt.Errorf("connection pool is not open")
+	}
+
+	rotated, err := p.credentialsRotated(ctx)
+	if err != nil {
+		p.getLog().WithError(err).Warnf("could not check the credentials of cluster %v", p.ClusterName)
+	}
+	rotated = rotated || p.isStale()
+	pingErr := db.PingContext(ctx)
+	if pingErr == nil {
+		pingErr = p.verifyRole(ctx, db)
+	}
+	if !rotated && !isInvalidPassword(pingErr) {
+		if IsFailoverError(pingErr) {
+			return p.Failover(ctx)
+		}
+		return pingErr
+	}
+
+	p.getLog().WithField("cluster", p.ClusterName).Infof("credentials have changed, reopening the connection pool")
+	if err := p.Reopen(ctx); err != nil {
+		return fmt.Errorf("could not Reopen: %v", err)
+	}
+	return nil
+}
+
+// Reopen connects a new pool with fresh credentials and closes the previous one once its queries are done
+func (p *Pool) Reopen(ctx context.Context) error {
+	db, lease, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	previous, previousLease := p.db, p.lease
+	p.db, p.lease, p.stale = db, lease, false
+	p.mu.Unlock()
+
+	p.releaseLease(previousLease)
+	if previous != nil {
+		go previous.Close()
+	}
+	return nil
+}
+
+// Invalidate makes the next health check reopen the pool with fresh credentials, e.g. after they have been rotated
+func (p *Pool) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stale = true
+}
+
+func (p *Pool) isStale() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.stale
+}
+
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db == nil {
+		return nil
+	}
+	err := p.db.Close()
+	p.releaseLease(p.lease)
+	p.db, p.lease = nil, poolLease{}
+	return err
+}
+
+// poolLease holds the credentials a pool connected with
+type poolLease struct {
+	password string
+	id       string
+	// expiresAt is when the lease expires unless it is renewed
+	expiresAt time.Time
+}
+
+// connect opens and pings a pool, returning the credentials it connected with.
+// They are read once, so that a rotation after is caught by the next health check
+func (p *Pool) connect(ctx context.Context) (*sqlx.DB, poolLease, error) {
+	p.connectMu.Lock()
+	defer p.connectMu.Unlock()
+
+	// PG connects with lib/pq
+	if _, ok := p.Postgres.(*PG); ok && p.Options.TargetSessionAttrs != "" {
+		return nil, poolLease{}, errTargetSessionAttrs
+	}
+	if p.usesClientCertificate() {
+		db, err := p.Postgres.GetConnection(ctx, p.ClusterName, p.Username, p.Options)
+		if err != nil {
+			return nil, poolLease{}, fmt.Errorf("could not GetConnection: %w", err)
+		}
+		if err := p.ping(ctx, db); err != nil {
+			return nil, poolLease{}, err
+		}
+		return db, poolLease{}, nil
+	}
+
+	if p.Options.SSLDownload {
+		downloader, ok := p.Postgres.(rootCertDownloader)
+		if !ok {
+			return nil, poolLease{}, fmt.Errorf("could not download the root certificate of cluster %v", p.ClusterName)
+		}
+		if err := downloader.DownloadSSLRootCert(ctx, p.ClusterName, p.Options); err != nil {
+			return nil, poolLease{}, fmt.Errorf("could not DownloadSSLRootCert: %w", err)
+		}
+	}
+	response, err := p.Postgres.GetCredentials(ctx, p.ClusterName, p.Username, p.Options)
+	if err != nil {
+		return nil, poolLease{}, fmt.Errorf("could not GetCredentials: %w", err)
+	}
+	lease := poolLease{password: response.Password, id: response.LeaseID}
+	if lease.id != "" {
+		lease.expiresAt = time.Now().Add(response.LeaseDuration)
+	}
+
+	dsn, err := p.Postgres.GetDSNContext(ctx, p.ClusterName, response.Password, response.Username, p.Options)
+	if err != nil {
+		p.releaseLease(lease)
+		return nil, poolLease{}, fmt.Errorf("could not GetDSNContext: %w", err)
+	}
+	db, err := p.Postgres.Connect(dsn)
+	if err != nil {
+		p.releaseLease(lease)
+		return nil, poolLease{}, fmt.Errorf("could not Connect: %w", err)
+	}
+	if err := p.ping(ctx, db); err != nil {
+		p.releaseLease(lease)
+		return nil, poolLease{}, err
+	}
+	return db, lease, nil
+}
+
+// ping applies the pool settings and checks the server, the pool is closed when it fails
+func (p *Pool) ping(ctx context.Context, db *sqlx.DB) error {
+	p.Options.PoolSettings().apply(db)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return fmt.Errorf("could not ping cluster %v: %w", p.ClusterName, err)
+	}
+	if err := p.verifyRole(ctx, db); err != nil {
+		db.Close()
+		return err
+	}
+	return nil
+}
+
+// credentialsRotated tells whether the lease of the pool expires before the next health check, or for static
+// passwords whether the password of the provider differs from the one the pool connected with
+func (p *Pool) credentialsRotated(ctx context.Context) (bool, error) {
+	if p.usesClientCertificate() {
+		return false, nil
+	}
+	p.mu.RLock()
+	lease := p.lease
+	p.mu.RUnlock()
+
+	if lease.id != "" {
+		expiresAt := lease.expiresAt
+		if leases := p.getLeases(); leases != nil {
+			var ok bool
+			// A lease which is not tracked anymore could not be renewed
+			if expiresAt, ok = leases.LeaseExpiry(lease.id); !ok {
+				return true, nil
+			}
+		}
+		return expiresAt.Before(time.Now().Add(p.getHealthCheckInterval())), nil
+	}
+
+	response, err := p.Postgres.GetCredentials(ctx, p.ClusterName, p.Username, p.Options)
+	if err != nil {
+		return false, err
+	}
+	return response.Password != lease.password, nil
+}
+
+// releaseLease stops renewing the lease of credentials the pool does not use anymore
+func (p *Pool) releaseLease(lease poolLease) {
+	if lease.id == "" {
+		return
+	}
+	if leases := p.getLeases(); leases != nil {
+		leases.ReleaseLease(lease.id)
+	}
+}
+
+func (p *Pool) getLeases() credentials.Leases {
+	if p.Leases != nil {
+		return p.Leases
+	}
+	if pg, ok := p.Postgres.(*PG); ok {
+		if leases, ok := pg.CredentialsProvider.(credentials.Leases); ok {
+			return leases
+		}
+	}
+	return nil
+}
+
+func (p *Pool) usesClientCertificate() bool {
+	return p.Options.SSLCertPath != ""
+}
+
+func isInvalidPassword(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == invalidPasswordCode
+}
+
+func (p *Pool) getHealthCheckInterval() time.Duration {
+	if p.HealthCheckInterval <= 0 {
+		return DefaultHealthCheckInterval
+	}
+	return p.HealthCheckInterval
+}
+
+func (p *Pool) getLog() *logrus.Entry {
+	p.logOnce.Do(func() {
+		if p.Log == nil {
+			p.Log = logger.NewDefaultLogger("info", "postgresql")
+		}
+	})
+	return p.Log
+}
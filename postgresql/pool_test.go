@@ -0,0 +1,338 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/credentials"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// fakeServer accepts the connections opened with its current password, the DSN of the fake driver is <password>/<host>.
+// The hosts but primary are in recovery, queries return the replication state otherwise
+type fakeServer struct {
+	mu       sync.Mutex
+	password string
+	// lag is the delay of the last replayed transaction in seconds, the replica has replayed everything it received
+	// when it is zero or when the replica is disconnected from the primary
+	lag          float64
+	disconnected bool
+	primary      string
+	// endpoint is the master host returned by the fake endpoint resolver, for staleResolutions more resolutions
+	endpoint         string
+	staleResolutions int
+}
+
+func (s *fakeServer) setPassword(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+func (s *fakeServer) setLag(lag float64, disconnected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lag, s.disconnected = lag, disconnected
+}
+
+// failover promotes a new primary, which is resolved after staleResolutions resolutions
+func (s *fakeServer) failover(primary string, staleResolutions int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.primary, s.staleResolutions = primary, staleResolutions
+}
+
+// resolve returns the host of a role
+func (s *fakeServer) resolve(role string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if role == constants.RoleReplica {
+		return "replica"
+	}
+	if s.staleResolutions > 0 {
+		s.staleResolutions--
+	} else {
+		s.endpoint = s.primary
+	}
+	return s.endpoint
+}
+
+func (s *fakeServer) Open(dsn string) (driver.Conn, error) {
+	password, host, _ := strings.Cut(dsn, "/")
+	return &fakeConn{server: s, password: password, host: host}, nil
+}
+
+type fakeConn struct {
+	server   *fakeServer
+	password string
+	host     string
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.password != c.server.password {
+		return &pq.Error{Code: invalidPasswordCode, Message: "password authentication failed"}
+	}
+	return nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if strings.Contains(query, "pg_is_in_recovery") {
+		return &fakeRows{values: []driver.Value{c.host != c.server.primary}}, nil
+	}
+	replayedAll := c.server.lag == 0 || c.server.disconnected
+	return &fakeRows{values: []driver.Value{!c.server.disconnected, replayedAll, c.server.lag}, columns: 3}, nil
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+// fakeRows returns values in rows of columns values, a single one by default
+type fakeRows struct {
+	values  []driver.Value
+	columns int
+}
+
+func (r *fakeRows) Columns() []string {
+	if r.columns == 0 {
+		return []string{"value"}
+	}
+	return make([]string, r.columns)
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	r.values = r.values[copy(dest, r.values):]
+	return nil
+}
+
+var testServer = &fakeServer{primary: "master", endpoint: "master"}
+
+func init() {
+	sql.Register("fakepg", testServer)
+}
+
+// fakePostgres hands out the password of the fake server, with a lease of leases when it is set
+type fakePostgres struct {
+	noReplica bool
+	leases    *fakeLeases
+}
+
+func (f fakePostgres) GetCredentials(ctx context.Context, clusterName string, username string, options Options) (credentials.GetPostgresCredentialsResponse, error) {
+	response := credentials.GetPostgresCredentialsResponse{Username: username}
+	if f.leases != nil {
+		response.LeaseID, response.LeaseDuration = f.leases.issue()
+	}
+	testServer.mu.Lock()
+	defer testServer.mu.Unlock()
+	response.Password = testServer.password
+	return response, nil
+}
+
+func (f fakePostgres) GetConnection(ctx context.Context, clusterName string, username string, options Options) (*sqlx.DB, error) {
+	response, _ := f.GetCredentials(ctx, clusterName, username, options)
+	dsn, err := f.GetDSN(clusterName, response.Password, response.Username, options)
+	if err != nil {
+		return nil, err
+	}
+	return f.Connect(dsn)
+}
+
+func (f fakePostgres) GetDSN(clusterName, password, username string, options Options) (string, error) {
+	return f.GetDSNContext(context.Background(), clusterName, password, username, options)
+}
+
+func (f fakePostgres) GetDSNContext(ctx context.Context, clusterName, password, username string, options Options) (string, error) {
+	if f.noReplica && options.Role == constants.RoleReplica {
+		return "", errors.New("no replica")
+	}
+	return password + "/" + testServer.resolve(options.Role), nil
+}
+
+func (f fakePostgres) Connect(dsn string) (*sqlx.DB, error) {
+	return sqlx.Open("fakepg", dsn)
+}
+
+// fakeLeases issues leases which expire in an hour
+type fakeLeases struct {
+	mu       sync.Mutex
+	issued   int
+	expiries map[string]time.Time
+	released []string
+}
+
+func (l *fakeLeases) issue() (string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.issued++
+	id := fmt.Sprintf("database/creds/mycluster-application/%v", l.issued)
+	if l.expiries == nil {
+		l.expiries = map[string]time.Time{}
+	}
+	l.expiries[id] = time.Now().Add(time.Hour)
+	return id, time.Hour
+}
+
+func (l *fakeLeases) setExpiry(id string, expiresAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expiries[id] = expiresAt
+}
+
+func (l *fakeLeases) LeaseExpiry(leaseID string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expiresAt, ok := l.expiries[leaseID]
+	return expiresAt, ok
+}
+
+func (l *fakeLeases) ReleaseLease(leaseID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.expiries, leaseID)
+	l.released = append(l.released, leaseID)
+}
+
+func TestPoolSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     Options
+		wantMaxOpen int
+		// wantPoolMaxOpen is the limit of GetConnection and Pool, zero being unlimited
+		wantPoolMaxOpen int
+	}{
+		{name: "defaults to a single connection for Connect only", options: Options{}, wantMaxOpen: 1, wantPoolMaxOpen: 0},
+		{name: "settings of the options", options: Options{SetMaxOpenConns: 20, SetMaxIdleConns: 5, SetConnMaxIdleTime: 60}, wantMaxOpen: 20, wantPoolMaxOpen: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := PG{Pool: tt.options.PoolSettings()}
+			conn, err := pg.Connect("postgresql://admin@localhost:5432/postgres?sslmode=disable")
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer conn.Close()
+			if got := conn.Stats().MaxOpenConnections; got != tt.wantMaxOpen {
+				t.Errorf("PG.Connect() MaxOpenConnections = %v, want %v", got, tt.wantMaxOpen)
+			}
+
+			v2 := V2{Pool: tt.options.PoolSettings()}
+			conn, err = v2.Connect("postgresql://admin@localhost:5432/postgres?sslmode=disable")
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer conn.Close()
+			if got := conn.Stats().MaxOpenConnections; got != tt.wantMaxOpen {
+				t.Errorf("V2.Connect() MaxOpenConnections = %v, want %v", got, tt.wantMaxOpen)
+			}
+
+			conn, err = connect("postgresql://admin@localhost:5432/postgres?sslmode=disable", tt.options.PoolSettings())
+			if err != nil {
+				t.Fatalf("connect() error = %v", err)
+			}
+			defer conn.Close()
+			if got := conn.Stats().MaxOpenConnections; got != tt.wantPoolMaxOpen {
+				t.Errorf("connect() MaxOpenConnections = %v, want %v", got, tt.wantPoolMaxOpen)
+			}
+		})
+	}
+}
+
+func TestPool_ReopensOnRotation(t *testing.T) {
+	ctx := context.Background()
+	testServer.setPassword("first")
+	pool := &Pool{
+		Postgres:    fakePostgres{},
+		ClusterName: "mycluster",
+		Username:    "application",
+		Options:     Options{SetMaxOpenConns: 10},
+	}
+	if err := pool.Open(ctx); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer pool.Close()
+	first := pool.DB()
+	if got := first.Stats().MaxOpenConnections; got != 10 {
+		t.Errorf("MaxOpenConnections = %v, want 10", got)
+	}
+	if err := pool.HealthCheck(ctx); err != nil || pool.DB() != first {
+		t.Fatalf("HealthCheck() of a healthy pool error = %v, reopened = %v", err, pool.DB() != first)
+	}
+
+	testServer.setPassword("second")
+	if err := pool.HealthCheck(ctx); err != nil {
+		t.Fatalf("HealthCheck() after rotation error = %v", err)
+	}
+	if pool.DB() == first {
+		t.Fatalf("pool has not been reopened after the password rotated")
+	}
+	if err := pool.DB().PingContext(ctx); err != nil {
+		t.Errorf("reopened pool can not connect: %v", err)
+	}
+}
+
+func TestPool_ReopensBeforeLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	testServer.setPassword("secret")
+	leases := &fakeLeases{}
+	pool := &Pool{
+		Postgres:    fakePostgres{leases: leases},
+		ClusterName: "mycluster",
+		Username:    "application",
+		Leases:      leases,
+	}
+	if err := pool.Open(ctx); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	first := pool.DB()
+	if err := pool.HealthCheck(ctx); err != nil || pool.DB() != first {
+		t.Fatalf("HealthCheck() of a renewed lease error = %v, reopened = %v", err, pool.DB() != first)
+	}
+	if leases.issued != 1 {
+		t.Errorf("issued %v leases, want the credentials to be read once", leases.issued)
+	}
+
+	leases.setExpiry("database/creds/mycluster-application/1", time.Now().Add(time.Second))
+	if err := pool.HealthCheck(ctx); err != nil {
+		t.Fatalf("HealthCheck() of an expiring lease error = %v", err)
+	}
+	if pool.DB() == first || leases.issued != 2 {
+		t.Fatalf("pool has not been reopened before its lease expired")
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	want := []string{"database/creds/mycluster-application/1", "database/creds/mycluster-application/2"}
+	if !reflect.DeepEqual(leases.released, want) {
+		t.Errorf("released leases %v, want %v", leases.released, want)
+	}
+}
@@ -3,17 +3,19 @@ package postgresql
 import (
 	"context"
 	"fmt"
+	"github.com/borealisdb/commons/constants"
 	"github.com/borealisdb/commons/credentials"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"os"
-	"strings"
+	"time"
 )
 
 type Postgresql interface {
 	GetConnection(ctx context.Context, clusterName string, username string, options Options) (*sqlx.DB, error)
 	Connect(dsn string) (*sqlx.DB, error)
 	GetDSN(clusterName, password, username string, options Options) (string, error)
+	GetDSNContext(ctx context.Context, clusterName, password, username string, options Options) (string, error)
 	GetCredentials(ctx context.Context, clusterName string, username string, options Options) (credentials.GetPostgresCredentialsResponse, error)
 }
 
@@ -26,125 +28,240 @@ type Options struct {
 	SSLMode         string
 	SSLDownload     bool
 
+	// SSLCertPath and SSLKeyPath hold the client certificate of the user, used to authenticate
+	// with the cert method of pg_hba. No password is fetched when they are set
+	SSLCertPath           string
+	SSLKeyPath            string
+	SSLClientCertDownload bool
+
+	// ConnectTimeout is in seconds. See DSN for the other connection parameters
+	ConnectTimeout  int
+	ApplicationName string
+	// TargetSessionAttrs, e.g. read-write, makes GetDSN render a key/value DSN for libpq and pgx.
+	// GetConnection refuses it, as lib/pq would send it to the server which rejects it
+	TargetSessionAttrs string
+	ServerOptions      string
+	SearchPath         string
+
+	// Pool settings, the lifetime and idle time are in seconds. See PoolSettings for the defaults
 	SetMaxIdleConns    int
 	SetMaxOpenConns    int
 	SetConnMaxLifetime int
+	SetConnMaxIdleTime int
+}
+
+// PoolSettings returns the connection pool settings of the options
+func (o Options) PoolSettings() PoolSettings {
+	return PoolSettings{
+		MaxIdleConns:    o.SetMaxIdleConns,
+		MaxOpenConns:    o.SetMaxOpenConns,
+		ConnMaxLifetime: time.Duration(o.SetConnMaxLifetime) * time.Second,
+		ConnMaxIdleTime: time.Duration(o.SetConnMaxIdleTime) * time.Second,
+	}
 }
 
+// PG connects to the clusters of its credentials provider. It keeps no per-call state and is safe for concurrent use
 type PG struct {
 	CredentialsProvider credentials.Credentials
-	options             Options
-	clusterName         string
+	// Pool holds the settings of the pools returned by Connect, GetConnection applies those of its options
+	Pool PoolSettings
+}
+
+// session holds the options of a single call, once resolved by setDefaults
+type session struct {
+	provider    credentials.Credentials
+	clusterName string
+	options     Options
 }
 
 func (pg *PG) GetConnection(ctx context.Context, clusterName string, username string, options Options) (*sqlx.DB, error) {
-	if err := pg.setDefaults(options, clusterName); err != nil {
-		return &sqlx.DB{}, err
+	if options.TargetSessionAttrs != "" {
+		return &sqlx.DB{}, errTargetSessionAttrs
 	}
-	resp, err := pg.getCredentials(ctx, username)
+	s, err := pg.setDefaults(ctx, options, clusterName)
 	if err != nil {
-		return &sqlx.DB{}, fmt.Errorf("could not GetCredentials: %v", err)
+		return &sqlx.DB{}, err
 	}
 
-	if pg.options.SSLDownload {
-		if err := pg.downloadSSLRootCert(ctx); err != nil {
-			return &sqlx.DB{}, fmt.Errorf("could not downloadSSLRootCert: %v", err)
+	if s.options.SSLDownload {
+		if err := s.downloadSSLRootCert(ctx); err != nil {
+			return &sqlx.DB{}, fmt.Errorf("could not downloadSSLRootCert: %w", err)
 		}
 	}
 
-	dsn := pg.getDSN(resp.Password, resp.Username)
-	return pg.Connect(dsn)
+	if s.options.SSLCertPath != "" {
+		if s.options.SSLClientCertDownload {
+			certUsername, err := s.downloadSSLClientCert(ctx, username)
+			if err != nil {
+				return &sqlx.DB{}, fmt.Errorf("could not downloadSSLClientCert: %w", err)
+			}
+			username = certUsername
+		}
+		if username == "" {
+			username = constants.AdminUsername
+		}
+		return connect(s.getDSN("", username), s.options.PoolSettings())
+	}
+
+	resp, err := s.getCredentials(ctx, username)
+	if err != nil {
+		return &sqlx.DB{}, fmt.Errorf("could not GetCredentials: %w", err)
+	}
+
+	dsn := s.getDSN(resp.Password, resp.Username)
+	return connect(dsn, s.options.PoolSettings())
+}
+
+// DownloadSSLRootCert stores the root certificate of a cluster in Options.SSLRootCertPath
+func (pg *PG) DownloadSSLRootCert(ctx context.Context, clusterName string, options Options) error {
+	s, err := pg.setDefaults(ctx, options, clusterName)
+	if err != nil {
+		return fmt.Errorf("could not setDefaults: %w", err)
+	}
+	return s.downloadSSLRootCert(ctx)
 }
 
 func (pg *PG) Connect(dsn string) (*sqlx.DB, error) {
+	return connect(dsn, pg.Pool.singleConnection())
+}
+
+func connect(dsn string, settings PoolSettings) (*sqlx.DB, error) {
 	conn, err := sqlx.Open("postgres", dsn)
 	if err != nil {
 		return &sqlx.DB{}, err
 	}
-	conn.SetMaxIdleConns(1)
-	conn.SetMaxOpenConns(1)
-	conn.SetConnMaxLifetime(0)
+	settings.apply(conn)
 	return conn, nil
 }
 
-func (pg *PG) getDSN(password string, username string) string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf(
-		"postgresql://%v:%v@%v:%v/%v?sslmode=%v",
-		username,
-		password,
-		pg.options.Host,
-		pg.options.Port,
-		pg.options.Database,
-		pg.options.SSLMode,
-	))
-	if pg.options.SSLRootCertPath != "" {
-		sb.WriteString(fmt.Sprintf("&sslrootcert=%v", pg.options.SSLRootCertPath))
+// GetDSN is GetDSNContext without a deadline on the endpoint lookup
+func (pg *PG) GetDSN(clusterName, password, username string, options Options) (string, error) {
+	return pg.GetDSNContext(context.Background(), clusterName, password, username, options)
+}
+
+// GetDSNContext resolves the endpoint of the cluster within the context and returns the DSN of the user,
+// as a URL unless Options.TargetSessionAttrs is set
+func (pg *PG) GetDSNContext(ctx context.Context, clusterName, password, username string, options Options) (string, error) {
+	s, err := pg.setDefaults(ctx, options, clusterName)
+	if err != nil {
+		return "", fmt.Errorf("could not setDefaults: %w", err)
 	}
 
-	return sb.String()
+	return s.getDSN(password, username), nil
 }
 
-func (pg *PG) GetDSN(clusterName, password, username string, options Options) (string, error) {
-	if err := pg.setDefaults(options, clusterName); err != nil {
-		return "", fmt.Errorf("could not setDefaults: %v", err)
+func (pg *PG) GetCredentials(ctx context.Context, clusterName string, username string, options Options) (credentials.GetPostgresCredentialsResponse, error) {
+	s, err := pg.setDefaults(ctx, options, clusterName)
+	if err != nil {
+		return credentials.GetPostgresCredentialsResponse{}, fmt.Errorf("could not setDefaults: %w", err)
 	}
+	return s.getCredentials(ctx, username)
+}
 
-	return pg.getDSN(password, username), nil
+func (s session) getDSN(password string, username string) string {
+	return s.dsn(password, username).render()
 }
 
-func (pg *PG) GetCredentials(ctx context.Context, clusterName string, username string, options Options) (credentials.GetPostgresCredentialsResponse, error) {
-	if err := pg.setDefaults(options, clusterName); err != nil {
-		return credentials.GetPostgresCredentialsResponse{}, fmt.Errorf("could not setDefaults: %v", err)
+func (s session) dsn(password string, username string) DSN {
+	return DSN{
+		Host:               s.options.Host,
+		Port:               s.options.Port,
+		Database:           s.options.Database,
+		User:               username,
+		Password:           password,
+		SSLMode:            s.options.SSLMode,
+		SSLRootCert:        s.options.SSLRootCertPath,
+		SSLCert:            s.options.SSLCertPath,
+		SSLKey:             s.options.SSLKeyPath,
+		ConnectTimeout:     s.options.ConnectTimeout,
+		ApplicationName:    s.options.ApplicationName,
+		TargetSessionAttrs: s.options.TargetSessionAttrs,
+		Options:            s.options.ServerOptions,
+		SearchPath:         s.options.SearchPath,
 	}
-	return pg.getCredentials(ctx, username)
 }
 
-func (pg *PG) getCredentials(ctx context.Context, username string) (credentials.GetPostgresCredentialsResponse, error) {
-	postgresCredentials, err := pg.CredentialsProvider.GetPostgresCredentials(
+func (s session) getCredentials(ctx context.Context, username string) (credentials.GetPostgresCredentialsResponse, error) {
+	postgresCredentials, err := s.provider.GetPostgresCredentials(
 		ctx,
-		pg.clusterName,
+		s.clusterName,
 		username,
-		credentials.Options{},
+		s.getCredentialsOptions(),
 	)
 	if err != nil {
-		return credentials.GetPostgresCredentialsResponse{}, fmt.Errorf("could not GetPostgresCredentials: %v", err)
+		return credentials.GetPostgresCredentialsResponse{}, fmt.Errorf("could not GetPostgresCredentials: %w", err)
 	}
 
 	return postgresCredentials, nil
 }
 
-func (pg *PG) downloadSSLRootCert(ctx context.Context) error {
-	cert, err := pg.CredentialsProvider.GetPostgresSSLRootCert(ctx, pg.clusterName, credentials.Options{})
+func (s session) downloadSSLRootCert(ctx context.Context) error {
+	cert, err := s.provider.GetPostgresSSLRootCert(ctx, s.clusterName, s.getCredentialsOptions())
+	if err != nil {
+		return fmt.Errorf("could not GetPostgresSSLRootCert: %w", err)
+	}
+
+	return os.WriteFile(s.options.SSLRootCertPath, cert.RootCertBytes, 0777)
+}
+
+// downloadSSLClientCert stores the client certificate of the user and returns the username it has been issued for
+func (s session) downloadSSLClientCert(ctx context.Context, username string) (string, error) {
+	if s.options.SSLKeyPath == "" {
+		return "", fmt.Errorf("SSLKeyPath is required to download the client certificate")
+	}
+	cert, err := s.provider.GetPostgresClientCertificate(ctx, s.clusterName, username, s.getCredentialsOptions())
 	if err != nil {
-		return fmt.Errorf("could not GetPostgresSSLRootCert: %v", err)
+		return "", fmt.Errorf("could not GetPostgresClientCertificate: %w", err)
 	}
 
-	return os.WriteFile(pg.options.SSLRootCertPath, cert.RootCertBytes, 0777)
+	if err := os.WriteFile(s.options.SSLCertPath, cert.CertBytes, 0644); err != nil {
+		return "", err
+	}
+	// libpq refuses to use a key which is accessible by group or others
+	if err := os.WriteFile(s.options.SSLKeyPath, cert.KeyBytes, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(s.options.SSLKeyPath, 0600); err != nil {
+		return "", err
+	}
+	return cert.Username, nil
 }
 
-func (pg *PG) setDefaults(options Options, clusterName string) error {
-	pg.clusterName = clusterName
-	pg.options = options
-	resp, err := pg.CredentialsProvider.GetClusterEndpoint(context.Background(), pg.clusterName, pg.options.Role)
-	if pg.options.Host == "" {
+// getCredentialsOptions tells the provider which instance and database the credentials are for
+func (s session) getCredentialsOptions() credentials.Options {
+	return credentials.Options{
+		Role:     s.options.Role,
+		Database: s.options.Database,
+	}
+}
+
+// setDefaults resolves the endpoint of the cluster and fills in the options which are not set
+func (pg *PG) setDefaults(ctx context.Context, options Options, clusterName string) (session, error) {
+	s := session{provider: pg.CredentialsProvider, clusterName: clusterName, options: options}
+	resp, err := pg.CredentialsProvider.GetClusterEndpoint(ctx, clusterName, options.Role)
+	if s.options.Host == "" {
 		if err != nil {
-			return fmt.Errorf("could not GetClusterEndpoint: %v", err)
+			return session{}, fmt.Errorf("could not GetClusterEndpoint: %w", err)
 		}
-		pg.options.Host = resp.Hostname
+		s.options.Host = resp.Hostname
 	}
-	if pg.options.Port == "" {
-		pg.options.Port = resp.Port
+	if s.options.Port == "" {
+		s.options.Port = resp.Port
 	}
-	if pg.options.Database == "" {
-		pg.options.Database = "postgres"
+	if s.options.Database == "" {
+		s.options.Database = "postgres"
 	}
 
-	if pg.options.SSLRootCertPath == "" && pg.options.SSLMode == "" {
-		pg.options.SSLMode = "disable"
-	} else if pg.options.SSLRootCertPath != "" && pg.options.SSLMode == "" {
-		pg.options.SSLMode = "verify-ca"
+	if s.options.SSLRootCertPath == "" && s.options.SSLMode == "" {
+		// Client certificates are sent only over TLS, which the server may also require
+		if s.options.SSLCertPath != "" || resp.TLSRequired {
+			s.options.SSLMode = "require"
+		} else {
+			s.options.SSLMode = "disable"
+		}
+	} else if s.options.SSLRootCertPath != "" && s.options.SSLMode == "" {
+		s.options.SSLMode = "verify-ca"
 	}
 
-	return nil
+	return s, nil
 }
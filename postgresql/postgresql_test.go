@@ -2,10 +2,12 @@ package postgresql
 
 import (
 	"context"
+	"errors"
 	"github.com/borealisdb/commons/credentials"
 	"github.com/borealisdb/commons/mocks"
 	"github.com/golang/mock/gomock"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -39,6 +41,19 @@ func TestPG_GetPostgresDSN(t *testing.T) {
 				os.Setenv("mycluster_admin_CLUSTER_PASSWORD", "123")
 			},
 		},
+		{
+			name:   "key/value dsn for target_session_attrs",
+			fields: fields{CredentialsProvider: credentials.Environment{}, ClusterName: "mycluster"},
+			args: args{
+				options: Options{TargetSessionAttrs: "read-write"},
+			},
+			want: "host=myhost port=5432 dbname=postgres user=admin password=123 sslmode=disable target_session_attrs=read-write",
+			doBefore: func() {
+				os.Setenv("mycluster_CLUSTER_HOSTNAME", "myhost")
+				os.Setenv("mycluster_CLUSTER_USERNAME", "admin")
+				os.Setenv("mycluster_admin_CLUSTER_PASSWORD", "123")
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -48,17 +63,18 @@ func TestPG_GetPostgresDSN(t *testing.T) {
 
 			pg := PG{CredentialsProvider: tt.fields.CredentialsProvider}
 
-			if err := pg.setDefaults(tt.args.options, tt.fields.ClusterName); err != nil {
+			s, err := pg.setDefaults(ctx, tt.args.options, tt.fields.ClusterName)
+			if err != nil {
 				t.Errorf("setDefaults() error = %v", err)
 				return
 			}
-			resp, err := pg.getCredentials(ctx, "")
+			resp, err := s.getCredentials(ctx, "")
 			if err != nil {
 				t.Errorf("getCredentials() error = %v", err)
 				return
 			}
 
-			dsn := pg.getDSN(resp.Password, resp.Username)
+			dsn := s.getDSN(resp.Password, resp.Username)
 
 			if dsn != tt.want {
 				t.Errorf("getDSN() = %v, want %v", dsn, tt.want)
@@ -67,6 +83,17 @@ func TestPG_GetPostgresDSN(t *testing.T) {
 	}
 }
 
+func TestGetConnection_TargetSessionAttrs(t *testing.T) {
+	pg := PG{CredentialsProvider: credentials.Environment{}}
+	if _, err := pg.GetConnection(context.Background(), "mycluster", "", Options{TargetSessionAttrs: "read-write"}); !errors.Is(err, errTargetSessionAttrs) {
+		t.Errorf("PG.GetConnection() error = %v, want %v", err, errTargetSessionAttrs)
+	}
+	v2 := V2{}
+	if _, err := v2.GetConnection(Args{Host: "myhost", TargetSessionAttrs: "read-write"}); !errors.Is(err, errTargetSessionAttrs) {
+		t.Errorf("V2.GetConnection() error = %v, want %v", err, errTargetSessionAttrs)
+	}
+}
+
 func TestPG_GetCredentials(t *testing.T) {
 	type fields struct {
 		options     Options
@@ -88,7 +115,7 @@ func TestPG_GetCredentials(t *testing.T) {
 			fields: fields{
 				options:     Options{},
 				clusterName: "mycluster",
-				credOptions: credentials.Options{},
+				credOptions: credentials.Options{Database: "postgres"},
 			},
 			args: args{
 				username: "postgres",
@@ -104,7 +131,7 @@ func TestPG_GetCredentials(t *testing.T) {
 			fields: fields{
 				options:     Options{},
 				clusterName: "mycluster",
-				credOptions: credentials.Options{},
+				credOptions: credentials.Options{Database: "postgres"},
 			},
 			args: args{
 				username: "admin",
@@ -115,6 +142,22 @@ func TestPG_GetCredentials(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "replica credentials",
+			fields: fields{
+				options:     Options{Role: "replica", Database: "app"},
+				clusterName: "mycluster",
+				credOptions: credentials.Options{Role: "replica", Database: "app"},
+			},
+			args: args{
+				username: "application",
+			},
+			want: credentials.GetPostgresCredentialsResponse{
+				Username: "application",
+				Password: "123",
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -134,7 +177,7 @@ func TestPG_GetCredentials(t *testing.T) {
 			pg := PG{
 				CredentialsProvider: mockCredentials,
 			}
-			got, err := pg.GetCredentials(context.Background(), tt.fields.clusterName, "", tt.fields.options)
+			got, err := pg.GetCredentials(context.Background(), tt.fields.clusterName, tt.args.username, tt.fields.options)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetCredentials() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -145,3 +188,79 @@ func TestPG_GetCredentials(t *testing.T) {
 		})
 	}
 }
+
+func TestPG_GetConnection_ClientCertificate(t *testing.T) {
+	tests := []struct {
+		name     string
+		download bool
+	}{
+		{name: "stored client certificate"},
+		{name: "downloaded client certificate", download: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			options := Options{
+				SSLCertPath:           filepath.Join(dir, "analyst.crt"),
+				SSLKeyPath:            filepath.Join(dir, "analyst.key"),
+				SSLClientCertDownload: tt.download,
+			}
+
+			// No password is fetched, GetPostgresCredentials is not expected
+			ctrl := gomock.NewController(t)
+			mockCredentials := mocks.NewMockCredentials(ctrl)
+			mockCredentials.EXPECT().
+				GetClusterEndpoint(ctx, "mycluster", "").
+				Return(credentials.GetClusterEndpointResponse{Hostname: "mycluster.default.svc.cluster.local"}, nil)
+			if tt.download {
+				mockCredentials.EXPECT().
+					GetPostgresClientCertificate(ctx, "mycluster", "analyst", credentials.Options{Database: "postgres"}).
+					Return(credentials.GetPostgresClientCertificateResponse{Username: "analyst", CertBytes: []byte("cert"), KeyBytes: []byte("key")}, nil)
+			}
+
+			pg := PG{CredentialsProvider: mockCredentials}
+			conn, err := pg.GetConnection(ctx, "mycluster", "analyst", options)
+			if err != nil {
+				t.Fatalf("GetConnection() error = %v", err)
+			}
+			conn.Close()
+
+			if !tt.download {
+				return
+			}
+			if info, err := os.Stat(options.SSLKeyPath); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("key should be stored with 0600 permissions, got %v", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestAlterRolePasswordQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     string
+	}{
+		{
+			name:     "plain role",
+			username: "application",
+			password: "secret",
+			want:     `ALTER ROLE "application" WITH PASSWORD 'secret'`,
+		},
+		{
+			name:     "quotes are escaped",
+			username: `app"lication`,
+			password: `it's`,
+			want:     `ALTER ROLE "app""lication" WITH PASSWORD 'it''s'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AlterRolePasswordQuery(tt.username, tt.password); got != tt.want {
+				t.Errorf("AlterRolePasswordQuery() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
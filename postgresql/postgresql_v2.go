@@ -1,11 +1,9 @@
 package postgresql
 
 import (
-	"fmt"
 	"github.com/borealisdb/commons/constants"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
-	"strings"
 )
 
 type PostgresqlV2 interface {
@@ -23,11 +21,28 @@ type Args struct {
 
 	SSLRootCertPath string
 	SSLMode         string
+	// SSLCertPath and SSLKeyPath hold the client certificate used with the cert method of pg_hba
+	SSLCertPath string
+	SSLKeyPath  string
+
+	// ConnectTimeout is in seconds. See DSN for the other connection parameters
+	ConnectTimeout  int
+	ApplicationName string
+	// TargetSessionAttrs, e.g. read-write, makes GetDSN render a key/value DSN for libpq and pgx.
+	// GetConnection refuses it, as lib/pq would send it to the server which rejects it
+	TargetSessionAttrs string
+	ServerOptions      string
+	SearchPath         string
 }
 
-type V2 struct{}
+type V2 struct {
+	Pool PoolSettings
+}
 
 func (pg *V2) GetConnection(args Args) (*sqlx.DB, error) {
+	if args.TargetSessionAttrs != "" {
+		return &sqlx.DB{}, errTargetSessionAttrs
+	}
 	argsWithDefaults := pg.setDefaults(args)
 	dsn := pg.getDSN(argsWithDefaults)
 	return pg.Connect(dsn)
@@ -38,9 +53,7 @@ func (pg *V2) Connect(dsn string) (*sqlx.DB, error) {
 	if err != nil {
 		return &sqlx.DB{}, err
 	}
-	conn.SetMaxIdleConns(1)
-	conn.SetMaxOpenConns(1)
-	conn.SetConnMaxLifetime(0)
+	pg.Pool.singleConnection().apply(conn)
 	return conn, nil
 }
 
@@ -50,21 +63,22 @@ func (pg *V2) GetDSN(args Args) (string, error) {
 }
 
 func (pg *V2) getDSN(args Args) string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf(
-		"postgresql://%v:%v@%v:%v/%v?sslmode=%v",
-		args.Username,
-		args.Password,
-		args.Host,
-		args.Port,
-		args.Database,
-		args.SSLMode,
-	))
-	if args.SSLRootCertPath != "" {
-		sb.WriteString(fmt.Sprintf("&sslrootcert=%v", args.SSLRootCertPath))
-	}
-
-	return sb.String()
+	return DSN{
+		Host:               args.Host,
+		Port:               args.Port,
+		Database:           args.Database,
+		User:               args.Username,
+		Password:           args.Password,
+		SSLMode:            args.SSLMode,
+		SSLRootCert:        args.SSLRootCertPath,
+		SSLCert:            args.SSLCertPath,
+		SSLKey:             args.SSLKeyPath,
+		ConnectTimeout:     args.ConnectTimeout,
+		ApplicationName:    args.ApplicationName,
+		TargetSessionAttrs: args.TargetSessionAttrs,
+		Options:            args.ServerOptions,
+		SearchPath:         args.SearchPath,
+	}.render()
 }
 
 func (pg *V2) setDefaults(args Args) Args {
@@ -79,7 +93,9 @@ func (pg *V2) setDefaults(args Args) Args {
 		newArgs.Database = "postgres"
 	}
 
-	if args.SSLMode == "" {
+	if args.SSLMode == "" && args.SSLCertPath != "" {
+		newArgs.SSLMode = "require"
+	} else if args.SSLMode == "" {
 		newArgs.SSLMode = "disable"
 	} else if args.SSLRootCertPath != "" && args.SSLMode == "" {
 		newArgs.SSLMode = "verify-ca"
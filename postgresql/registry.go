@@ -0,0 +1,230 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/credentials"
+	"github.com/borealisdb/commons/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRegistryOpenTimeout bounds the opening of a pool, which does not end with the caller which asked for it
+const defaultRegistryOpenTimeout = 30 * time.Second
+
+// RegistryKey identifies a pool of a Registry
+type RegistryKey struct {
+	ClusterName string
+	Username    string
+	// Role defaults to constants.RoleMaster and Database to postgres
+	Role     string
+	Database string
+}
+
+func (k RegistryKey) normalize() RegistryKey {
+	if k.Role == "" {
+		k.Role = constants.RoleMaster
+	}
+	if k.Database == "" {
+		k.Database = "postgres"
+	}
+	return k
+}
+
+// Registry hands out pools shared by every caller of the same cluster, user, role and database, for multi-tenant services
+type Registry struct {
+	CredentialsProvider credentials.Credentials
+	// Options are the defaults of every pool, Role and Database are those of the key
+	Options             Options
+	HealthCheckInterval time.Duration
+	Log                 *logrus.Entry
+
+	mu    sync.Mutex
+	pools map[RegistryKey]*registryEntry
+	// postgres connects the pools, a PG of CredentialsProvider by default
+	postgres Postgresql
+}
+
+// registryEntry is ready once its pool is open, or failed to
+type registryEntry struct {
+	ready chan struct{}
+	pool  *Pool
+	err   error
+}
+
+// Get returns the pool of a key, opening it on first use. Concurrent callers of a new key wait for the same pool,
+// which is opened whether or not the caller which asked for it first is still waiting
+func (r *Registry) Get(ctx context.Context, key RegistryKey) (*Pool, error) {
+	key = key.normalize()
+
+	r.mu.Lock()
+	if r.pools == nil {
+		r.pools = map[RegistryKey]*registryEntry{}
+	}
+	entry, ok := r.pools[key]
+	if !ok {
+		entry = &registryEntry{ready: make(chan struct{})}
+		r.pools[key] = entry
+	}
+	postgres, log := r.getPostgres(), r.getLog()
+	r.mu.Unlock()
+
+	if !ok {
+		go func() {
+			openCtx, cancel := context.WithTimeout(detachedContext{ctx}, defaultRegistryOpenTimeout)
+			defer cancel()
+			entry.pool, entry.err = r.open(openCtx, key, postgres, log)
+			if entry.err != nil {
+				// The next caller tries again
+				r.mu.Lock()
+				delete(r.pools, key)
+				r.mu.Unlock()
+			}
+			close(entry.ready)
+		}()
+	}
+
+	select {
+	case <-entry.ready:
+		return entry.pool, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// detachedContext keeps the values of its parent but not its deadline nor its cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (r *Registry) open(ctx context.Context, key RegistryKey, postgres Postgresql, log *logrus.Entry) (*Pool, error) {
+	options := r.Options
+	options.Role, options.Database = key.Role, key.Database
+	pool := &Pool{
+		Postgres:            postgres,
+		ClusterName:         key.ClusterName,
+		Username:            key.Username,
+		Options:             options,
+		HealthCheckInterval: r.HealthCheckInterval,
+		Log:                 log,
+	}
+	if err := pool.Open(ctx); err != nil {
+		return nil, fmt.Errorf("could not open pool of %v@%v/%v (%v): %w", key.Username, key.ClusterName, key.Database, key.Role, err)
+	}
+	return pool, nil
+}
+
+// Run health checks every open pool until the context is done
+func (r *Registry) Run(ctx context.Context) {
+	interval := r.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	r.mu.Lock()
+	log := r.getLog()
+	r.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for key, pool := range r.openPools() {
+				if err := pool.HealthCheck(ctx); err != nil {
+					log.WithError(err).WithField("key", key).Warnf("connection pool is unhealthy")
+				}
+			}
+		}
+	}
+}
+
+// Invalidate makes Run reopen the pools of a cluster with fresh credentials, e.g. after they have been rotated
+func (r *Registry) Invalidate(clusterName string) {
+	for key, pool := range r.openPools() {
+		if key.ClusterName == clusterName {
+			pool.Invalidate()
+		}
+	}
+}
+
+// CloseCluster closes the pools of a cluster, e.g. once it has been deleted
+func (r *Registry) CloseCluster(clusterName string) error {
+	return r.close(func(key RegistryKey) bool {
+		return key.ClusterName == clusterName
+	})
+}
+
+func (r *Registry) Close() error {
+	return r.close(func(RegistryKey) bool {
+		return true
+	})
+}
+
+func (r *Registry) close(match func(RegistryKey) bool) error {
+	var errs []string
+	for key, pool := range r.openPools() {
+		if !match(key) {
+			continue
+		}
+		r.mu.Lock()
+		delete(r.pools, key)
+		r.mu.Unlock()
+		if err := pool.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", key.ClusterName, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not close pools: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// openPools returns the pools which are open, skipping those still opening
+func (r *Registry) openPools() map[RegistryKey]*Pool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pools := map[RegistryKey]*Pool{}
+	for key, entry := range r.pools {
+		select {
+		case <-entry.ready:
+			if entry.pool != nil {
+				pools[key] = entry.pool
+			}
+		default:
+		}
+	}
+	return pools
+}
+
+// getPostgres and getLog are called with mu held
+func (r *Registry) getPostgres() Postgresql {
+	if r.postgres == nil {
+		r.postgres = &PG{CredentialsProvider: r.CredentialsProvider}
+	}
+	return r.postgres
+}
+
+func (r *Registry) getLog() *logrus.Entry {
+	if r.Log == nil {
+		r.Log = logger.NewDefaultLogger("info", "postgresql")
+	}
+	return r.Log
+}
@@ -0,0 +1,143 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/borealisdb/commons/credentials"
+	"github.com/jmoiron/sqlx"
+)
+
+// countingPostgres counts the pools opened through it
+type countingPostgres struct {
+	fakePostgres
+	opens *int32
+}
+
+func (c countingPostgres) Connect(dsn string) (*sqlx.DB, error) {
+	atomic.AddInt32(c.opens, 1)
+	return c.fakePostgres.Connect(dsn)
+}
+
+func TestRegistry_Get(t *testing.T) {
+	ctx := context.Background()
+	testServer.setPassword("secret")
+	var opens int32
+	registry := &Registry{postgres: countingPostgres{opens: &opens}}
+	defer registry.Close()
+
+	keys := []RegistryKey{
+		{ClusterName: "tenant-a", Username: "application"},
+		{ClusterName: "tenant-b", Username: "application"},
+	}
+	pools := make([][]*Pool, len(keys))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := range keys {
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				pool, err := registry.Get(ctx, keys[i])
+				if err != nil {
+					t.Errorf("Get() error = %v", err)
+					return
+				}
+				mu.Lock()
+				pools[i] = append(pools[i], pool)
+				mu.Unlock()
+			}(i)
+		}
+	}
+	wg.Wait()
+
+	if opens != int32(len(keys)) {
+		t.Errorf("opened %v pools, want one per key", opens)
+	}
+	for i := range keys {
+		for _, pool := range pools[i] {
+			if pool != pools[i][0] {
+				t.Errorf("Get() returned several pools for %v", keys[i])
+			}
+		}
+	}
+	if pools[0][0] == pools[1][0] {
+		t.Errorf("Get() shared a pool between clusters")
+	}
+	if pool, _ := registry.Get(ctx, RegistryKey{ClusterName: "tenant-a", Username: "application", Role: "master", Database: "postgres"}); pool != pools[0][0] {
+		t.Errorf("Get() did not apply the default role and database to the key")
+	}
+
+	registry.Invalidate("tenant-b")
+	if err := pools[1][0].HealthCheck(ctx); err != nil {
+		t.Fatalf("HealthCheck() error = %v", err)
+	}
+	if opens != int32(len(keys))+1 {
+		t.Errorf("opened %v pools, want the invalidated pool to be reopened", opens)
+	}
+
+	if err := registry.CloseCluster("tenant-a"); err != nil {
+		t.Fatalf("CloseCluster() error = %v", err)
+	}
+	if pools[0][0].DB() != nil || pools[1][0].DB() == nil {
+		t.Errorf("CloseCluster() closed the wrong pools")
+	}
+}
+
+func TestRegistry_GetCancelled(t *testing.T) {
+	testServer.setPassword("secret")
+	var opens int32
+	registry := &Registry{postgres: countingPostgres{opens: &opens}}
+	defer registry.Close()
+	key := RegistryKey{ClusterName: "tenant-a", Username: "application"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := registry.Get(ctx, key); err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatalf("Get() with a cancelled context error = %v", err)
+	}
+	pool, err := registry.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if pool.DB() == nil || atomic.LoadInt32(&opens) != 1 {
+		t.Errorf("opened %v pools, want the pool of the cancelled caller to be shared", opens)
+	}
+}
+
+func TestPG_Concurrency(t *testing.T) {
+	for _, cluster := range []string{"tenanta", "tenantb"} {
+		t.Setenv(fmt.Sprintf("%v_CLUSTER_HOSTNAME", cluster), cluster+".example.com")
+		t.Setenv(fmt.Sprintf("%v_application_CLUSTER_PASSWORD", cluster), cluster+"-secret")
+	}
+	pg := &PG{CredentialsProvider: credentials.Environment{}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		cluster := []string{"tenanta", "tenantb"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+			resp, err := pg.GetCredentials(ctx, cluster, "application", Options{})
+			if err != nil {
+				t.Errorf("GetCredentials() error = %v", err)
+				return
+			}
+			dsn, err := pg.GetDSN(cluster, resp.Password, resp.Username, Options{})
+			if err != nil {
+				t.Errorf("GetDSN() error = %v", err)
+				return
+			}
+			if !strings.Contains(dsn, cluster+"-secret@"+cluster+".example.com") {
+				t.Errorf("GetDSN() of %v = %v", cluster, dsn)
+			}
+		}()
+	}
+	wg.Wait()
+}
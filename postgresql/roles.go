@@ -0,0 +1,53 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/lib/pq"
+)
+
+// RoleManager changes the passwords of Postgres roles through the admin user
+type RoleManager struct {
+	Postgres Postgresql
+	Options  Options
+}
+
+// SetPassword runs ALTER ROLE with the admin user
+func (r RoleManager) SetPassword(ctx context.Context, clusterName, username, password string) error {
+	conn, err := r.Postgres.GetConnection(ctx, clusterName, constants.AdminUsername, r.Options)
+	if err != nil {
+		return fmt.Errorf("could not GetConnection: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, AlterRolePasswordQuery(username, password)); err != nil {
+		return fmt.Errorf("could not alter role %v: %v", username, err)
+	}
+	return nil
+}
+
+// VerifyLogin opens a new session with the given password
+func (r RoleManager) VerifyLogin(ctx context.Context, clusterName, username, password string) error {
+	dsn, err := r.Postgres.GetDSNContext(ctx, clusterName, password, username, r.Options)
+	if err != nil {
+		return fmt.Errorf("could not GetDSNContext: %v", err)
+	}
+	conn, err := r.Postgres.Connect(dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.PingContext(ctx); err != nil {
+		return fmt.Errorf("could not login as %v: %v", username, err)
+	}
+	return nil
+}
+
+// AlterRolePasswordQuery returns the statement setting the password of a role,
+// which is quoted as ALTER ROLE does not accept bind parameters
+func AlterRolePasswordQuery(username, password string) string {
+	return fmt.Sprintf("ALTER ROLE %v WITH PASSWORD %v", pq.QuoteIdentifier(username), pq.QuoteLiteral(password))
+}
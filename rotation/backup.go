@@ -0,0 +1,93 @@
+package rotation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/helpers"
+	"github.com/borealisdb/commons/k8sutil"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const BackupEncryptionKeyRotatedAtKey = "backupEncryptionKeyRotatedAt"
+
+type RetiredBackupEncryptionKey struct {
+	Key       string    `json:"key"`
+	RetiredAt time.Time `json:"retiredAt"`
+}
+
+// RotateBackupEncryptionKey replaces the key new backups are encrypted with, keeping the previous ones in the history.
+// The update carries the resource version of the secret read, so it fails rather than overwrite a concurrent change
+func (r *Rotator) RotateBackupEncryptionKey(ctx context.Context, namespace, clusterName string) error {
+	secretName, err := r.getClusterSecretsName(ctx, namespace, clusterName)
+	if err != nil {
+		return err
+	}
+	secrets := r.KubeClient.Secrets(namespace)
+	secret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get secret %v: %v", secretName, err)
+	}
+	history, err := GetRetiredBackupEncryptionKeys(secret.Data)
+	if err != nil {
+		return fmt.Errorf("could not read secret %v: %v", secretName, err)
+	}
+
+	now := r.getNow()
+	if previous := string(secret.Data[constants.ClusterSecretsBackupEncryptionKey]); previous != "" {
+		history = append(history, RetiredBackupEncryptionKey{Key: previous, RetiredAt: now})
+	}
+	encodedHistory, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("could not marshal backup encryption key history: %v", err)
+	}
+	key := helpers.RandomPassword(constants.PasswordLength)
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[constants.ClusterSecretsBackupEncryptionKey] = []byte(key)
+	secret.Data[constants.ClusterSecretsBackupEncryptionKeyHistory] = encodedHistory
+	secret.Data[BackupEncryptionKeyRotatedAtKey] = []byte(now.Format(time.RFC3339))
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("could not update secret %v: %v", secretName, err)
+	}
+	r.invalidate(namespace, clusterName)
+
+	r.getLog().WithFields(logrus.Fields{"cluster": clusterName, "namespace": namespace}).Infof("backup encryption key rotated")
+	return nil
+}
+
+// GetRetiredBackupEncryptionKeys returns the keys older backups have been encrypted with, the oldest first
+func GetRetiredBackupEncryptionKeys(data map[string][]byte) ([]RetiredBackupEncryptionKey, error) {
+	var history []RetiredBackupEncryptionKey
+	encoded, ok := data[constants.ClusterSecretsBackupEncryptionKeyHistory]
+	if !ok || len(encoded) == 0 {
+		return history, nil
+	}
+	if err := json.Unmarshal(encoded, &history); err != nil {
+		return nil, fmt.Errorf("could not unmarshal %v: %v", constants.ClusterSecretsBackupEncryptionKeyHistory, err)
+	}
+	return history, nil
+}
+
+// getClusterSecretsName returns the secret holding the backup credentials of the cluster
+func (r *Rotator) getClusterSecretsName(ctx context.Context, namespace, clusterName string) (string, error) {
+	if r.KubeClient.PostgresqlsGetter == nil {
+		return constants.GetClusterSecrets(clusterName), nil
+	}
+	cluster, err := r.KubeClient.Postgresqls(namespace).Get(ctx, clusterName, metav1.GetOptions{})
+	if k8sutil.ResourceNotFound(err) {
+		return "", fmt.Errorf("no cluster found with name %v in namespace %v", clusterName, namespace)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get cluster %v: %v", clusterName, err)
+	}
+	if cluster.Spec.ClusterSecretsName == "" {
+		return constants.GetClusterSecrets(clusterName), nil
+	}
+	return cluster.Spec.ClusterSecretsName, nil
+}
@@ -0,0 +1,217 @@
+package rotation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/borealisdb/commons/constants"
+	"github.com/borealisdb/commons/helpers"
+	"github.com/borealisdb/commons/k8sutil"
+	"github.com/borealisdb/commons/logger"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PreviousPasswordKey holds the password before the last rotation, which Postgres does not accept anymore
+	PreviousPasswordKey          = "previousPassword"
+	PreviousPasswordExpiresAtKey = "previousPasswordExpiresAt"
+	RotatedAtKey                 = "rotatedAt"
+
+	DefaultGracePeriod = 24 * time.Hour
+)
+
+// systemUsernames are the users Borealis and Spilo connect with. Postgres accepts a single password per role,
+// so they would be locked out until every component reads the new password
+var systemUsernames = []string{
+	constants.AdminUsername,
+	constants.ReplicationUsername,
+	constants.MonitoringUsername,
+	constants.BackupUsername,
+}
+
+// Roles changes and checks the passwords of Postgres roles, postgresql.RoleManager implements it
+type Roles interface {
+	SetPassword(ctx context.Context, clusterName, username, password string) error
+	VerifyLogin(ctx context.Context, clusterName, username, password string) error
+}
+
+// Invalidator forgets what it cached about a cluster, credentials.Cache and postgresql.Registry implement it
+type Invalidator interface {
+	Invalidate(clusterName string)
+}
+
+// Rotator rotates the passwords stored in the <cluster>-<user>-credentials secrets and the backup encryption keys.
+// Postgres accepts a single password per role, so consumers must switch to the new one right away: the previous one
+// is only kept in the secret for GracePeriod to roll the rotation back by hand, nothing can log in with it
+type Rotator struct {
+	KubeClient     k8sutil.KubernetesClient
+	Roles          Roles
+	GracePeriod    time.Duration
+	PasswordLength int
+	// Invalidators are told about every rotation in order, the credentials caches before the pools reading from them
+	Invalidators []Invalidator
+	Log          *logrus.Entry
+
+	logOnce sync.Once
+	now     func() time.Time
+}
+
+type PasswordRotation struct {
+	ClusterName               string
+	Namespace                 string
+	Username                  string
+	RotatedAt                 time.Time
+	PreviousPasswordExpiresAt time.Time
+}
+
+// RotatePassword sets a new password on the role, stores it in the secret and checks it can be used to log in,
+// then invalidates the cached credentials and pools of the cluster. Every change is rolled back when a step fails.
+// The users Borealis connects with are refused
+func (r *Rotator) RotatePassword(ctx context.Context, namespace, clusterName, username string) (PasswordRotation, error) {
+	for _, systemUsername := range systemUsernames {
+		if username == systemUsername {
+			return PasswordRotation{}, fmt.Errorf("user %v is used by Borealis itself, its password can not be rotated", username)
+		}
+	}
+	secrets := r.KubeClient.Secrets(namespace)
+	secretName := constants.GetCredentialSecretNameForCluster(username, clusterName)
+	secret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return PasswordRotation{}, fmt.Errorf("could not get secret %v: %v", secretName, err)
+	}
+	previousPassword := constants.GetPasswordFromSecret(secret)
+	if previousPassword == "" {
+		return PasswordRotation{}, fmt.Errorf("password for user %v not found in secret %v", username, secretName)
+	}
+
+	// The qualified name lets the credentials provider find the cluster whatever the namespaces it sees
+	target := k8sutil.NamespacedName{Namespace: namespace, Name: clusterName}.String()
+	password := helpers.RandomPassword(r.getPasswordLength())
+	if err := r.Roles.SetPassword(ctx, target, username, password); err != nil {
+		return PasswordRotation{}, fmt.Errorf("could not set password of %v: %v", username, err)
+	}
+
+	now := r.getNow()
+	rotation := PasswordRotation{
+		ClusterName:               clusterName,
+		Namespace:                 namespace,
+		Username:                  username,
+		RotatedAt:                 now,
+		PreviousPasswordExpiresAt: now.Add(r.getGracePeriod()),
+	}
+	original := secret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[constants.PostgresClusterSecretPasswordKey] = []byte(password)
+	secret.Data[PreviousPasswordKey] = []byte(previousPassword)
+	secret.Data[PreviousPasswordExpiresAtKey] = []byte(rotation.PreviousPasswordExpiresAt.Format(time.RFC3339))
+	secret.Data[RotatedAtKey] = []byte(now.Format(time.RFC3339))
+	updated, err := secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if err != nil {
+		err = fmt.Errorf("could not update secret %v: %v", secretName, err)
+		return PasswordRotation{}, r.rollback(ctx, target, username, previousPassword, nil, nil, err)
+	}
+	// The new password may have been read in the meantime, whether the rotation succeeds or is rolled back
+	defer r.invalidate(namespace, clusterName)
+
+	if err := r.Roles.VerifyLogin(ctx, target, username, password); err != nil {
+		err = fmt.Errorf("could not verify the new password of %v: %v", username, err)
+		return PasswordRotation{}, r.rollback(ctx, target, username, previousPassword, updated, original, err)
+	}
+
+	r.getLog().WithFields(logrus.Fields{"cluster": target, "username": username}).Infof("password rotated")
+	return rotation, nil
+}
+
+// ExpirePreviousPassword drops the previous password from the secret once the grace period is over.
+// It returns whether the secret has been updated
+func (r *Rotator) ExpirePreviousPassword(ctx context.Context, namespace, clusterName, username string) (bool, error) {
+	secrets := r.KubeClient.Secrets(namespace)
+	secretName := constants.GetCredentialSecretNameForCluster(username, clusterName)
+	secret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("could not get secret %v: %v", secretName, err)
+	}
+	expiresAt, ok := secret.Data[PreviousPasswordExpiresAtKey]
+	if !ok {
+		return false, nil
+	}
+	expiration, err := time.Parse(time.RFC3339, string(expiresAt))
+	if err != nil {
+		return false, fmt.Errorf("could not parse %v of secret %v: %v", PreviousPasswordExpiresAtKey, secretName, err)
+	}
+	if r.getNow().Before(expiration) {
+		return false, nil
+	}
+
+	delete(secret.Data, PreviousPasswordKey)
+	delete(secret.Data, PreviousPasswordExpiresAtKey)
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return false, fmt.Errorf("could not update secret %v: %v", secretName, err)
+	}
+	return true, nil
+}
+
+// rollback restores the previous password of the role and, when it has been updated, the original secret
+func (r *Rotator) rollback(ctx context.Context, target, username, previousPassword string, updated, original *v1.Secret, cause error) error {
+	var errs []error
+	if err := r.Roles.SetPassword(ctx, target, username, previousPassword); err != nil {
+		errs = append(errs, fmt.Errorf("could not restore password of %v: %v", username, err))
+	}
+	if updated != nil {
+		// The updated secret carries the resource version expected by the API server
+		updated.Data = original.Data
+		if _, err := r.KubeClient.Secrets(updated.Namespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("could not restore secret %v: %v", updated.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		r.getLog().WithError(cause).Errorf("could not roll back the rotation of %v: %v", username, errs)
+		return fmt.Errorf("%v, rollback failed: %v", cause, errs)
+	}
+	return fmt.Errorf("%v, rotation rolled back", cause)
+}
+
+// invalidate tells the Invalidators about a rotation, under the qualified and the bare name the cluster may be looked up by
+func (r *Rotator) invalidate(namespace, clusterName string) {
+	target := k8sutil.NamespacedName{Namespace: namespace, Name: clusterName}.String()
+	for _, invalidator := range r.Invalidators {
+		invalidator.Invalidate(target)
+		invalidator.Invalidate(clusterName)
+	}
+}
+
+func (r *Rotator) getPasswordLength() int {
+	if r.PasswordLength <= 0 {
+		return constants.PasswordLength
+	}
+	return r.PasswordLength
+}
+
+func (r *Rotator) getGracePeriod() time.Duration {
+	if r.GracePeriod <= 0 {
+		return DefaultGracePeriod
+	}
+	return r.GracePeriod
+}
+
+func (r *Rotator) getNow() time.Time {
+	if r.now == nil {
+		return time.Now()
+	}
+	return r.now()
+}
+
+func (r *Rotator) getLog() *logrus.Entry {
+	r.logOnce.Do(func() {
+		if r.Log == nil {
+			r.Log = logger.NewDefaultLogger("info", "rotation")
+		}
+	})
+	return r.Log
+}
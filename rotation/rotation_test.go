@@ -0,0 +1,180 @@
+package rotation
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	borealisdbv1 "github.com/borealisdb/commons/borealisdb.io/v1"
+	"github.com/borealisdb/commons/constants"
+	borealisfake "github.com/borealisdb/commons/generated/clientset/versioned/fake"
+	"github.com/borealisdb/commons/k8sutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeRoles keeps the password of every role in memory
+type fakeRoles struct {
+	passwords map[string]string
+	setErr    error
+	verifyErr error
+}
+
+func (f *fakeRoles) SetPassword(ctx context.Context, clusterName, username, password string) error {
+	if f.setErr != nil && password != "old" {
+		return f.setErr
+	}
+	f.passwords[clusterName+"/"+username] = password
+	return nil
+}
+
+func (f *fakeRoles) VerifyLogin(ctx context.Context, clusterName, username, password string) error {
+	if f.verifyErr != nil {
+		return f.verifyErr
+	}
+	if f.passwords[clusterName+"/"+username] != password {
+		return fmt.Errorf("password authentication failed for user %v", username)
+	}
+	return nil
+}
+
+// recordingInvalidator records the invalidated clusters
+type recordingInvalidator struct {
+	clusterNames []string
+}
+
+func (r *recordingInvalidator) Invalidate(clusterName string) {
+	r.clusterNames = append(r.clusterNames, clusterName)
+}
+
+func newCredentialsSecret(username string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: constants.GetCredentialSecretNameForCluster(username, "mycluster"), Namespace: "databases"},
+		Data:       map[string][]byte{constants.PostgresClusterSecretPasswordKey: []byte("old")},
+	}
+}
+
+func TestRotator_RotatePassword(t *testing.T) {
+	tests := []struct {
+		name      string
+		setErr    error
+		verifyErr error
+		wantErr   bool
+	}{
+		{name: "rotates the password"},
+		{name: "alter role fails", setErr: fmt.Errorf("connection refused"), wantErr: true},
+		{name: "login with the new password fails", verifyErr: fmt.Errorf("no pg_hba.conf entry"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			clientset := fake.NewSimpleClientset(newCredentialsSecret(constants.Application))
+			roles := &fakeRoles{passwords: map[string]string{"databases/mycluster/application": "old"}, setErr: tt.setErr, verifyErr: tt.verifyErr}
+			now := time.Now()
+			invalidator := &recordingInvalidator{}
+			rotator := &Rotator{
+				KubeClient:   k8sutil.KubernetesClient{SecretsGetter: clientset.CoreV1()},
+				Roles:        roles,
+				Invalidators: []Invalidator{invalidator},
+				now:          func() time.Time { return now },
+			}
+
+			_, err := rotator.RotatePassword(ctx, "databases", "mycluster", constants.Application)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RotatePassword() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			secret, _ := clientset.CoreV1().Secrets("databases").Get(ctx, constants.GetCredentialSecretNameForCluster(constants.Application, "mycluster"), metav1.GetOptions{})
+			password := constants.GetPasswordFromSecret(secret)
+			if roles.passwords["databases/mycluster/application"] != password {
+				t.Errorf("role password %v differs from the secret %v", roles.passwords["databases/mycluster/application"], password)
+			}
+			if tt.wantErr {
+				if password != "old" || secret.Data[PreviousPasswordKey] != nil {
+					t.Errorf("secret has not been rolled back: %v", secret.Data)
+				}
+				return
+			}
+			if len(password) != constants.PasswordLength || string(secret.Data[PreviousPasswordKey]) != "old" {
+				t.Errorf("secret has not been rotated: %v", secret.Data)
+			}
+			if want := []string{"databases/mycluster", "mycluster"}; !reflect.DeepEqual(invalidator.clusterNames, want) {
+				t.Errorf("invalidated %v, want %v", invalidator.clusterNames, want)
+			}
+
+			if expired, err := rotator.ExpirePreviousPassword(ctx, "databases", "mycluster", constants.Application); err != nil || expired {
+				t.Errorf("ExpirePreviousPassword() = %v, %v during the grace period", expired, err)
+			}
+			now = now.Add(DefaultGracePeriod)
+			if expired, err := rotator.ExpirePreviousPassword(ctx, "databases", "mycluster", constants.Application); err != nil || !expired {
+				t.Errorf("ExpirePreviousPassword() = %v, %v after the grace period", expired, err)
+			}
+		})
+	}
+}
+
+func TestRotator_RotatePasswordSystemUser(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(newCredentialsSecret(constants.AdminUsername))
+	roles := &fakeRoles{passwords: map[string]string{"databases/mycluster/postgres": "old"}}
+	rotator := &Rotator{KubeClient: k8sutil.KubernetesClient{SecretsGetter: clientset.CoreV1()}, Roles: roles}
+
+	if _, err := rotator.RotatePassword(ctx, "databases", "mycluster", constants.AdminUsername); err == nil {
+		t.Errorf("RotatePassword() of %v should fail", constants.AdminUsername)
+	}
+	if roles.passwords["databases/mycluster/postgres"] != "old" {
+		t.Errorf("password of %v has been changed", constants.AdminUsername)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	created := metav1.NewTime(time.Now().Add(-48 * time.Hour))
+	clusterSecrets := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "mycluster-backup", Namespace: "databases", CreationTimestamp: created},
+		Data:       map[string][]byte{constants.ClusterSecretsBackupEncryptionKey: []byte("first")},
+	}
+	application, developer := newCredentialsSecret(constants.Application), newCredentialsSecret(constants.Developer)
+	application.CreationTimestamp, developer.CreationTimestamp = created, created
+	clientset := fake.NewSimpleClientset(clusterSecrets, application, developer)
+	borealisClient := borealisfake.NewSimpleClientset(&borealisdbv1.Postgresql{
+		ObjectMeta: metav1.ObjectMeta{Name: "mycluster", Namespace: "databases", Annotations: map[string]string{
+			ScheduleAnnotation:          "24h",
+			UsersAnnotation:             constants.Application,
+			BackupKeyScheduleAnnotation: "24h",
+		}},
+		Spec: borealisdbv1.PostgresSpec{ClusterSecretsName: "mycluster-backup"},
+	})
+	roles := &fakeRoles{passwords: map[string]string{}}
+	scheduler := &Scheduler{Rotator: &Rotator{
+		KubeClient: k8sutil.KubernetesClient{SecretsGetter: clientset.CoreV1(), PostgresqlsGetter: borealisClient.BorealisdbV1()},
+		Roles:      roles,
+	}}
+
+	for i := 0; i < 2; i++ {
+		if err := scheduler.RunOnce(ctx); err != nil {
+			t.Fatalf("RunOnce() error = %v", err)
+		}
+	}
+
+	secrets := clientset.CoreV1().Secrets("databases")
+	secret, _ := secrets.Get(ctx, application.Name, metav1.GetOptions{})
+	if string(secret.Data[PreviousPasswordKey]) != "old" || len(roles.passwords) != 1 {
+		t.Errorf("application password has not been rotated once: %v", secret.Data)
+	}
+	secret, _ = secrets.Get(ctx, developer.Name, metav1.GetOptions{})
+	if constants.GetPasswordFromSecret(secret) != "old" {
+		t.Errorf("developer password has been rotated without being listed in %v", UsersAnnotation)
+	}
+
+	secret, _ = secrets.Get(ctx, clusterSecrets.Name, metav1.GetOptions{})
+	history, err := GetRetiredBackupEncryptionKeys(secret.Data)
+	if err != nil || len(history) != 1 || history[0].Key != "first" {
+		t.Errorf("backup encryption key history = %v, %v", history, err)
+	}
+	if key := string(secret.Data[constants.ClusterSecretsBackupEncryptionKey]); key == "first" || key == "" {
+		t.Errorf("backup encryption key has not been rotated")
+	}
+}
@@ -0,0 +1,181 @@
+package rotation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	borealisdbv1 "github.com/borealisdb/commons/borealisdb.io/v1"
+	"github.com/borealisdb/commons/constants"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ScheduleAnnotation on a Postgresql sets how often the passwords are rotated, as a duration like 720h
+	ScheduleAnnotation = constants.DomainName + "/rotate-credentials-every"
+	// UsersAnnotation lists the users to rotate, separated by commas, DefaultUsernames otherwise
+	UsersAnnotation = constants.DomainName + "/rotate-credentials-users"
+	// BackupKeyScheduleAnnotation sets how often the backup encryption key is rotated
+	BackupKeyScheduleAnnotation = constants.DomainName + "/rotate-backup-key-every"
+
+	DefaultScheduleInterval = time.Hour
+)
+
+// DefaultUsernames are rotated when UsersAnnotation is not set.
+// The users Borealis itself connects with are left out, RotatePassword refuses them
+var DefaultUsernames = []string{
+	constants.Migrator,
+	constants.Application,
+	constants.Developer,
+	constants.Analyst,
+}
+
+// Scheduler rotates the credentials of the clusters which are annotated with a schedule
+type Scheduler struct {
+	Rotator  *Rotator
+	Interval time.Duration
+	// Namespace restricts the clusters to rotate, all namespaces are watched when empty
+	Namespace string
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.getInterval())
+	defer ticker.Stop()
+	for {
+		if err := s.RunOnce(ctx); err != nil {
+			s.Rotator.getLog().WithError(err).Errorf("could not rotate credentials")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce rotates the credentials which are due and drops the previous passwords which have expired
+func (s *Scheduler) RunOnce(ctx context.Context) error {
+	clusters, err := s.Rotator.KubeClient.Postgresqls(s.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list clusters: %v", err)
+	}
+
+	var errs []string
+	for _, cluster := range clusters.Items {
+		if err := s.rotateCluster(ctx, cluster); err != nil {
+			errs = append(errs, fmt.Sprintf("%v/%v: %v", cluster.Namespace, cluster.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (s *Scheduler) rotateCluster(ctx context.Context, cluster borealisdbv1.Postgresql) error {
+	var errs []string
+	if every, ok, err := getSchedule(cluster, ScheduleAnnotation); err != nil {
+		errs = append(errs, err.Error())
+	} else if ok {
+		for _, username := range getUsernames(cluster) {
+			if err := s.rotateUser(ctx, cluster, username, every); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if every, ok, err := getSchedule(cluster, BackupKeyScheduleAnnotation); err != nil {
+		errs = append(errs, err.Error())
+	} else if ok {
+		if err := s.rotateBackupKey(ctx, cluster, every); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (s *Scheduler) rotateUser(ctx context.Context, cluster borealisdbv1.Postgresql, username string, every time.Duration) error {
+	secretName := constants.GetCredentialSecretNameForCluster(username, cluster.Name)
+	secret, err := s.Rotator.KubeClient.Secrets(cluster.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get secret %v: %v", secretName, err)
+	}
+
+	if !s.isDue(secret, RotatedAtKey, every) {
+		_, err := s.Rotator.ExpirePreviousPassword(ctx, cluster.Namespace, cluster.Name, username)
+		return err
+	}
+	s.Rotator.getLog().WithFields(logrus.Fields{"cluster": cluster.Name, "namespace": cluster.Namespace, "username": username}).
+		Infof("password rotation is due")
+	_, err = s.Rotator.RotatePassword(ctx, cluster.Namespace, cluster.Name, username)
+	return err
+}
+
+func (s *Scheduler) rotateBackupKey(ctx context.Context, cluster borealisdbv1.Postgresql, every time.Duration) error {
+	secretName := cluster.Spec.ClusterSecretsName
+	if secretName == "" {
+		secretName = constants.GetClusterSecrets(cluster.Name)
+	}
+	secret, err := s.Rotator.KubeClient.Secrets(cluster.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get secret %v: %v", secretName, err)
+	}
+	if !s.isDue(secret, BackupEncryptionKeyRotatedAtKey, every) {
+		return nil
+	}
+	return s.Rotator.RotateBackupEncryptionKey(ctx, cluster.Namespace, cluster.Name)
+}
+
+// isDue tells whether the secret has not been rotated for the given duration, since its creation if it never was
+func (s *Scheduler) isDue(secret *v1.Secret, rotatedAtKey string, every time.Duration) bool {
+	rotatedAt := secret.CreationTimestamp.Time
+	if value, ok := secret.Data[rotatedAtKey]; ok {
+		if parsed, err := time.Parse(time.RFC3339, string(value)); err == nil {
+			rotatedAt = parsed
+		}
+	}
+	return !s.Rotator.getNow().Before(rotatedAt.Add(every))
+}
+
+func getSchedule(cluster borealisdbv1.Postgresql, annotation string) (time.Duration, bool, error) {
+	value, ok := cluster.Annotations[annotation]
+	if !ok {
+		return 0, false, nil
+	}
+	every, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("could not parse annotation %v: %v", annotation, err)
+	}
+	if every <= 0 {
+		return 0, false, fmt.Errorf("annotation %v must be a positive duration", annotation)
+	}
+	return every, true, nil
+}
+
+func getUsernames(cluster borealisdbv1.Postgresql) []string {
+	value, ok := cluster.Annotations[UsersAnnotation]
+	if !ok {
+		return DefaultUsernames
+	}
+	var usernames []string
+	for _, username := range strings.Split(value, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+func (s *Scheduler) getInterval() time.Duration {
+	if s.Interval <= 0 {
+		return DefaultScheduleInterval
+	}
+	return s.Interval
+}